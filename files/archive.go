@@ -0,0 +1,113 @@
+package files
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	FormatZip   = "zip"
+	FormatTarGz = "tar.gz"
+)
+
+var ErrInvalidArchive = errors.New("archive format must be zip or tar.gz")
+
+// Entry is a file to archive: Path on disk stored as Name.
+type Entry struct {
+	Name string
+	Path string
+}
+
+// ArchiveFormat returns the format named by name, zip when empty, and its
+// content type.
+func ArchiveFormat(name string) (string, string, error) {
+	switch strings.ToLower(name) {
+	case "", FormatZip:
+		return FormatZip, "application/zip", nil
+	case FormatTarGz, "tgz":
+		return FormatTarGz, "application/gzip", nil
+	default:
+		return "", "", fmt.Errorf("%w: %q", ErrInvalidArchive, name)
+	}
+}
+
+// WriteArchive streams entries to w as a zip or tar.gz archive.
+func WriteArchive(w io.Writer, format string, entries []Entry) error {
+	switch format {
+	case FormatZip:
+		zw := zip.NewWriter(w)
+		for _, e := range entries {
+			if err := addZip(zw, e); err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	case FormatTarGz:
+		gz := gzip.NewWriter(w)
+		tw := tar.NewWriter(gz)
+		for _, e := range entries {
+			if err := addTar(tw, e); err != nil {
+				return err
+			}
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return gz.Close()
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidArchive, format)
+	}
+}
+
+func addZip(zw *zip.Writer, e Entry) error {
+	f, err := os.Open(e.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	hdr.Name = e.Name
+	hdr.Method = zip.Deflate
+	dst, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+func addTar(tw *tar.Writer, e Entry) error {
+	f, err := os.Open(e.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = e.Name
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	// Copy no more than the header promised in case the file is growing.
+	_, err = io.CopyN(tw, f, hdr.Size)
+	return err
+}
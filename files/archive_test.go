@@ -0,0 +1,81 @@
+package files
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWriteArchive(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite(t, filepath.Join(dir, "a.csv"), "a")
+	mustWrite(t, filepath.Join(dir, "dir", "b.csv"), "bb")
+	entries := []Entry{
+		{Path: filepath.Join(dir, "a.csv"), Name: "a.csv"},
+		{Path: filepath.Join(dir, "dir", "b.csv"), Name: "dir/b.csv"},
+	}
+	want := map[string]string{"a.csv": "a", "dir/b.csv": "bb"}
+
+	for _, format := range []string{FormatZip, FormatTarGz} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteArchive(&buf, format, entries); err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]string)
+			if format == FormatZip {
+				zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, f := range zr.File {
+					rc, err := f.Open()
+					if err != nil {
+						t.Fatal(err)
+					}
+					data, _ := io.ReadAll(rc)
+					rc.Close()
+					got[f.Name] = string(data)
+				}
+			} else {
+				gz, err := gzip.NewReader(&buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tr := tar.NewReader(gz)
+				for {
+					h, err := tr.Next()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					data, _ := io.ReadAll(tr)
+					got[h.Name] = string(data)
+				}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("archive holds %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestArchiveFormat(t *testing.T) {
+	tests := map[string]string{"": FormatZip, "ZIP": FormatZip, "tgz": FormatTarGz, "tar.gz": FormatTarGz}
+	for name, want := range tests {
+		if format, _, err := ArchiveFormat(name); err != nil || format != want {
+			t.Errorf("ArchiveFormat(%q) = %q, %v, want %s", name, format, err, want)
+		}
+	}
+	if _, _, err := ArchiveFormat("rar"); !errors.Is(err, ErrInvalidArchive) {
+		t.Errorf("ArchiveFormat(rar) error = %v, want ErrInvalidArchive", err)
+	}
+}
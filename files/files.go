@@ -0,0 +1,160 @@
+// Package files lists, serves and bundles the files the services write to
+// their output directories without letting a request reach outside them.
+package files
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidPath = errors.New("invalid file path")
+	ErrNotFound    = errors.New("file not found")
+	// ErrNoRoot is returned for an empty root, which would otherwise be the
+	// working directory.
+	ErrNoRoot = errors.New("no root directory is configured")
+)
+
+// Info describes a file by its slash separated path below the root.
+type Info struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// Clean validates a slash separated relative path. It rejects absolute paths,
+// backslashes, NUL bytes and any ".." element rather than resolving them.
+func Clean(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, "\\\x00") || path.IsAbs(name) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidPath, name)
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("%w: %q", ErrInvalidPath, name)
+		}
+	}
+	name = path.Clean(name)
+	if name == "." {
+		return "", fmt.Errorf("%w: %q", ErrInvalidPath, name)
+	}
+	return name, nil
+}
+
+// absRoot returns root as an absolute path. An empty root is an error.
+func absRoot(root string) (string, error) {
+	if root == "" {
+		return "", ErrNoRoot
+	}
+	return filepath.Abs(root)
+}
+
+// Resolve returns the absolute path of name below root. When the file exists
+// its symlinks are followed and the result must still be inside root.
+func Resolve(root, name string) (string, error) {
+	root, err := absRoot(root)
+	if err != nil {
+		return "", err
+	}
+	name, err = Clean(name)
+	if err != nil {
+		return "", err
+	}
+	p := filepath.Join(root, filepath.FromSlash(name))
+
+	real, err := filepath.EvalSymlinks(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	if !within(realRoot, real) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidPath, name)
+	}
+	return p, nil
+}
+
+func within(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Open opens the regular file name below root.
+func Open(root, name string) (*os.File, fs.FileInfo, error) {
+	p, err := Resolve(root, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, fmt.Errorf("%w: %q", ErrNotFound, name)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, nil, fmt.Errorf("%w: %q", ErrNotFound, name)
+	}
+	return f, fi, nil
+}
+
+// List returns the regular files below dir, a path relative to root or ""
+// for all of root, sorted by path. Temporary files of writes in progress and
+// symlinks are left out. A missing directory has no files.
+func List(root, dir string) ([]Info, error) {
+	root, err := absRoot(root)
+	if err != nil {
+		return nil, err
+	}
+	start := root
+	if dir != "" {
+		if start, err = Resolve(root, dir); err != nil {
+			return nil, err
+		}
+	}
+
+	var infos []Info
+	err = filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == start && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasSuffix(d.Name(), ".tmp") {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		infos = append(infos, Info{Path: filepath.ToSlash(rel), Size: fi.Size(), ModTime: fi.ModTime().UTC()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Path < infos[j].Path })
+	return infos, nil
+}
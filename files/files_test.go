@@ -0,0 +1,178 @@
+package files
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestClean(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		err  error
+	}{
+		{"a.csv", "a.csv", nil},
+		{"dir/a.csv", "dir/a.csv", nil},
+		{"dir//./a.csv", "dir/a.csv", nil},
+		{"dir/", "dir", nil},
+		{"", "", ErrInvalidPath},
+		{".", "", ErrInvalidPath},
+		{"./", "", ErrInvalidPath},
+		{"..", "", ErrInvalidPath},
+		{"../a.csv", "", ErrInvalidPath},
+		{"dir/../a.csv", "", ErrInvalidPath},
+		{"dir/..", "", ErrInvalidPath},
+		{"/etc/passwd", "", ErrInvalidPath},
+		{`dir\a.csv`, "", ErrInvalidPath},
+		{"a\x00.csv", "", ErrInvalidPath},
+	}
+	for _, tt := range tests {
+		got, err := Clean(tt.name)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("Clean(%q) error = %v, want %v", tt.name, err, tt.err)
+		}
+		if got != tt.want {
+			t.Errorf("Clean(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	mustWrite(t, filepath.Join(root, "dir", "a.csv"), "a")
+	mustWrite(t, filepath.Join(outside, "secret"), "s")
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "dir", "a.csv"), filepath.Join(root, "inside")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		root string
+		name string
+		want string
+		err  error
+	}{
+		{root, "dir/a.csv", filepath.Join(root, "dir", "a.csv"), nil},
+		{root, "missing.csv", filepath.Join(root, "missing.csv"), nil},
+		{root, "inside", filepath.Join(root, "inside"), nil},
+		{root, "escape", "", ErrInvalidPath},
+		{root, "../secret", "", ErrInvalidPath},
+		{root, "/etc/passwd", "", ErrInvalidPath},
+		{"", "a.csv", "", ErrNoRoot},
+	}
+	for _, tt := range tests {
+		got, err := Resolve(tt.root, tt.name)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("Resolve(%q, %q) error = %v, want %v", tt.root, tt.name, err, tt.err)
+		}
+		if got != tt.want {
+			t.Errorf("Resolve(%q, %q) = %q, want %q", tt.root, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResolveRelativeRoot(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Resolve("out", "a.csv")
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if want := filepath.Join(wd, "out", "a.csv"); got != want {
+		t.Errorf("Resolve = %q, want %q", got, want)
+	}
+}
+
+func TestList(t *testing.T) {
+	root := t.TempDir()
+	mustWrite(t, filepath.Join(root, "b.csv"), "bb")
+	mustWrite(t, filepath.Join(root, "dir", "a.csv"), "a")
+	mustWrite(t, filepath.Join(root, "dir", "c.csv.tmp"), "partial")
+	if err := os.Symlink(filepath.Join(root, "b.csv"), filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dir  string
+		want []string
+		err  error
+	}{
+		{"", []string{"b.csv", "dir/a.csv"}, nil},
+		{"dir", []string{"dir/a.csv"}, nil},
+		{"missing", nil, nil},
+		{"../", nil, ErrInvalidPath},
+	}
+	for _, tt := range tests {
+		infos, err := List(root, tt.dir)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("List(%q) error = %v, want %v", tt.dir, err, tt.err)
+		}
+		var got []string
+		for _, fi := range infos {
+			got = append(got, fi.Path)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("List(%q) = %q, want %q", tt.dir, got, tt.want)
+		}
+	}
+
+	if _, err := List("", ""); !errors.Is(err, ErrNoRoot) {
+		t.Errorf("List with no root: error = %v, want ErrNoRoot", err)
+	}
+}
+
+func TestNewServerNoRoot(t *testing.T) {
+	if _, err := NewServer("x", map[string]string{"a": t.TempDir(), "b": ""}); !errors.Is(err, ErrNoRoot) {
+		t.Errorf("NewServer with an empty root: error = %v, want ErrNoRoot", err)
+	}
+	if _, err := NewServer("x", nil); !errors.Is(err, ErrNoRoot) {
+		t.Errorf("NewServer without roots: error = %v, want ErrNoRoot", err)
+	}
+}
+
+func TestServerServeFile(t *testing.T) {
+	mappings, deps := t.TempDir(), t.TempDir()
+	mustWrite(t, filepath.Join(mappings, "P.csv"), "mapping")
+	s, err := NewServer("all", map[string]string{"mappings": mappings, "dependencies": deps})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"mappings/P.csv", http.StatusOK},
+		{"mappings/missing.csv", http.StatusNotFound},
+		{"dependencies/P.csv", http.StatusNotFound},
+		{"other/P.csv", http.StatusNotFound},
+		{"mappings/../P.csv", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.ServeFile(w, httptest.NewRequest(http.MethodGet, "/", nil), tt.path)
+		if w.Code != tt.code {
+			t.Errorf("ServeFile(%q) = %d, want %d", tt.path, w.Code, tt.code)
+		}
+	}
+}
+
+func mustWrite(t *testing.T, name, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
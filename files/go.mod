@@ -0,0 +1,3 @@
+module github.com/AmitSuresh/sfdataapp/files
+
+go 1.22.4
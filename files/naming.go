@@ -0,0 +1,154 @@
+package files
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ManifestFile is written next to the files it describes.
+const ManifestFile = "manifest.json"
+
+// maxNameLength leaves room for suffixes and an extension within the 255
+// bytes most file systems allow.
+const maxNameLength = 200
+
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Sanitize makes s safe to use as a file name on any platform. Path
+// separators, characters Windows reserves and control or invisible format
+// characters become underscores, leading and trailing dots and spaces are
+// dropped, device names such as CON are prefixed and long names are cut.
+func Sanitize(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r == utf8.RuneError, unicode.IsControl(r), unicode.Is(unicode.Cf, r),
+			strings.ContainsRune(`<>:"/\|?*`, r):
+			return '_'
+		}
+		return r
+	}, s)
+	s = strings.Trim(s, " .")
+	if len(s) > maxNameLength {
+		cut := maxNameLength
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		s = strings.TrimRight(s[:cut], " .")
+	}
+	if s == "" {
+		return "_"
+	}
+	stem, _, _ := strings.Cut(s, ".")
+	if reservedNames[strings.ToUpper(strings.TrimSpace(stem))] {
+		s = "_" + s
+	}
+	return s
+}
+
+// FileName returns the file name, without extension, for a record's
+// original name. With an id the name is suffixed with it. Without one, a
+// name that had to be sanitized is suffixed with a hash of the original, so
+// different names never share a file and the same name always maps to the
+// same file.
+func FileName(original, id string) string {
+	name := Sanitize(original)
+	if id != "" {
+		return name + "_" + Sanitize(id)
+	}
+	if name != original {
+		sum := sha256.Sum256([]byte(original))
+		name += "-" + hex.EncodeToString(sum[:4])
+	}
+	return name
+}
+
+// ManifestEntry maps the original name of a file's content to the file.
+type ManifestEntry struct {
+	Name string `json:"name"`
+	ID   string `json:"id,omitempty"`
+	File string `json:"file"`
+}
+
+var manifestMu sync.Mutex
+
+// UpdateManifest merges entries into dir's manifest, replacing entries for
+// the same file.
+func UpdateManifest(dir string, entries []ManifestEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+
+	p := filepath.Join(dir, ManifestFile)
+	byFile := make(map[string]ManifestEntry)
+	data, err := os.ReadFile(p)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	case len(strings.TrimSpace(string(data))) > 0:
+		var existing []ManifestEntry
+		if err := json.Unmarshal(data, &existing); err != nil {
+			return err
+		}
+		for _, e := range existing {
+			byFile[e.File] = e
+		}
+	}
+	for _, e := range entries {
+		byFile[e.File] = e
+	}
+
+	merged := make([]ManifestEntry, 0, len(byFile))
+	for _, e := range byFile {
+		merged = append(merged, e)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].File < merged[j].File })
+	data, err = json.MarshalIndent(merged, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFile(p, data)
+}
+
+// WriteFile writes data to a temporary file next to name and renames it into
+// place, so readers never see a partial file.
+func WriteFile(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
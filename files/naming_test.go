@@ -0,0 +1,73 @@
+package files
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"Program A", "Program A"},
+		{"a/b\\c:d", "a_b_c_d"},
+		{"tab\there", "tab_here"},
+		{"zero​width", "zero_width"},
+		{" .hidden. ", "hidden"},
+		{"...", "_"},
+		{"", "_"},
+		{"CON", "_CON"},
+		{"com1.csv", "_com1.csv"},
+		{"Console", "Console"},
+		{strings.Repeat("é", 150), strings.Repeat("é", 100)},
+	}
+	for _, tt := range tests {
+		if got := Sanitize(tt.in); got != tt.want {
+			t.Errorf("Sanitize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFileName(t *testing.T) {
+	if got := FileName("Program A", ""); got != "Program A" {
+		t.Errorf("FileName of a safe name = %q", got)
+	}
+	if got := FileName("A/B", "a01"); got != "A_B_a01" {
+		t.Errorf("FileName with an id = %q, want A_B_a01", got)
+	}
+	slash, colon := FileName("A/B", ""), FileName("A:B", "")
+	if slash == colon || !strings.HasPrefix(slash, "A_B-") {
+		t.Errorf("FileName(A/B) = %q and FileName(A:B) = %q, want distinct hashed names", slash, colon)
+	}
+	if again := FileName("A/B", ""); again != slash {
+		t.Errorf("FileName(A/B) = %q then %q, want the same name", slash, again)
+	}
+}
+
+func TestUpdateManifest(t *testing.T) {
+	dir := t.TempDir()
+	if err := UpdateManifest(dir, []ManifestEntry{{Name: "A/B", File: "A_B-1.csv"}, {Name: "C", File: "C.csv"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateManifest(dir, []ManifestEntry{{Name: "C", ID: "c1", File: "C.csv"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []ManifestEntry
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []ManifestEntry{{Name: "A/B", File: "A_B-1.csv"}, {Name: "C", ID: "c1", File: "C.csv"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("manifest = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,215 @@
+package files
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Server serves the files below one or more named roots over HTTP. Paths
+// start with the root's name, such as mappings/Program.csv, unless the
+// server has a single root named "", whose paths are used as they are.
+type Server struct {
+	roots map[string]string
+	names []string
+	// name is the archive's file name when every root is bundled.
+	name string
+	// ErrorLog, if set, reports errors that are not the client's fault.
+	ErrorLog func(r *http.Request, msg string, err error)
+}
+
+// NewServer returns a server for roots, which are made absolute. Every root
+// must be set; an empty one is ErrNoRoot.
+func NewServer(name string, roots map[string]string) (*Server, error) {
+	s := &Server{roots: make(map[string]string, len(roots)), name: name}
+	for n, root := range roots {
+		abs, err := absRoot(root)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", err, n)
+		}
+		s.roots[n] = abs
+		s.names = append(s.names, n)
+	}
+	if len(s.names) == 0 {
+		return nil, ErrNoRoot
+	}
+	sort.Strings(s.names)
+	return s, nil
+}
+
+// ServeList lists the files of every root, or below the dir query
+// parameter, with their size and modification time.
+func (s *Server) ServeList(w http.ResponseWriter, r *http.Request) {
+	infos, err := s.list(r.URL.Query().Get("dir"))
+	if err != nil {
+		s.error(w, r, err)
+		return
+	}
+	if infos == nil {
+		infos = []Info{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(infos); err != nil {
+		s.log(r, "error writing response", err)
+	}
+}
+
+// ServeFile serves the file at p.
+func (s *Server) ServeFile(w http.ResponseWriter, r *http.Request, p string) {
+	_, root, rel, err := s.split(p)
+	if err != nil {
+		s.error(w, r, err)
+		return
+	}
+	f, fi, err := Open(root, rel)
+	if err != nil {
+		s.error(w, r, err)
+		return
+	}
+	defer f.Close()
+
+	noWriteDeadline(w)
+	w.Header().Set("Content-Disposition", attachment(fi.Name()))
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+// ServeArchive bundles the files ServeList would list into a zip or, with
+// format=tar.gz, a gzipped tarball.
+func (s *Server) ServeArchive(w http.ResponseWriter, r *http.Request) {
+	dir := r.URL.Query().Get("dir")
+	infos, err := s.list(dir)
+	if err != nil {
+		s.error(w, r, err)
+		return
+	}
+	paths := make([]string, len(infos))
+	for i, fi := range infos {
+		paths[i] = fi.Path
+	}
+
+	name := s.name
+	if dir != "" {
+		name = path.Base(dir)
+	}
+	s.ServeFiles(w, r, name, paths)
+}
+
+// ServeFiles bundles the files at paths into an archive called name, in the
+// format of the format query parameter.
+func (s *Server) ServeFiles(w http.ResponseWriter, r *http.Request, name string, paths []string) {
+	format, contentType, err := ArchiveFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries := make([]Entry, 0, len(paths))
+	for _, p := range paths {
+		_, root, rel, err := s.split(p)
+		if err == nil {
+			var abs string
+			if abs, err = Resolve(root, rel); err == nil {
+				entries = append(entries, Entry{Name: p, Path: abs})
+			}
+		}
+		if err != nil {
+			s.error(w, r, err)
+			return
+		}
+	}
+
+	noWriteDeadline(w)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", attachment(name+"."+format))
+	if err := WriteArchive(w, format, entries); err != nil {
+		// The status has been sent; the client sees a truncated archive.
+		s.log(r, "error writing archive", err)
+	}
+}
+
+// list lists dir, or every root when it is empty, with paths prefixed by the
+// root's name.
+func (s *Server) list(dir string) ([]Info, error) {
+	names := s.names
+	rel := ""
+	if dir != "" {
+		n, _, r, err := s.split(dir)
+		if err != nil {
+			return nil, err
+		}
+		names, rel = []string{n}, r
+	}
+
+	var infos []Info
+	for _, n := range names {
+		list, err := prefixed(n, s.roots[n], rel)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, list...)
+	}
+	return infos, nil
+}
+
+// prefixed lists rel below root with paths starting with the root's name.
+func prefixed(name, root, rel string) ([]Info, error) {
+	infos, err := List(root, rel)
+	if err != nil || name == "" {
+		return infos, err
+	}
+	for i := range infos {
+		infos[i].Path = name + "/" + infos[i].Path
+	}
+	return infos, nil
+}
+
+// split returns the name and directory of p's root and the path inside it.
+func (s *Server) split(p string) (string, string, string, error) {
+	if root, ok := s.roots[""]; ok && len(s.roots) == 1 {
+		return "", root, p, nil
+	}
+	n, rel, _ := strings.Cut(p, "/")
+	root, ok := s.roots[n]
+	if !ok {
+		return "", "", "", fmt.Errorf("%w: %q", ErrNotFound, n)
+	}
+	return n, root, rel, nil
+}
+
+func (s *Server) error(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidPath):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		s.log(r, "error reading files", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) log(r *http.Request, msg string, err error) {
+	if s.ErrorLog != nil {
+		s.ErrorLog(r, msg, err)
+	}
+}
+
+func attachment(name string) string {
+	if v := mime.FormatMediaType("attachment", map[string]string{"filename": name}); v != "" {
+		return v
+	}
+	return `attachment; filename="download"`
+}
+
+// noWriteDeadline lifts the server's write timeout for downloads that can
+// take longer than a regular response.
+func noWriteDeadline(w http.ResponseWriter) {
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+}
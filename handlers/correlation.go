@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	rbmq "github.com/AmitSuresh/sfdataapp/rabbitmq"
+	"go.uber.org/zap"
+)
+
+// CorrelationHeader carries the correlation ID on requests and responses. A
+// picklist mapping run records the ID of the request that started it and
+// passes it on to its queue messages.
+const CorrelationHeader = "X-Correlation-ID"
+
+var validCorrelationID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+type ctxKey int
+
+const (
+	correlationIDKey ctxKey = iota
+	loggerKey
+)
+
+// Correlate assigns every request a correlation ID, reusing a valid
+// X-Correlation-ID sent by the client, and echoes it on the response.
+func (h *Handler) Correlate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(CorrelationHeader)
+		if !validCorrelationID.MatchString(id) {
+			var err error
+			if id, err = rbmq.NewMessageID(); err != nil {
+				h.l.Error("error creating correlation id", zap.Error(err))
+				http.Error(w, "error creating correlation id", http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set(CorrelationHeader, id)
+		next.ServeHTTP(w, r.WithContext(h.withCorrelationID(r.Context(), id)))
+	})
+}
+
+func (h *Handler) withCorrelationID(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, correlationIDKey, id)
+	return context.WithValue(ctx, loggerKey, h.l.With(zap.String("correlationId", id)))
+}
+
+// withRunID adds the ID of a picklist mapping run to the logger of ctx.
+func (h *Handler) withRunID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, loggerKey, h.logger(ctx).With(zap.String("runId", id)))
+}
+
+// correlationID returns the ID set by Correlate, or a new one for contexts
+// that did not pass through it.
+func correlationID(ctx context.Context) (string, error) {
+	if id, ok := ctx.Value(correlationIDKey).(string); ok {
+		return id, nil
+	}
+	return rbmq.NewMessageID()
+}
+
+// logger returns h.l tagged with the correlation ID of ctx, if any.
+func (h *Handler) logger(ctx context.Context) *zap.Logger {
+	if l, ok := ctx.Value(loggerKey).(*zap.Logger); ok {
+		return l
+	}
+	return h.l
+}
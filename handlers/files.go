@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// The output directories served under /api/files, by the first element of
+// a file's path.
+const (
+	FilesMappings     = "mappings"
+	FilesDependencies = "dependencies"
+)
+
+// ListFiles lists the files of every output directory, or of the one named
+// by the dir query parameter, with their size and modification time.
+func (h *Handler) ListFiles(w http.ResponseWriter, r *http.Request) {
+	h.files.ServeList(w, r)
+}
+
+// DownloadFile serves one file, addressed as <dir>/<path>.
+func (h *Handler) DownloadFile(w http.ResponseWriter, r *http.Request) {
+	h.files.ServeFile(w, r, mux.Vars(r)["path"])
+}
+
+// Archive bundles the files ListFiles would list into a zip or, with
+// format=tar.gz, a gzipped tarball.
+func (h *Handler) Archive(w http.ResponseWriter, r *http.Request) {
+	h.files.ServeArchive(w, r)
+}
+
+func (h *Handler) logFileError(r *http.Request, msg string, err error) {
+	h.logger(r.Context()).Error(msg, zap.Error(err))
+}
@@ -1,139 +1,230 @@
-package handlers
-
-import (
-	"encoding/json"
-	"fmt"
-	"net/http"
-	"net/url"
-	"strings"
-
-	rbmq "github.com/AmitSuresh/sfdataapp/rabbitmq"
-	"github.com/rabbitmq/amqp091-go"
-	"go.uber.org/zap"
-)
-
-func (h *Handler) GetPickBasedMappingRec(w http.ResponseWriter, r *http.Request) {
-	p := new(Payload)
-	err := FromJSON(p, r.Body)
-	if err != nil {
-		h.l.Error("error decoding body", zap.Error(err))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	if p.Records == nil {
-		h.l.Error("custom object records are not found in payload.", zap.Error(err))
-		http.Error(w, "error reading records from payload", http.StatusBadRequest)
-		return
-	}
-
-	customRecMap := make(CustomRecordsMap)
-	for _, v := range p.Records {
-		if strings.Contains(v.MeasureNameNew, "Recommendation") {
-			customRecMap["Recommendation"] = append(customRecMap["Recommendation"], v)
-		} else {
-			customRecMap["Direct Install"] = append(customRecMap["Direct Install"], v)
-		}
-	}
-
-	h.l.Info("\n", zap.Any("", customRecMap))
-
-	if len(customRecMap["Recommendation"]) > 0 && len(customRecMap["Direct Install"]) > 0 {
-		processMapping := func(recordType string, fieldName string) error {
-			for _, v := range customRecMap[recordType] {
-				p.RecTypeID = v.RecTypeId
-				p.FieldName = fieldName
-				pickURL := fmt.Sprintf("%s%s/picklist-values/%s/%s", h.uiapiURL, p.SObject, p.RecTypeID, p.FieldName)
-				h.l.Info(pickURL)
-
-				q, err := h.amqpCh.QueueDeclare(rbmq.PicklistQueryEvent, true, false, false, false, nil)
-				if err != nil {
-					h.l.Error("error declaring queue", zap.Error(err))
-					return err
-				}
-
-				request := &rbmq.PicklistQueueRequest{
-					Method:      http.MethodGet,
-					Url:         pickURL,
-					Body:        nil,
-					AccessToken: h.accessToken,
-					CustomObj: rbmq.CustomRecords{
-						Id:             v.Id,
-						MeasureNameNew: v.MeasureNameNew,
-						RecTypeName:    v.RecTypeName,
-						RecTypeId:      v.RecTypeId,
-						ProgRec:        rbmq.ProgramRecord(v.ProgRec),
-					},
-					RecordType: recordType,
-				}
-
-				marshalledReq, err := json.Marshal(request)
-				if err != nil {
-					h.l.Error("error marshalling", zap.Error(err))
-				}
-
-				err = h.amqpCh.PublishWithContext(r.Context(), "", q.Name, false, false, amqp091.Publishing{
-					ContentType: "application/json",
-					Body:        marshalledReq,
-				})
-				if err != nil {
-					h.l.Error("error publishing request", zap.Error(err))
-					return err
-				}
-				h.l.Info("Published to queue", zap.String("queue", q.Name))
-			}
-			return nil
-		}
-
-		if err := processMapping("Recommendation", "Recommendation__c"); err != nil {
-			h.l.Error("error processing recommendations", zap.Error(err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		if err := processMapping("Direct Install", "Equipment_Type__c"); err != nil {
-			h.l.Error("error processing equipment", zap.Error(err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-	}
-
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write([]byte("Request is placed successfully."))
-	if err != nil {
-		h.l.Error("error writing response", zap.Error(err))
-	}
-}
-
-func (h *Handler) QueryRecords(w http.ResponseWriter, r *http.Request) {
-	p := new(Payload)
-	if err := json.NewDecoder(r.Body).Decode(p); err != nil {
-		h.l.Error("error decoding body", zap.Error(err))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	qURL := fmt.Sprintf("%s%s", h.queryURL, url.QueryEscape(p.Query))
-
-	resp, err := h.handleNewRequest(http.MethodGet, qURL, nil)
-	if err != nil {
-		h.l.Error("error sending request", zap.Error(err))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	var qResp QueryResponse
-	err = FromJSON(&qResp, resp.Body)
-	if err != nil {
-		h.l.Error("error unmarshalling response", zap.Error(err))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	err = ToJSON(&qResp, w)
-	if err != nil {
-		h.l.Error("error writing result", zap.Error(err))
-	}
-	w.WriteHeader(http.StatusOK)
-}
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	rbmq "github.com/AmitSuresh/sfdataapp/rabbitmq"
+	"github.com/AmitSuresh/sfdataapp/store"
+	"go.uber.org/zap"
+)
+
+func (h *Handler) GetPickBasedMappingRec(w http.ResponseWriter, r *http.Request) {
+	l := h.logger(r.Context())
+	p := new(Payload)
+	err := FromJSON(p, r.Body)
+	if err != nil {
+		l.Error("error decoding body", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if p.SObject == "" {
+		l.Error("sObject is missing from payload")
+		http.Error(w, "sObject is required", http.StatusBadRequest)
+		return
+	}
+
+	if p.Records == nil {
+		l.Error("custom object records are not found in payload.", zap.Error(err))
+		http.Error(w, "error reading records from payload", http.StatusBadRequest)
+		return
+	}
+
+	corrID, err := correlationID(r.Context())
+	if err != nil {
+		l.Error("error creating correlation id", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Clients may reuse a trace ID, so every run gets an ID of its own.
+	runID, err := rbmq.NewMessageID()
+	if err != nil {
+		l.Error("error creating run id", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	run, err := h.runs.start(r.Context(), runID, corrID)
+	if err != nil {
+		l.Error("error starting run", zap.Error(err))
+		status := http.StatusInternalServerError
+		if errors.Is(err, errRunExists) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	l = l.With(zap.String("runId", run.ID))
+	res := &PublishResult{RunID: run.ID}
+
+	// A record listed twice is published once.
+	customRecMap := make(CustomRecordsMap)
+	seen := make(map[string]bool, len(p.Records))
+	for _, v := range p.Records {
+		if seen[v.Id] {
+			continue
+		}
+		seen[v.Id] = true
+		rule, err := classify(h.rules, v)
+		if err != nil {
+			res.addFailure(v.Id, "", err)
+			continue
+		}
+		customRecMap[rule.Name] = append(customRecMap[rule.Name], v)
+	}
+
+	l.Info("\n", zap.Any("", customRecMap))
+
+	if len(customRecMap) > 0 {
+		if err := rbmq.DeclarePicklistQueue(h.broker); err != nil {
+			l.Error("error declaring queue", zap.Error(err))
+			h.runs.update(run.ID, func(r *MappingRun) {
+				r.State = RunFailed
+				r.Error = err.Error()
+			})
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	processMapping := func(recordType string, fieldName string, controllingField string) {
+		for _, v := range customRecMap[recordType] {
+			var controllingValue string
+			if controllingField != "" {
+				controllingValue, _ = v.field(controllingField)
+			}
+			request := &rbmq.PicklistQueueRequest{
+				RunID:     run.ID,
+				SObject:   p.SObject,
+				FieldName: fieldName,
+				CustomObj: rbmq.CustomRecords{
+					Id:             v.Id,
+					MeasureNameNew: v.MeasureNameNew,
+					RecTypeName:    v.RecTypeName,
+					RecTypeId:      v.RecTypeId,
+					ProgRec:        rbmq.ProgramRecord(v.ProgRec),
+				},
+				RecordType:       recordType,
+				ControllingValue: controllingValue,
+			}
+
+			marshalledReq, err := json.Marshal(request)
+			if err != nil {
+				l.Error("error marshalling", zap.Error(err))
+				res.addFailure(v.Id, recordType, err)
+				continue
+			}
+
+			msgID, err := rbmq.NewMessageID()
+			if err != nil {
+				l.Error("error creating message id", zap.Error(err))
+				res.addFailure(v.Id, recordType, err)
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), publishTimeout)
+			err = h.broker.Publish(ctx, rbmq.PicklistQueryEvent, rbmq.Message{
+				ContentType:   "application/json",
+				CorrelationID: run.CorrelationID,
+				MessageID:     msgID,
+				Body:          marshalledReq,
+			})
+			cancel()
+			if err != nil {
+				l.Error("error publishing request", zap.String("id", v.Id), zap.String("messageId", msgID), zap.Error(err))
+				res.addFailure(v.Id, recordType, err)
+				continue
+			}
+			res.Accepted++
+			l.Info("Published to queue", zap.String("queue", rbmq.PicklistQueryEvent), zap.String("messageId", msgID))
+		}
+	}
+
+	// Each category is published on its own; an empty one is skipped.
+	for _, rule := range h.rules {
+		processMapping(rule.Name, rule.PicklistField, rule.ControllingField)
+	}
+
+	if h.runs.published(run.ID, res) {
+		go h.loadRun(run.ID)
+	}
+
+	status := http.StatusOK
+	switch {
+	case res.Failed > 0 && res.Accepted > 0:
+		status = http.StatusMultiStatus
+	case res.Failed > 0:
+		status = http.StatusBadGateway
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := ToJSON(res, w); err != nil {
+		l.Error("error writing response", zap.Error(err))
+	}
+}
+
+func (p *PublishResult) addFailure(id, recordType string, err error) {
+	p.Failed++
+	p.Failures = append(p.Failures, PublishFailure{RecordID: id, RecordType: recordType, Error: err.Error()})
+}
+
+func (h *Handler) QueryRecords(w http.ResponseWriter, r *http.Request) {
+	l := h.logger(r.Context())
+	p := new(Payload)
+	if err := json.NewDecoder(r.Body).Decode(p); err != nil {
+		l.Error("error decoding body", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	qURL := fmt.Sprintf("%s%s", h.queryURL, url.QueryEscape(p.Query))
+
+	resp, err := h.handleNewRequest(r.Context(), http.MethodGet, qURL, nil)
+	if err != nil {
+		l.Error("error sending request", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+
+	var qResp QueryResponse
+	err = FromJSON(&qResp, resp.Body)
+	if err != nil {
+		l.Error("error unmarshalling response", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = ToJSON(&qResp, w)
+	if err != nil {
+		l.Error("error writing result", zap.Error(err))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetMappings returns stored picklist mappings filtered by the program,
+// measure and recordType query parameters.
+func (h *Handler) GetMappings(w http.ResponseWriter, r *http.Request) {
+	l := h.logger(r.Context())
+	q := r.URL.Query()
+	m, err := h.mappings.Find(r.Context(), store.Query{
+		Program:    q.Get("program"),
+		Measure:    q.Get("measure"),
+		RecordType: q.Get("recordType"),
+	})
+	if err != nil {
+		l.Error("error reading mappings", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := ToJSON(m, w); err != nil {
+		l.Error("error writing result", zap.Error(err))
+	}
+}
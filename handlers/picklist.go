@@ -0,0 +1,401 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/AmitSuresh/sfdataapp/salesforce"
+	"go.uber.org/zap"
+)
+
+// masterRecordTypeID is used when a comparison names no record type.
+const masterRecordTypeID = "012000000000000AAA"
+
+var (
+	errPicklistNotFound    = errors.New("picklist definition not found")
+	errUnsupportedPicklist = errors.New("unsupported picklist")
+)
+
+// ComparePicklist reports which of the posted values are missing from a
+// field's picklist, as returned by the ui-api for the record type.
+func (h *Handler) ComparePicklist(w http.ResponseWriter, r *http.Request) {
+	l := h.logger(r.Context())
+	p := new(PicklistCompareRequest)
+	if err := FromJSON(p, r.Body); err != nil {
+		l.Error("error decoding body", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if p.RecTypeID == "" {
+		p.RecTypeID = masterRecordTypeID
+	}
+	if err := validatePicklistField(p.SObject, p.FieldName); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := salesforce.ValidateID(p.RecTypeID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pickURL := fmt.Sprintf("%s%s/picklist-values/%s/%s", h.uiapiURL, p.SObject, p.RecTypeID, p.FieldName)
+	resp, err := h.handleNewRequest(r.Context(), http.MethodGet, pickURL, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err := salesforceError(resp)
+		l.Error("error reading picklist values", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	pick := new(PicklistQueryResponse)
+	if err := FromJSON(pick, resp.Body); err != nil {
+		l.Error("error decoding picklist values", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	res := &PicklistCompareResult{SObject: p.SObject, FieldName: p.FieldName, RecTypeID: p.RecTypeID}
+	existing := make(map[string]bool, len(pick.PicklistValues))
+	for _, v := range pick.PicklistValues {
+		val := html.UnescapeString(v.PickValues)
+		existing[val] = true
+		res.Existing = append(res.Existing, val)
+	}
+	incoming := make(map[string]bool, len(p.Values))
+	for _, v := range p.Values {
+		if incoming[v] {
+			continue
+		}
+		incoming[v] = true
+		if !existing[v] {
+			res.Missing = append(res.Missing, v)
+		}
+	}
+	for _, v := range res.Existing {
+		if !incoming[v] {
+			res.Unused = append(res.Unused, v)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := ToJSON(res, w); err != nil {
+		l.Error("error writing result", zap.Error(err))
+	}
+}
+
+// ChangePicklistValues adds, deactivates and reorders the values of a custom
+// picklist field or a global value set through the Tooling API. The computed
+// diff is always returned; it is only written to Salesforce when the request
+// sets apply.
+func (h *Handler) ChangePicklistValues(w http.ResponseWriter, r *http.Request) {
+	l := h.logger(r.Context())
+	p := new(PicklistChangeRequest)
+	if err := FromJSON(p, r.Body); err != nil {
+		l.Error("error decoding body", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	def, err := h.readPicklistDefinition(r.Context(), p)
+	if err != nil {
+		l.Error("error reading picklist definition", zap.Error(err))
+		status := http.StatusBadGateway
+		switch {
+		case errors.Is(err, salesforce.ErrInvalidName), errors.Is(err, salesforce.ErrInvalidQuery), errors.Is(err, errUnsupportedPicklist):
+			status = http.StatusBadRequest
+		case errors.Is(err, errPicklistNotFound):
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	res, err := def.apply(p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if p.Apply && res.changed() {
+		if err := h.writePicklistDefinition(r.Context(), def); err != nil {
+			l.Error("error updating picklist definition", zap.String("target", def.fullName), zap.Error(err))
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		res.Applied = true
+		l.Info("updated picklist definition", zap.String("target", def.fullName),
+			zap.Strings("added", res.Added), zap.Strings("deactivated", res.Deactivated))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := ToJSON(res, w); err != nil {
+		l.Error("error writing result", zap.Error(err))
+	}
+}
+
+// picklistDefinition is the Tooling API metadata of a CustomField or
+// GlobalValueSet. The metadata is kept as decoded so that properties this
+// code does not know about are written back unchanged.
+type picklistDefinition struct {
+	sobject  string
+	id       string
+	fullName string
+	metadata map[string]interface{}
+	values   []interface{}
+	setValue func(values []interface{})
+	// nameKey holds a value's API name: valueName in a field's
+	// valueSetDefinition, fullName in a global value set's customValue.
+	nameKey string
+}
+
+func validatePicklistField(object, field string) error {
+	for _, name := range []string{object, field} {
+		if err := salesforce.ValidateName(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handler) readPicklistDefinition(ctx context.Context, p *PicklistChangeRequest) (*picklistDefinition, error) {
+	var sobject string
+	q := &salesforce.Query{Fields: []string{"Id", "FullName", "Metadata"}}
+	if p.ValueSet != "" {
+		sobject = "GlobalValueSet"
+		q.Where = []salesforce.Condition{{Field: "DeveloperName", Op: "=", Value: p.ValueSet}}
+	} else {
+		if err := validatePicklistField(p.SObject, p.FieldName); err != nil {
+			return nil, err
+		}
+		name, ok := strings.CutSuffix(p.FieldName, "__c")
+		if !ok {
+			return nil, fmt.Errorf("%w: %s is not a custom field", errUnsupportedPicklist, p.FieldName)
+		}
+		sobject = "CustomField"
+		q.Where = []salesforce.Condition{{Field: "EntityDefinition.QualifiedApiName", Op: "=", Value: p.SObject}}
+		if ns, dev, ok := strings.Cut(name, "__"); ok {
+			q.Where = append(q.Where, salesforce.Condition{Field: "NamespacePrefix", Op: "=", Value: ns})
+			name = dev
+		}
+		q.Where = append(q.Where, salesforce.Condition{Field: "DeveloperName", Op: "=", Value: name})
+	}
+	q.Object = sobject
+	queries, err := q.Build()
+	if err != nil {
+		return nil, err
+	}
+	soql := queries[0]
+
+	resp, err := h.handleNewRequest(ctx, http.MethodGet, h.toolingURL+"/query?q="+url.QueryEscape(soql), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, salesforceError(resp)
+	}
+
+	var res ToolingQueryResponse
+	if err := FromJSON(&res, resp.Body); err != nil {
+		return nil, err
+	}
+	if len(res.Records) != 1 {
+		return nil, fmt.Errorf("%w: %d %s records matched", errPicklistNotFound, len(res.Records), sobject)
+	}
+	return newPicklistDefinition(sobject, res.Records[0])
+}
+
+// newPicklistDefinition finds the values in the metadata of rec, a
+// CustomField or GlobalValueSet record.
+func newPicklistDefinition(sobject string, rec ToolingRecord) (*picklistDefinition, error) {
+	def := &picklistDefinition{sobject: sobject, id: rec.ID, fullName: rec.FullName, metadata: rec.Metadata}
+
+	if def.sobject == "GlobalValueSet" {
+		def.nameKey = "fullName"
+		def.values, _ = def.metadata["customValue"].([]interface{})
+		def.setValue = func(values []interface{}) { def.metadata["customValue"] = values }
+		return def, nil
+	}
+
+	valueSet, _ := def.metadata["valueSet"].(map[string]interface{})
+	if valueSet == nil {
+		return nil, fmt.Errorf("%w: %s is not a picklist field", errUnsupportedPicklist, def.fullName)
+	}
+	if name, _ := valueSet["valueSetName"].(string); name != "" {
+		return nil, fmt.Errorf("%w: %s uses the global value set %s; change it through valueSet", errUnsupportedPicklist, def.fullName, name)
+	}
+	valueSetDef, _ := valueSet["valueSetDefinition"].(map[string]interface{})
+	if valueSetDef == nil {
+		valueSetDef = map[string]interface{}{}
+		valueSet["valueSetDefinition"] = valueSetDef
+	}
+	def.nameKey = "valueName"
+	def.values, _ = valueSetDef["value"].([]interface{})
+	def.setValue = func(values []interface{}) { valueSetDef["value"] = values }
+	return def, nil
+}
+
+func (h *Handler) writePicklistDefinition(ctx context.Context, def *picklistDefinition) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"FullName": def.fullName,
+		"Metadata": def.metadata,
+	})
+	if err != nil {
+		return err
+	}
+
+	patchURL := fmt.Sprintf("%s/sobjects/%s/%s", h.toolingURL, def.sobject, def.id)
+	resp, err := h.handleNewRequest(ctx, http.MethodPatch, patchURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return salesforceError(resp)
+	}
+	return nil
+}
+
+// apply changes the definition as p asks and returns the diff. Adding an
+// inactive value activates it again; values named in Order move to the front
+// in that order and the rest keep their relative order.
+func (def *picklistDefinition) apply(p *PicklistChangeRequest) (*PicklistChangeResult, error) {
+	res := &PicklistChangeResult{Target: def.fullName, Before: def.valueStates(def.values)}
+
+	values := append([]interface{}{}, def.values...)
+	find := func(name string) map[string]interface{} {
+		for _, v := range values {
+			if m, ok := v.(map[string]interface{}); ok && def.valueName(m) == name {
+				return m
+			}
+		}
+		return nil
+	}
+
+	for _, name := range p.Add {
+		if name == "" {
+			return nil, errors.New("picklist values cannot be empty")
+		}
+		switch m := find(name); {
+		case m == nil:
+			values = append(values, map[string]interface{}{def.nameKey: name, "label": name, "default": false})
+			res.Added = append(res.Added, name)
+		case !valueActive(m):
+			m["isActive"] = true
+			res.Activated = append(res.Activated, name)
+		}
+	}
+
+	for _, name := range p.Deactivate {
+		switch m := find(name); {
+		case m == nil:
+			res.NotFound = append(res.NotFound, name)
+		case valueActive(m):
+			m["isActive"] = false
+			m["default"] = false
+			res.Deactivated = append(res.Deactivated, name)
+		}
+	}
+
+	if len(p.Order) > 0 {
+		ordered := make([]interface{}, 0, len(values))
+		placed := make(map[string]bool, len(p.Order))
+		for _, name := range p.Order {
+			m := find(name)
+			if m == nil {
+				res.NotFound = append(res.NotFound, name)
+				continue
+			}
+			if !placed[name] {
+				placed[name] = true
+				ordered = append(ordered, m)
+			}
+		}
+		for _, v := range values {
+			if m, ok := v.(map[string]interface{}); !ok || !placed[def.valueName(m)] {
+				ordered = append(ordered, v)
+			}
+		}
+		res.Reordered = !def.sameOrder(values, ordered)
+		values = ordered
+		if res.Reordered {
+			// An alphabetically sorted value set ignores the stored order.
+			def.sorted(false)
+		}
+	}
+
+	def.values = values
+	def.setValue(values)
+	res.After = def.valueStates(values)
+	return res, nil
+}
+
+func (def *picklistDefinition) sorted(v bool) {
+	if def.sobject == "GlobalValueSet" {
+		def.metadata["sorted"] = v
+		return
+	}
+	valueSet, _ := def.metadata["valueSet"].(map[string]interface{})
+	if valueSetDef, ok := valueSet["valueSetDefinition"].(map[string]interface{}); ok {
+		valueSetDef["sorted"] = v
+	}
+}
+
+func (res *PicklistChangeResult) changed() bool {
+	return len(res.Added) > 0 || len(res.Activated) > 0 || len(res.Deactivated) > 0 || res.Reordered
+}
+
+func (def *picklistDefinition) valueName(m map[string]interface{}) string {
+	name, _ := m[def.nameKey].(string)
+	return html.UnescapeString(name)
+}
+
+// valueActive treats a missing isActive as active, as the Tooling API does.
+func valueActive(m map[string]interface{}) bool {
+	active, ok := m["isActive"].(bool)
+	return !ok || active
+}
+
+func (def *picklistDefinition) valueStates(values []interface{}) []PicklistValueState {
+	states := make([]PicklistValueState, 0, len(values))
+	for _, v := range values {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		label, _ := m["label"].(string)
+		states = append(states, PicklistValueState{Value: def.valueName(m), Label: html.UnescapeString(label), Active: valueActive(m)})
+	}
+	return states
+}
+
+func (def *picklistDefinition) sameOrder(a, b []interface{}) bool {
+	for i := range a {
+		am, _ := a[i].(map[string]interface{})
+		bm, _ := b[i].(map[string]interface{})
+		if def.valueName(am) != def.valueName(bm) {
+			return false
+		}
+	}
+	return true
+}
+
+// salesforceError turns an unexpected Salesforce response into an error that
+// includes the start of its body.
+func salesforceError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("salesforce responded %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// customFieldResponse is a Tooling API query response for a restricted
+// custom picklist field, trimmed of the null field properties.
+const customFieldResponse = `{"size":1,"totalSize":1,"done":true,"queryLocator":null,"entityTypeName":"CustomField","records":[{
+	"attributes":{"type":"CustomField","url":"/services/data/v58.0/tooling/sobjects/CustomField/00N5e00000AbCdEEAV"},
+	"Id":"00N5e00000AbCdEEAV",
+	"FullName":"Measure__c.Recommendation__c",
+	"Metadata":{"externalId":false,"label":"Recommendation","required":false,"trackHistory":false,"type":"Picklist",
+		"valueSet":{"controllingField":null,"restricted":true,"valueSetName":null,"valueSettings":[],
+			"valueSetDefinition":{"sorted":true,"value":[
+				{"color":null,"default":false,"description":null,"isActive":null,"label":"Seal &amp; Insulate","urls":null,"valueName":"Seal &amp; Insulate"},
+				{"color":null,"default":true,"description":null,"isActive":null,"label":"Tune Up","urls":null,"valueName":"Tune Up"},
+				{"color":null,"default":false,"description":null,"isActive":false,"label":"Duct Sealing","urls":null,"valueName":"Duct Sealing"}
+			]}}}
+}]}`
+
+// globalValueSetResponse is a Tooling API query response for a global value
+// set, whose values are named by fullName.
+const globalValueSetResponse = `{"size":1,"totalSize":1,"done":true,"queryLocator":null,"entityTypeName":"GlobalValueSet","records":[{
+	"attributes":{"type":"GlobalValueSet","url":"/services/data/v58.0/tooling/sobjects/GlobalValueSet/0Nt5e000000AbCdCAK"},
+	"Id":"0Nt5e000000AbCdCAK",
+	"FullName":"Equipment_Types",
+	"Metadata":{"description":null,"masterLabel":"Equipment Types","sorted":false,"customValue":[
+		{"color":null,"default":false,"description":null,"isActive":null,"label":"Furnace","urls":null,"fullName":"Furnace"},
+		{"color":null,"default":false,"description":null,"isActive":null,"label":"Heat Pump","urls":null,"fullName":"Heat Pump"}
+	]}
+}]}`
+
+func testDefinition(t *testing.T, sobject, body string) *picklistDefinition {
+	t.Helper()
+	var res ToolingQueryResponse
+	if err := FromJSON(&res, strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	def, err := newPicklistDefinition(sobject, res.Records[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return def
+}
+
+// writtenValues returns the values as they would be sent back to Salesforce.
+func writtenValues(t *testing.T, def *picklistDefinition) []map[string]interface{} {
+	t.Helper()
+	data, err := json.Marshal(def.metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m struct {
+		ValueSet struct {
+			ValueSetDefinition struct {
+				Sorted bool                     `json:"sorted"`
+				Value  []map[string]interface{} `json:"value"`
+			} `json:"valueSetDefinition"`
+		} `json:"valueSet"`
+		CustomValue []map[string]interface{} `json:"customValue"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if def.sobject == "GlobalValueSet" {
+		return m.CustomValue
+	}
+	return m.ValueSet.ValueSetDefinition.Value
+}
+
+func TestPicklistApplyAdd(t *testing.T) {
+	def := testDefinition(t, "CustomField", customFieldResponse)
+
+	res, err := def.apply(&PicklistChangeRequest{Add: []string{"Seal & Insulate", "Duct Sealing", "Replace"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res.Added, []string{"Replace"}) || !reflect.DeepEqual(res.Activated, []string{"Duct Sealing"}) {
+		t.Errorf("added %q and activated %q, want [Replace] and [Duct Sealing]", res.Added, res.Activated)
+	}
+	want := []PicklistValueState{
+		{Value: "Seal & Insulate", Label: "Seal & Insulate", Active: true},
+		{Value: "Tune Up", Label: "Tune Up", Active: true},
+		{Value: "Duct Sealing", Label: "Duct Sealing", Active: true},
+		{Value: "Replace", Label: "Replace", Active: true},
+	}
+	if !reflect.DeepEqual(res.After, want) {
+		t.Errorf("after = %+v, want %+v", res.After, want)
+	}
+
+	values := writtenValues(t, def)
+	added := values[len(values)-1]
+	if added["valueName"] != "Replace" || added["fullName"] != nil {
+		t.Errorf("added value = %v, want it named by valueName", added)
+	}
+	if values[0]["color"] != nil || values[0]["urls"] != nil || values[0]["valueName"] != "Seal &amp; Insulate" {
+		t.Errorf("existing value = %v, want it written back unchanged", values[0])
+	}
+}
+
+func TestPicklistApplyDeactivate(t *testing.T) {
+	def := testDefinition(t, "CustomField", customFieldResponse)
+
+	res, err := def.apply(&PicklistChangeRequest{Deactivate: []string{"Tune Up", "Duct Sealing", "Missing"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res.Deactivated, []string{"Tune Up"}) || !reflect.DeepEqual(res.NotFound, []string{"Missing"}) {
+		t.Errorf("deactivated %q, not found %q, want [Tune Up] and [Missing]", res.Deactivated, res.NotFound)
+	}
+	if v := writtenValues(t, def)[1]; v["isActive"] != false || v["default"] != false {
+		t.Errorf("Tune Up = %v, want inactive and not the default", v)
+	}
+}
+
+func TestPicklistApplyOrder(t *testing.T) {
+	def := testDefinition(t, "CustomField", customFieldResponse)
+
+	res, err := def.apply(&PicklistChangeRequest{Order: []string{"Duct Sealing", "Tune Up", "Duct Sealing"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, v := range res.After {
+		got = append(got, v.Value)
+	}
+	if want := []string{"Duct Sealing", "Tune Up", "Seal & Insulate"}; !res.Reordered || !reflect.DeepEqual(got, want) {
+		t.Errorf("order = %q (reordered %v), want %q", got, res.Reordered, want)
+	}
+	valueSetDef := def.metadata["valueSet"].(map[string]interface{})["valueSetDefinition"].(map[string]interface{})
+	if valueSetDef["sorted"] != false {
+		t.Error("a reordered value set is still sorted alphabetically")
+	}
+
+	// Asking for the current order changes nothing.
+	res, err = def.apply(&PicklistChangeRequest{Order: got})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.changed() {
+		t.Errorf("result = %+v, want no change", res)
+	}
+}
+
+func TestPicklistApplyGlobalValueSet(t *testing.T) {
+	def := testDefinition(t, "GlobalValueSet", globalValueSetResponse)
+
+	res, err := def.apply(&PicklistChangeRequest{Add: []string{"Boiler"}, Deactivate: []string{"Furnace"}, Order: []string{"Heat Pump"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res.Added, []string{"Boiler"}) || !reflect.DeepEqual(res.Deactivated, []string{"Furnace"}) || !res.Reordered {
+		t.Errorf("result = %+v", res)
+	}
+	values := writtenValues(t, def)
+	var names []interface{}
+	for _, v := range values {
+		names = append(names, v["fullName"])
+	}
+	if want := []interface{}{"Heat Pump", "Furnace", "Boiler"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("written values = %v, want %v", names, want)
+	}
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/AmitSuresh/sfdataapp/salesforce"
+	"go.uber.org/zap"
+)
+
+// RunQuery builds the posted query with salesforce.Query, runs every chunk
+// its IN list was split into, following result pages, and returns the
+// records of all chunks together.
+func (h *Handler) RunQuery(w http.ResponseWriter, r *http.Request) {
+	l := h.logger(r.Context())
+	q := new(salesforce.Query)
+	d := json.NewDecoder(r.Body)
+	d.UseNumber()
+	if err := d.Decode(q); err != nil {
+		l.Error("error decoding body", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	queries, err := q.Build()
+	if err != nil {
+		l.Error("error building query", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res := &salesforce.QueryResult{Done: true, Records: []json.RawMessage{}}
+	err = h.sf.QueryAll(r.Context(), q, func(records []json.RawMessage) error {
+		res.Records = append(res.Records, records...)
+		return nil
+	})
+	if err != nil {
+		l.Error("error running query", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	res.TotalSize = len(res.Records)
+	l.Info("ran query", zap.Int("queries", len(queries)), zap.Int("records", res.TotalSize))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := ToJSON(res, w); err != nil {
+		l.Error("error writing result", zap.Error(err))
+	}
+}
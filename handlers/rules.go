@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// defaultRuleField is matched by rules that set a pattern but no field.
+const defaultRuleField = "Measure_Name_New__c"
+
+var errNoRuleMatched = errors.New("no classification rule matched the record")
+
+// DefaultClassificationRules reproduce the original behaviour: measures named
+// like a recommendation map to Measure_Recommendation__c and everything else
+// to Measure_Equipment_Type__c.
+func DefaultClassificationRules() []ClassificationRule {
+	rules := []ClassificationRule{
+		{
+			Name:          "Recommendation",
+			Field:         defaultRuleField,
+			Pattern:       "Recommendation",
+			PicklistField: "Recommendation__c",
+			TargetObject:  "Measure_Recommendation__c",
+		},
+		{
+			Name:          "Direct Install",
+			PicklistField: "Equipment_Type__c",
+			TargetObject:  "Measure_Equipment_Type__c",
+		},
+	}
+	for i := range rules {
+		rules[i].compile()
+	}
+	return rules
+}
+
+// LoadClassificationRules reads a JSON array of rules from path. An empty path
+// selects the default rules.
+func LoadClassificationRules(path string) ([]ClassificationRule, error) {
+	if path == "" {
+		return DefaultClassificationRules(), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []ClassificationRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("%s defines no classification rules", path)
+	}
+
+	seen := make(map[string]bool, len(rules))
+	for i := range rules {
+		r := &rules[i]
+		if r.Name == "" || r.PicklistField == "" || r.TargetObject == "" {
+			return nil, fmt.Errorf("rule %d: name, picklistField and targetObject are required", i)
+		}
+		if seen[r.Name] {
+			return nil, fmt.Errorf("rule %d: duplicate name %q", i, r.Name)
+		}
+		seen[r.Name] = true
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+	}
+	return rules, nil
+}
+
+func (r *ClassificationRule) compile() error {
+	if r.Pattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return err
+	}
+	r.re = re
+	if r.Field == "" {
+		r.Field = defaultRuleField
+	}
+	return nil
+}
+
+// matches reports whether rec belongs to the rule. A rule without a pattern
+// or record type name matches every record.
+func (r *ClassificationRule) matches(rec CustomRecords) bool {
+	if r.RecordTypeName != "" && rec.RecTypeName != r.RecordTypeName {
+		return false
+	}
+	if r.re == nil {
+		return true
+	}
+	v, ok := rec.field(r.Field)
+	return ok && r.re.MatchString(v)
+}
+
+// classify returns the first rule that matches rec.
+func classify(rules []ClassificationRule, rec CustomRecords) (*ClassificationRule, error) {
+	for i := range rules {
+		if rules[i].matches(rec) {
+			return &rules[i], nil
+		}
+	}
+	return nil, errNoRuleMatched
+}
+
+// ruleByName finds the rule for a category, falling back to the default rules
+// so rows for the built-in categories can always be loaded.
+func ruleByName(rules []ClassificationRule, name string) (*ClassificationRule, bool) {
+	for _, set := range [][]ClassificationRule{rules, DefaultClassificationRules()} {
+		for i := range set {
+			if set[i].Name == name {
+				return &set[i], true
+			}
+		}
+	}
+	return nil, false
+}
+
+// UnmarshalJSON keeps every field of the record so classification rules can
+// match fields that CustomRecords does not declare.
+func (c *CustomRecords) UnmarshalJSON(b []byte) error {
+	type plain CustomRecords
+	if err := json.Unmarshal(b, (*plain)(c)); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &c.fields)
+}
+
+// field returns the string value of a record field. Relationship fields are
+// addressed with dots, e.g. Program__r.Name.
+func (c CustomRecords) field(name string) (string, bool) {
+	var v interface{} = c.fields
+	if c.fields == nil {
+		var err error
+		if v, err = toMap(c); err != nil {
+			return "", false
+		}
+	}
+
+	for _, part := range strings.Split(name, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if v, ok = m[part]; !ok {
+			return "", false
+		}
+	}
+
+	switch t := v.(type) {
+	case string:
+		return t, true
+	case nil:
+		return "", false
+	default:
+		return fmt.Sprint(t), true
+	}
+}
+
+func toMap(v interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	return m, json.Unmarshal(b, &m)
+}
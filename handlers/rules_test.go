@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.json")
+	custom := `[
+		{"name":"Lighting","field":"Program__r.Name","pattern":"^Lighting","picklistField":"Lamp_Type__c","targetObject":"Measure_Lamp_Type__c"},
+		{"name":"Thermostat","recordTypeName":"Controls","picklistField":"Thermostat__c","targetObject":"Measure_Thermostat__c"},
+		{"name":"Direct Install","picklistField":"Equipment_Type__c","targetObject":"Measure_Equipment_Type__c"}
+	]`
+	if err := os.WriteFile(path, []byte(custom), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := LoadClassificationRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		rules  []ClassificationRule
+		record string
+		want   string
+	}{
+		{"default recommendation", DefaultClassificationRules(), `{"Id":"a1","Measure_Name_New__c":"Recommendation A"}`, "Recommendation"},
+		{"default direct install", DefaultClassificationRules(), `{"Id":"a2","Measure_Name_New__c":"Furnace"}`, "Direct Install"},
+		{"relationship field", rules, `{"Id":"a3","Measure_Name_New__c":"LED","Program__r":{"Name":"Lighting 2024"}}`, "Lighting"},
+		{"record type", rules, `{"Id":"a4","Record_Type_Name__c":"Controls","Program__r":{"Name":"P"}}`, "Thermostat"},
+		{"fallback", rules, `{"Id":"a5","Program__r":{"Name":"P"}}`, "Direct Install"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rec CustomRecords
+			if err := json.Unmarshal([]byte(tt.record), &rec); err != nil {
+				t.Fatal(err)
+			}
+			rule, err := classify(tt.rules, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rule.Name != tt.want {
+				t.Errorf("classified as %q, want %q", rule.Name, tt.want)
+			}
+		})
+	}
+
+	if _, err := classify(rules[:2], CustomRecords{Id: "a6"}); err != errNoRuleMatched {
+		t.Errorf("classify without a catch-all rule: error = %v, want errNoRuleMatched", err)
+	}
+}
+
+func TestLoadClassificationRulesErrors(t *testing.T) {
+	tests := map[string]string{
+		"empty":           `[]`,
+		"missing field":   `[{"name":"A","targetObject":"T__c"}]`,
+		"duplicate name":  `[{"name":"A","picklistField":"F__c","targetObject":"T__c"},{"name":"A","picklistField":"F__c","targetObject":"T__c"}]`,
+		"invalid pattern": `[{"name":"A","pattern":"(","picklistField":"F__c","targetObject":"T__c"}]`,
+	}
+	for name, rules := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rules.json")
+			if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadClassificationRules(path); err == nil {
+				t.Error("LoadClassificationRules succeeded")
+			}
+		})
+	}
+}
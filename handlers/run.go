@@ -0,0 +1,535 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	rbmq "github.com/AmitSuresh/sfdataapp/rabbitmq"
+	"github.com/AmitSuresh/sfdataapp/store"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+const (
+	RunPublishing = "publishing"
+	RunProcessing = "processing"
+	RunLoading    = "loading"
+	RunCompleted  = "completed"
+	RunFailed     = "failed"
+
+	// runTimeout bounds how long a run waits for the worker's results.
+	runTimeout = 30 * time.Minute
+	// requeueDelay spaces out redeliveries of results for runs that another
+	// process is tracking.
+	requeueDelay = 5 * time.Second
+)
+
+var (
+	errRunExists  = errors.New("a run with this id already exists")
+	errUnknownRun = errors.New("run is not tracked by this process")
+)
+
+// runTracker keeps picklist mapping runs in memory and writes their progress
+// through to the mapping store. A run is started by GetPickBasedMappingRec
+// and finished once the worker has reported on every request it published,
+// or failed when that takes longer than timeout. Finished runs are only kept
+// in the store.
+type runTracker struct {
+	mu      sync.Mutex
+	runs    map[string]*MappingRun
+	store   store.Store
+	timeout time.Duration
+	l       *zap.Logger
+
+	// saveMu orders writes to the store, which are made without mu held.
+	saveMu sync.Mutex
+}
+
+func newRunTracker(s store.Store, l *zap.Logger) *runTracker {
+	return &runTracker{runs: make(map[string]*MappingRun), store: s, timeout: runTimeout, l: l}
+}
+
+// start begins run id for the request with the given correlation ID.
+func (t *runTracker) start(ctx context.Context, id, correlationID string) (*MappingRun, error) {
+	if t.store != nil {
+		_, err := t.store.FindRun(ctx, id)
+		if err == nil {
+			return nil, errRunExists
+		}
+		if !errors.Is(err, store.ErrRunNotFound) {
+			return nil, err
+		}
+	}
+
+	now := time.Now().UTC()
+	run := &MappingRun{
+		ID:            id,
+		CorrelationID: correlationID,
+		State:         RunPublishing,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		reported:      make(map[string]bool),
+	}
+
+	t.mu.Lock()
+	if _, ok := t.runs[id]; ok {
+		t.mu.Unlock()
+		return nil, errRunExists
+	}
+	t.runs[id] = run
+	snap := t.snapshot(run)
+	t.mu.Unlock()
+
+	t.save(snap)
+	return run, nil
+}
+
+// snapshot copies the progress of run for save. It is called with t.mu held.
+func (t *runTracker) snapshot(run *MappingRun) *runSnapshot {
+	run.seq++
+	return &runSnapshot{seq: run.seq, run: &store.Run{
+		ID:            run.ID,
+		CorrelationID: run.CorrelationID,
+		State:         run.State,
+		Published:     run.Published,
+		Succeeded:     run.Succeeded,
+		Failed:        run.Failed,
+		Error:         run.Error,
+		Failures:      append([]PublishFailure(nil), run.Failures...),
+		Jobs:          append([]BulkLoadJob(nil), run.Jobs...),
+		CreatedAt:     run.CreatedAt,
+		UpdatedAt:     run.UpdatedAt,
+	}}
+}
+
+type runSnapshot struct {
+	seq uint64
+	run *store.Run
+}
+
+// save writes snap to the store without holding t.mu, so a slow store does
+// not hold up GetRun or the results of other runs. A snapshot older than one
+// already saved is dropped. Once a finished run is saved it is forgotten.
+func (t *runTracker) save(snap *runSnapshot) {
+	if t.store == nil || snap == nil {
+		return
+	}
+	t.saveMu.Lock()
+	defer t.saveMu.Unlock()
+
+	id := snap.run.ID
+	t.mu.Lock()
+	run, ok := t.runs[id]
+	stale := ok && snap.seq <= run.saved
+	t.mu.Unlock()
+	if !ok || stale {
+		return
+	}
+
+	if err := t.store.SaveRun(context.Background(), snap.run); err != nil {
+		// Keep the run in memory so GetRun can still report it.
+		t.l.Error("error saving run progress", zap.String("runId", id), zap.String("correlationId", snap.run.CorrelationID), zap.Error(err))
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	run.saved = snap.seq
+	if (run.State == RunCompleted || run.State == RunFailed) && run.seq == snap.seq {
+		if run.timer != nil {
+			run.timer.Stop()
+		}
+		delete(t.runs, id)
+	}
+}
+
+// published records how many requests of the run reached the queue and
+// reports whether the run is already complete.
+func (t *runTracker) published(id string, res *PublishResult) bool {
+	var snap *runSnapshot
+	defer func() { t.save(snap) }()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	run := t.runs[id]
+	run.Published = res.Accepted
+	run.Failed += res.Failed
+	run.Failures = append(run.Failures, res.Failures...)
+	run.UpdatedAt = time.Now().UTC()
+	defer func() { snap = t.snapshot(run) }()
+
+	switch {
+	case res.Accepted == 0 && res.Failed > 0:
+		run.State = RunFailed
+		run.Error = "no requests were published"
+		return false
+	case res.Accepted == 0:
+		run.State = RunCompleted
+		return false
+	}
+
+	run.State = RunProcessing
+	if run.done() {
+		return run.finish()
+	}
+	run.timer = time.AfterFunc(t.timeout, func() { t.expire(id) })
+	return false
+}
+
+// expire fails a run that is still waiting for results.
+func (t *runTracker) expire(id string) {
+	t.mu.Lock()
+	run, ok := t.runs[id]
+	if !ok || run.State != RunProcessing {
+		t.mu.Unlock()
+		return
+	}
+	run.State = RunFailed
+	run.Error = fmt.Sprintf("timed out after %s with %d of %d requests reported", t.timeout, len(run.reported), run.Published)
+	run.UpdatedAt = time.Now().UTC()
+	t.l.Warn("picklist mapping run timed out", zap.String("runId", id), zap.String("correlationId", run.CorrelationID), zap.String("error", run.Error))
+	snap := t.snapshot(run)
+	t.mu.Unlock()
+
+	t.save(snap)
+}
+
+// record applies a worker result and reports whether it completed the run.
+// Results are counted by request, so a request reported twice, after a
+// redelivery, is counted once.
+func (t *runTracker) record(id string, res *rbmq.PicklistQueryResult) (bool, error) {
+	var snap *runSnapshot
+	defer func() { t.save(snap) }()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	run, ok := t.runs[id]
+	if !ok {
+		return false, fmt.Errorf("%w: %q", errUnknownRun, id)
+	}
+	key := res.RequestID
+	if key == "" {
+		// Reported by a worker that does not send request ids.
+		key = res.RecordType + "/" + res.RecordID
+	}
+	if run.reported[key] {
+		return false, nil
+	}
+	run.reported[key] = true
+	run.UpdatedAt = time.Now().UTC()
+	defer func() { snap = t.snapshot(run) }()
+
+	if !res.Succeeded {
+		run.Failed++
+		run.Failures = append(run.Failures, PublishFailure{RecordID: res.RecordID, RecordType: res.RecordType, Error: res.Error})
+	} else {
+		run.Succeeded++
+		for _, r := range res.Mappings.Recs {
+			run.addRow(store.RecordTypeRecommendation, mappingRow{r.ProgName, r.MeasureName, r.PicklistVal})
+		}
+		for _, r := range res.Mappings.Eqs {
+			run.addRow(store.RecordTypeDirectInstall, mappingRow{r.ProgName, r.MeasureName, r.PicklistVal})
+		}
+		for _, r := range res.Mappings.Other {
+			run.addRow(r.RecordType, mappingRow{r.ProgName, r.MeasureName, r.PicklistVal})
+		}
+	}
+
+	if run.State != RunProcessing || !run.done() {
+		return false, nil
+	}
+	return run.finish(), nil
+}
+
+func (r *MappingRun) addRow(category string, row mappingRow) {
+	if r.rows == nil {
+		r.rows = make(map[string][]mappingRow)
+	}
+	r.rows[category] = append(r.rows[category], row)
+}
+
+// done reports whether every published request has been reported on.
+// Failures to publish are counted in Failed but not in Published.
+func (r *MappingRun) done() bool {
+	return len(r.reported) >= r.Published
+}
+
+// finish stops the timeout of a run whose requests have all been reported
+// and reports whether its rows should be loaded. A run where every reported
+// request failed has nothing to load and fails.
+func (r *MappingRun) finish() bool {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	if r.Succeeded == 0 {
+		r.State = RunFailed
+		r.Error = "every request failed"
+		return false
+	}
+	return true
+}
+
+func (t *runTracker) update(id string, f func(r *MappingRun)) {
+	t.mu.Lock()
+	run, ok := t.runs[id]
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+	f(run)
+	run.UpdatedAt = time.Now().UTC()
+	snap := t.snapshot(run)
+	t.mu.Unlock()
+
+	t.save(snap)
+}
+
+// orphaned decides what to do with a result for a run this process does not
+// track. It reports true when the result should be requeued for the process
+// that started the run. Results of finished or unknown runs are dropped, and
+// a run no process has updated within timeout, such as one started before a
+// restart, is failed in the store.
+func (t *runTracker) orphaned(ctx context.Context, id string) (bool, error) {
+	if t.store == nil {
+		return false, nil
+	}
+	run, err := t.store.FindRun(ctx, id)
+	switch {
+	case errors.Is(err, store.ErrRunNotFound):
+		return false, nil
+	case err != nil:
+		return true, err
+	case run.State == RunCompleted || run.State == RunFailed:
+		return false, nil
+	case time.Since(run.UpdatedAt) < t.timeout:
+		return true, nil
+	}
+
+	run.State = RunFailed
+	run.Error = "no process is tracking the run; it was started before a restart or by a stopped replica"
+	run.UpdatedAt = time.Now().UTC()
+	return false, t.store.SaveRun(ctx, run)
+}
+
+// get returns a copy of the run that is safe to encode without the lock.
+// Finished runs and runs started by another process or before a restart are
+// read from the store.
+func (t *runTracker) get(ctx context.Context, id string) (MappingRun, error) {
+	t.mu.Lock()
+	run, ok := t.runs[id]
+	if ok {
+		c := *run
+		c.Failures = append([]PublishFailure(nil), run.Failures...)
+		c.Jobs = append([]BulkLoadJob(nil), run.Jobs...)
+		t.mu.Unlock()
+		return c, nil
+	}
+	t.mu.Unlock()
+
+	if t.store == nil {
+		return MappingRun{}, store.ErrRunNotFound
+	}
+	stored, err := t.store.FindRun(ctx, id)
+	if err != nil {
+		return MappingRun{}, err
+	}
+	return MappingRun{
+		ID:            stored.ID,
+		CorrelationID: stored.CorrelationID,
+		State:         stored.State,
+		Published:     stored.Published,
+		Succeeded:     stored.Succeeded,
+		Failed:        stored.Failed,
+		Error:         stored.Error,
+		Failures:      stored.Failures,
+		Jobs:          stored.Jobs,
+		CreatedAt:     stored.CreatedAt,
+		UpdatedAt:     stored.UpdatedAt,
+	}, nil
+}
+
+// ConsumePicklistResults starts consuming worker results and loads each run's
+// mapping rows into Salesforce once all of its requests are reported.
+func (h *Handler) ConsumePicklistResults() error {
+	if err := rbmq.DeclarePicklistResultQueue(h.broker); err != nil {
+		h.l.Error("error declaring result queue", zap.Error(err))
+		return err
+	}
+
+	msgs, err := h.broker.Consume(rbmq.PicklistResultQueue, false)
+	if err != nil {
+		h.l.Error("error consuming results", zap.Error(err))
+		return err
+	}
+
+	go func() {
+		for d := range msgs {
+			l := h.l.With(zap.String("correlationId", d.CorrelationID), zap.String("messageId", d.MessageID))
+			res := new(rbmq.PicklistQueryResult)
+			if err := json.Unmarshal(d.Body, res); err != nil {
+				l.Error("error unmarshalling result", zap.Error(err))
+				d.Nack(false)
+				continue
+			}
+
+			if res.RunID == "" {
+				l.Warn("dropping result without a run id")
+				if err := d.Ack(); err != nil {
+					l.Error("error acknowledging result", zap.Error(err))
+				}
+				continue
+			}
+			l = l.With(zap.String("runId", res.RunID))
+
+			done, err := h.runs.record(res.RunID, res)
+			if errors.Is(err, errUnknownRun) {
+				h.orphanedResult(d, res.RunID, l)
+				continue
+			}
+			if done {
+				go h.loadRun(res.RunID)
+			}
+			if err := d.Ack(); err != nil {
+				l.Error("error acknowledging result", zap.Error(err))
+			}
+		}
+	}()
+	return nil
+}
+
+// orphanedResult requeues a result for a run tracked by another process,
+// after requeueDelay so it is not redelivered straight back, and acks it
+// otherwise.
+func (h *Handler) orphanedResult(d rbmq.Delivery, runID string, l *zap.Logger) {
+	requeue, err := h.runs.orphaned(context.Background(), runID)
+	if err != nil {
+		l.Error("error reading run", zap.Error(err))
+	}
+	if requeue {
+		l.Info("requeueing result for a run tracked elsewhere")
+		time.AfterFunc(requeueDelay, func() {
+			if err := d.Nack(true); err != nil {
+				l.Error("error requeueing result", zap.Error(err))
+			}
+		})
+		return
+	}
+	l.Warn("dropping result of a finished or unknown run")
+	if err := d.Ack(); err != nil {
+		l.Error("error acknowledging result", zap.Error(err))
+	}
+}
+
+// loadRun inserts the run's mapping rows with one Bulk API job per object.
+func (h *Handler) loadRun(id string) {
+	var correlationID string
+	var rows map[string][]mappingRow
+	h.runs.update(id, func(r *MappingRun) {
+		r.State = RunLoading
+		correlationID, rows = r.CorrelationID, r.rows
+	})
+	ctx := h.withRunID(h.withCorrelationID(context.Background(), correlationID), id)
+	l := h.logger(ctx)
+
+	categories := make([]string, 0, len(rows))
+	for c := range rows {
+		categories = append(categories, c)
+	}
+	sort.Strings(categories)
+
+	var jobs []BulkLoadJob
+	failed := false
+	for _, category := range categories {
+		rule, ok := ruleByName(h.rules, category)
+		if !ok {
+			jobs = append(jobs, BulkLoadJob{Category: category, Error: "no classification rule for category"})
+			failed = true
+			continue
+		}
+
+		data := [][]string{{"Program_Name__c", "Measure_Description__c", rule.PicklistField}}
+		for _, v := range dedupeRows(rows[category]) {
+			data = append(data, []string{v.Program, v.Measure, v.Value})
+		}
+		job := h.bulkLoad(ctx, rule.TargetObject, data)
+		job.Category = category
+		failed = failed || job.Error != ""
+		jobs = append(jobs, job)
+	}
+
+	h.runs.update(id, func(r *MappingRun) {
+		r.Jobs = jobs
+		r.State = RunCompleted
+		if failed {
+			r.State = RunFailed
+			r.Error = "bulk load failed"
+		}
+	})
+	l.Info("picklist mapping run finished", zap.Bool("failed", failed), zap.Int("jobs", len(jobs)))
+}
+
+// bulkLoad creates, fills and closes one ingest job. data holds the CSV
+// header followed by the rows.
+func (h *Handler) bulkLoad(ctx context.Context, object string, data [][]string) BulkLoadJob {
+	l := h.logger(ctx)
+	job := BulkLoadJob{Object: object, Records: len(data) - 1}
+
+	jobID, err := h.createJob(ctx, object)
+	if err == nil && jobID == "" {
+		err = fmt.Errorf("no job id returned for %s", object)
+	}
+	if err != nil {
+		job.Error = err.Error()
+		return job
+	}
+	job.JobID = jobID
+
+	if err := h.uploadBatch(ctx, jobID, data); err != nil {
+		l.Error("error uploading batch", zap.String("jobID", jobID), zap.Error(err))
+		job.Error = err.Error()
+		return job
+	}
+	if err := h.closeJob(ctx, jobID); err != nil {
+		l.Error("error closing job", zap.String("jobID", jobID), zap.Error(err))
+		job.Error = err.Error()
+	}
+	return job
+}
+
+func dedupeRows[T comparable](rows []T) []T {
+	seen := make(map[T]struct{}, len(rows))
+	var out []T
+	for _, r := range rows {
+		if _, ok := seen[r]; ok {
+			continue
+		}
+		seen[r] = struct{}{}
+		out = append(out, r)
+	}
+	return out
+}
+
+func (h *Handler) GetRun(w http.ResponseWriter, r *http.Request) {
+	l := h.logger(r.Context())
+	run, err := h.runs.get(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, store.ErrRunNotFound) {
+		http.Error(w, "run not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		l.Error("error reading run", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := ToJSON(run, w); err != nil {
+		l.Error("error writing result", zap.Error(err))
+	}
+}
@@ -0,0 +1,348 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	rbmq "github.com/AmitSuresh/sfdataapp/rabbitmq"
+	"github.com/AmitSuresh/sfdataapp/salesforce"
+	"github.com/AmitSuresh/sfdataapp/salesforce/sftest"
+	"github.com/AmitSuresh/sfdataapp/store"
+	"go.uber.org/zap"
+)
+
+// fakeIngest issues access tokens and records the Bulk API jobs created
+// against it.
+type fakeIngest struct {
+	mu      sync.Mutex
+	objects map[string]string
+	batches map[string]string
+	closed  map[string]bool
+}
+
+func (f *fakeIngest) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/services/data/v58.0/jobs/ingest"), "/")
+	switch {
+	case r.URL.Path == "/services/oauth2/token":
+		fmt.Fprint(w, `{"access_token":"token"}`)
+	case r.Method == http.MethodPost && id == "":
+		var job map[string]string
+		json.NewDecoder(r.Body).Decode(&job)
+		id = fmt.Sprintf("750%d", len(f.objects))
+		f.objects[id] = job["object"]
+		fmt.Fprintf(w, `{"id":%q}`, id)
+	case r.Method == http.MethodPut && strings.HasSuffix(id, "/batches"):
+		body, _ := io.ReadAll(r.Body)
+		f.batches[strings.TrimSuffix(id, "/batches")] = string(body)
+	case r.Method == http.MethodPatch:
+		f.closed[id] = true
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func testHandler(t *testing.T) (*Handler, *rbmq.MemoryBroker, *fakeIngest) {
+	t.Helper()
+	ingest := &fakeIngest{objects: map[string]string{}, batches: map[string]string{}, closed: map[string]bool{}}
+	sf := httptest.NewServer(ingest)
+	t.Cleanup(sf.Close)
+
+	dir := t.TempDir()
+	l := zap.NewNop()
+	client, err := salesforce.NewClient(&salesforce.Config{
+		InstanceURL: sf.URL,
+		SfEnv:       "test",
+		KeyPath:     sftest.KeyFile(t, dir),
+		APIVersion:  "58.0",
+	}, sf.Client(), l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := store.New(&store.Config{Backend: store.BackendFile, Dir: dir}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := rbmq.NewMemoryBroker()
+	t.Cleanup(func() { b.Close() })
+
+	h, err := GetHandler(client, b, s, DefaultClassificationRules(), nil, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, b, ingest
+}
+
+// waitForRun polls the run until it has finished.
+func waitForRun(t *testing.T, h *Handler, id string) MappingRun {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		run, err := h.runs.get(context.Background(), id)
+		if err == nil && (run.State == RunCompleted || run.State == RunFailed) {
+			return run
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("run %s did not finish", id)
+	return MappingRun{}
+}
+
+// TestPicklistMappingRun publishes a run through GetPickBasedMappingRec,
+// answers its requests the way the queue worker does and checks that the
+// run loads the reported rows once every request is reported.
+func TestPicklistMappingRun(t *testing.T) {
+	h, b, ingest := testHandler(t)
+	if err := h.ConsumePicklistResults(); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"sObject":"Measure__c","records":[
+		{"Id":"a1","Measure_Name_New__c":"Recommendation A","Record_Type_Id__c":"012000000000001AAA","Program__r":{"Name":"P"}},
+		{"Id":"a1","Measure_Name_New__c":"Recommendation A","Record_Type_Id__c":"012000000000001AAA","Program__r":{"Name":"P"}},
+		{"Id":"a2","Measure_Name_New__c":"Furnace","Record_Type_Id__c":"012000000000001AAA","Program__r":{"Name":"P"}}
+	]}`
+	r := httptest.NewRequest(http.MethodPost, "/picklist", strings.NewReader(body))
+	r.Header.Set(CorrelationHeader, "trace-1")
+	w := httptest.NewRecorder()
+	h.Correlate(http.HandlerFunc(h.GetPickBasedMappingRec)).ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	res := new(PublishResult)
+	if err := json.Unmarshal(w.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	if res.RunID == "" || res.Accepted != 2 || res.Failed != 0 {
+		t.Fatalf("publish result = %+v, want a run with 2 accepted", res)
+	}
+
+	requests, err := b.Consume(rbmq.PicklistQueryEvent, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		var d rbmq.Delivery
+		select {
+		case d = <-requests:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a request")
+		}
+		o := new(rbmq.PicklistQueueRequest)
+		if err := json.Unmarshal(d.Body, o); err != nil {
+			t.Fatal(err)
+		}
+		if o.RunID != res.RunID || d.CorrelationID != "trace-1" || d.MessageID == "" || o.SObject != "Measure__c" {
+			t.Errorf("request = %+v with correlation id %q and message id %q", o, d.CorrelationID, d.MessageID)
+		}
+
+		result := &rbmq.PicklistQueryResult{RunID: o.RunID, RequestID: d.MessageID, RecordID: o.CustomObj.Id, RecordType: o.RecordType, Succeeded: true}
+		switch o.FieldName {
+		case "Recommendation__c":
+			result.Mappings.Recs = rbmq.RecommendationRecords{{ProgName: "P", MeasureName: o.CustomObj.MeasureNameNew, PicklistVal: "Seal"}}
+		case "Equipment_Type__c":
+			result.Mappings.Eqs = rbmq.EquipmentRecords{{ProgName: "P", MeasureName: o.CustomObj.MeasureNameNew, PicklistVal: "Heat Pump"}}
+		default:
+			t.Fatalf("unexpected picklist field %q", o.FieldName)
+		}
+		// A redelivered request reports twice; the run counts it once.
+		for n := 0; n < 2; n++ {
+			publishResult(t, b, result)
+		}
+	}
+
+	run := waitForRun(t, h, res.RunID)
+	if run.State != RunCompleted || run.Published != 2 || run.Succeeded != 2 || run.Failed != 0 || len(run.Jobs) != 2 {
+		t.Fatalf("run = %+v, want completed with 2 of 2 succeeded and 2 jobs", run)
+	}
+
+	ingest.mu.Lock()
+	defer ingest.mu.Unlock()
+	var loaded []string
+	for id, object := range ingest.objects {
+		if !ingest.closed[id] {
+			t.Errorf("job %s for %s was not closed", id, object)
+		}
+		loaded = append(loaded, object+": "+ingest.batches[id])
+	}
+	sort.Strings(loaded)
+	want := []string{
+		"Measure_Equipment_Type__c: Program_Name__c,Measure_Description__c,Equipment_Type__c\nP,Furnace,Heat Pump\n",
+		"Measure_Recommendation__c: Program_Name__c,Measure_Description__c,Recommendation__c\nP,Recommendation A,Seal\n",
+	}
+	if strings.Join(loaded, "|") != strings.Join(want, "|") {
+		t.Errorf("loaded %q, want %q", loaded, want)
+	}
+
+	stored, err := h.mappings.FindRun(context.Background(), res.RunID)
+	if err != nil || stored.State != RunCompleted || stored.CorrelationID != "trace-1" {
+		t.Errorf("stored run = %+v, %v, want completed with correlation id trace-1", stored, err)
+	}
+}
+
+func publishResult(t *testing.T, b rbmq.Broker, res *rbmq.PicklistQueryResult) {
+	t.Helper()
+	var body bytes.Buffer
+	if err := ToJSON(res, &body); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish(context.Background(), rbmq.PicklistResultQueue, rbmq.Message{CorrelationID: "trace-1", Body: body.Bytes()}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunTrackerTimeout(t *testing.T) {
+	h, _, _ := testHandler(t)
+	h.runs.timeout = 20 * time.Millisecond
+
+	if _, err := h.runs.start(context.Background(), "run-1", "trace-1"); err != nil {
+		t.Fatal(err)
+	}
+	if h.runs.published("run-1", &PublishResult{Accepted: 2}) {
+		t.Fatal("run with unreported requests is done")
+	}
+	if _, err := h.runs.record("run-1", &rbmq.PicklistQueryResult{RequestID: "m1", Succeeded: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	run := waitForRun(t, h, "run-1")
+	if run.State != RunFailed || !strings.Contains(run.Error, "1 of 2 requests reported") {
+		t.Errorf("run = %+v, want failed after 1 of 2 reports", run)
+	}
+	if _, err := h.runs.record("run-1", &rbmq.PicklistQueryResult{RequestID: "m2", Succeeded: true}); err == nil {
+		t.Error("a result for a timed out run was recorded")
+	}
+}
+
+func TestRunTrackerAllRequestsFailed(t *testing.T) {
+	h, _, _ := testHandler(t)
+	ctx := context.Background()
+
+	if _, err := h.runs.start(ctx, "run-1", "trace-1"); err != nil {
+		t.Fatal(err)
+	}
+	h.runs.published("run-1", &PublishResult{Accepted: 1, Failed: 1, Failures: []PublishFailure{{RecordID: "a2", Error: "no classification rule matches"}}})
+	load, err := h.runs.record("run-1", &rbmq.PicklistQueryResult{RequestID: "m1", RecordID: "a1", Error: "no picklist values"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if load {
+		t.Error("a run where every request failed is loaded")
+	}
+
+	// The failures are read back from the store once the run is evicted.
+	run, err := h.runs.get(ctx, "run-1")
+	if err != nil || run.State != RunFailed || len(run.Failures) != 2 {
+		t.Errorf("run = %+v, %v, want failed with 2 failures", run, err)
+	}
+}
+
+func TestRunTrackerStart(t *testing.T) {
+	h, _, _ := testHandler(t)
+	ctx := context.Background()
+
+	if _, err := h.runs.start(ctx, "run-1", "trace-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.runs.start(ctx, "run-1", "trace-1"); err != errRunExists {
+		t.Errorf("starting a running run: error = %v, want errRunExists", err)
+	}
+
+	// A finished run is evicted but still known through the store.
+	h.runs.published("run-1", &PublishResult{})
+	if _, err := h.runs.start(ctx, "run-1", "trace-1"); err != errRunExists {
+		t.Errorf("starting a finished run: error = %v, want errRunExists", err)
+	}
+	if run, err := h.runs.get(ctx, "run-1"); err != nil || run.State != RunCompleted || run.CorrelationID != "trace-1" {
+		t.Errorf("get = %+v, %v, want the completed run", run, err)
+	}
+}
+
+// TestRunIDs checks that requests reusing a correlation ID each start a run
+// of their own.
+func TestRunIDs(t *testing.T) {
+	h, _, _ := testHandler(t)
+
+	ids := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/picklist", strings.NewReader(`{"sObject":"Measure__c","records":[]}`))
+		r.Header.Set(CorrelationHeader, "trace-1")
+		w := httptest.NewRecorder()
+		h.Correlate(http.HandlerFunc(h.GetPickBasedMappingRec)).ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+		if id := w.Header().Get(CorrelationHeader); id != "trace-1" {
+			t.Errorf("%s = %q, want trace-1", CorrelationHeader, id)
+		}
+
+		res := new(PublishResult)
+		if err := json.Unmarshal(w.Body.Bytes(), res); err != nil {
+			t.Fatal(err)
+		}
+		run, err := h.runs.get(context.Background(), res.RunID)
+		if err != nil || run.CorrelationID != "trace-1" {
+			t.Errorf("run %q = %+v, %v, want correlation id trace-1", res.RunID, run, err)
+		}
+		ids[res.RunID] = true
+	}
+	if len(ids) != 2 {
+		t.Errorf("run ids = %v, want two distinct ids", ids)
+	}
+}
+
+func TestRunTrackerOrphaned(t *testing.T) {
+	h, _, _ := testHandler(t)
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	runs := []*store.Run{
+		{ID: "fresh", State: RunProcessing, UpdatedAt: now},
+		{ID: "stale", State: RunProcessing, UpdatedAt: now.Add(-2 * runTimeout)},
+		{ID: "done", State: RunCompleted, UpdatedAt: now},
+	}
+	for _, run := range runs {
+		if err := h.mappings.SaveRun(ctx, run); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		id      string
+		requeue bool
+		state   string
+	}{
+		{"fresh", true, RunProcessing},
+		{"stale", false, RunFailed},
+		{"done", false, RunCompleted},
+		{"unknown", false, ""},
+	}
+	for _, tt := range tests {
+		requeue, err := h.runs.orphaned(ctx, tt.id)
+		if err != nil {
+			t.Errorf("orphaned(%s): %v", tt.id, err)
+		}
+		if requeue != tt.requeue {
+			t.Errorf("orphaned(%s) = %v, want %v", tt.id, requeue, tt.requeue)
+		}
+		if tt.state == "" {
+			continue
+		}
+		if run, err := h.mappings.FindRun(ctx, tt.id); err != nil || run.State != tt.state {
+			t.Errorf("run %s = %+v, %v, want state %s", tt.id, run, err, tt.state)
+		}
+	}
+}
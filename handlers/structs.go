@@ -1,138 +1,265 @@
-package handlers
-
-import (
-	"net/http"
-
-	"github.com/rabbitmq/amqp091-go"
-	"go.uber.org/zap"
-)
-
-type Handler struct {
-	clientID      string
-	clientSecret  string
-	username      string
-	instanceURL   string
-	authURL       string
-	tokenURL      string
-	sobjectsURL   string
-	UserAgent     string
-	accessToken   string
-	jwtToken      string
-	sfEnv         string
-	pKeyPath      string
-	queryURL      string
-	uiapiURL      string
-	uiapibatchURL string
-	ingestURL     string
-
-	l      *zap.Logger
-	client *http.Client
-
-	amqpCh    *amqp091.Channel
-	amqpClose func() error
-}
-
-type FieldMetadata struct {
-	Name  string `json:"name"`
-	Label string `json:"label"`
-}
-
-type MetadataResponse struct {
-	Fields []FieldMetadata `json:"fields"`
-}
-
-type FieldAPILabelMapping map[string]string
-
-type Payload struct {
-	SObject             string                   `json:"sObject,omitempty"`
-	FieldName           string                   `json:"fieldName,omitempty"`
-	Query               string                   `json:"query,omitempty"`
-	RecTypeID           string                   `json:"recTypeId,omitempty"`
-	Records             []CustomRecords          `json:"records,omitempty"`
-	PicklistMapToInsert PicklistMappedResp       `json:"picklist_map_insert,omitempty"`
-	TargetSObject       string                   `json:"targetsObject,omitempty"`
-	RecordsToInsert     []map[string]interface{} `json:"rec_to_insert,omitempty"`
-}
-
-type QueryResponse struct {
-	TotalSize int             `json:"totalSize"`
-	Done      bool            `json:"done"`
-	Records   []CustomRecords `json:"records"`
-}
-
-type CustomRecords struct {
-	Id             string        `json:"Id"`
-	MeasureNameNew string        `json:"Measure_Name_New__c,omitempty"`
-	RecTypeName    string        `json:"Record_Type_Name__c,omitempty"`
-	RecTypeId      string        `json:"Record_Type_Id__c,omitempty"`
-	ProgRec        ProgramRecord `json:"Program__r,omitempty"`
-}
-type ProgramRecord struct {
-	Name string `json:"Name,omitempty"`
-}
-
-type PicklistQueryResponse struct {
-	PicklistValues []PicklistValue `json:"Values"`
-}
-
-type PicklistValue struct {
-	PickValues string `json:"value"`
-}
-
-type CustomRecordsMap map[string][]CustomRecords
-
-type EquipmentRecord struct {
-	ProgName    string `json:"Program_Name__c"`
-	MeasureName string `json:"Measure_Description__c"`
-	PicklistVal string `json:"Equipment_Type__c"`
-}
-type RecommendationRecord struct {
-	ProgName    string `json:"Program_Name__c"`
-	MeasureName string `json:"Measure_Description__c"`
-	PicklistVal string `json:"Recommendation__c"`
-}
-
-type EquipmentRecords []EquipmentRecord
-
-type RecommendationRecords []RecommendationRecord
-
-type PicklistMappedResp struct {
-	Eqs  EquipmentRecords      `json:"equipment_records,omitempty"`
-	Recs RecommendationRecords `json:"recommendation_records,omitempty"`
-}
-
-type BulkInsertResult struct {
-	HasErrors bool        `json:"hasErrors,omitempty"`
-	Results   interface{} `json:"results"`
-}
-
-type BulkInsert struct {
-	AllOrNone  bool        `json:"allOrNone"`
-	Operations []Operation `json:"operations"`
-}
-
-type Operation struct {
-	Type    string   `json:"type"`
-	Records []Record `json:"records"`
-}
-
-type Record struct {
-	APIName string      `json:"apiName"`
-	Fields  interface{} `json:"fields"`
-}
-
-type BulkCreateJobResult struct {
-	ID              string  `json:"id"`
-	Operation       string  `json:"operation"`
-	Object          string  `json:"object"`
-	CreatedByID     string  `json:"createdById,omitempty"`
-	CreatedDate     string  `json:"createdDate,omitempty"`
-	SystemModstamp  string  `json:"systemModstamp,omitempty"`
-	State           string  `json:"state,omitempty"`
-	ConcurrencyMode string  `json:"concurrencyMode,omitempty"`
-	ContentType     string  `json:"contentType,omitempty"`
-	APIVersion      float64 `json:"apiVersion,omitempty"`
-	ContentURL      string  `json:"contentUrl,omitempty"`
-	LineEnding      string  `json:"lineEnding,omitempty"`
-	ColumnDelimiter string  `json:"columnDelimiter,omitempty"`
-}
+package handlers
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/AmitSuresh/sfdataapp/files"
+	rbmq "github.com/AmitSuresh/sfdataapp/rabbitmq"
+	"github.com/AmitSuresh/sfdataapp/salesforce"
+	"github.com/AmitSuresh/sfdataapp/store"
+	"go.uber.org/zap"
+)
+
+type Handler struct {
+	sobjectsURL   string
+	queryURL      string
+	uiapiURL      string
+	uiapibatchURL string
+	ingestURL     string
+	toolingURL    string
+
+	l  *zap.Logger
+	sf *salesforce.Client
+
+	broker   rbmq.Broker
+	mappings store.Store
+	runs     *runTracker
+	rules    []ClassificationRule
+	// files serves the output directories under /api/files. It is nil when
+	// none is configured and the routes are not registered.
+	files *files.Server
+}
+
+type FieldMetadata struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+}
+
+type MetadataResponse struct {
+	Fields []FieldMetadata `json:"fields"`
+}
+
+type FieldAPILabelMapping map[string]string
+
+type Payload struct {
+	SObject             string                   `json:"sObject,omitempty"`
+	FieldName           string                   `json:"fieldName,omitempty"`
+	Query               string                   `json:"query,omitempty"`
+	RecTypeID           string                   `json:"recTypeId,omitempty"`
+	Records             []CustomRecords          `json:"records,omitempty"`
+	PicklistMapToInsert PicklistMappedResp       `json:"picklist_map_insert,omitempty"`
+	TargetSObject       string                   `json:"targetsObject,omitempty"`
+	RecordsToInsert     []map[string]interface{} `json:"rec_to_insert,omitempty"`
+}
+
+type QueryResponse struct {
+	TotalSize int             `json:"totalSize"`
+	Done      bool            `json:"done"`
+	Records   []CustomRecords `json:"records"`
+}
+
+type CustomRecords struct {
+	Id             string        `json:"Id"`
+	MeasureNameNew string        `json:"Measure_Name_New__c,omitempty"`
+	RecTypeName    string        `json:"Record_Type_Name__c,omitempty"`
+	RecTypeId      string        `json:"Record_Type_Id__c,omitempty"`
+	ProgRec        ProgramRecord `json:"Program__r,omitempty"`
+
+	fields map[string]interface{}
+}
+type ProgramRecord struct {
+	Name string `json:"Name,omitempty"`
+}
+
+type PicklistQueryResponse struct {
+	PicklistValues []PicklistValue `json:"Values"`
+}
+
+type PicklistValue struct {
+	PickValues string `json:"value"`
+}
+
+type CustomRecordsMap map[string][]CustomRecords
+
+// PicklistCompareRequest lists values about to be imported into FieldName.
+// RecTypeID defaults to the master record type.
+type PicklistCompareRequest struct {
+	SObject   string   `json:"sObject"`
+	FieldName string   `json:"fieldName"`
+	RecTypeID string   `json:"recTypeId,omitempty"`
+	Values    []string `json:"values"`
+}
+
+// PicklistCompareResult lists the incoming values the picklist lacks and the
+// picklist values the incoming data does not use.
+type PicklistCompareResult struct {
+	SObject   string   `json:"sObject"`
+	FieldName string   `json:"fieldName"`
+	RecTypeID string   `json:"recTypeId"`
+	Existing  []string `json:"existing"`
+	Missing   []string `json:"missing"`
+	Unused    []string `json:"unused"`
+}
+
+// PicklistChangeRequest targets either a custom picklist field (SObject and
+// FieldName) or a global value set (ValueSet). Nothing is written unless
+// Apply is set.
+type PicklistChangeRequest struct {
+	SObject    string   `json:"sObject,omitempty"`
+	FieldName  string   `json:"fieldName,omitempty"`
+	ValueSet   string   `json:"valueSet,omitempty"`
+	Add        []string `json:"add,omitempty"`
+	Deactivate []string `json:"deactivate,omitempty"`
+	Order      []string `json:"order,omitempty"`
+	Apply      bool     `json:"apply"`
+}
+
+type PicklistChangeResult struct {
+	Target      string               `json:"target"`
+	Applied     bool                 `json:"applied"`
+	Added       []string             `json:"added,omitempty"`
+	Activated   []string             `json:"activated,omitempty"`
+	Deactivated []string             `json:"deactivated,omitempty"`
+	NotFound    []string             `json:"notFound,omitempty"`
+	Reordered   bool                 `json:"reordered"`
+	Before      []PicklistValueState `json:"before"`
+	After       []PicklistValueState `json:"after"`
+}
+
+type PicklistValueState struct {
+	Value  string `json:"value"`
+	Label  string `json:"label"`
+	Active bool   `json:"active"`
+}
+
+type ToolingQueryResponse struct {
+	Size    int             `json:"size"`
+	Records []ToolingRecord `json:"records"`
+}
+
+type ToolingRecord struct {
+	ID       string                 `json:"Id"`
+	FullName string                 `json:"FullName"`
+	Metadata map[string]interface{} `json:"Metadata"`
+}
+
+// ClassificationRule sends matching records to a category. Pattern is a
+// regular expression matched against Field (Measure_Name_New__c by default,
+// dots reach into relationships) and RecordTypeName must equal the record's
+// Record_Type_Name__c; a rule with neither matches every record. The
+// category's picklist values are read from PicklistField and loaded into
+// TargetObject.
+type ClassificationRule struct {
+	Name           string `json:"name"`
+	Field          string `json:"field,omitempty"`
+	Pattern        string `json:"pattern,omitempty"`
+	RecordTypeName string `json:"recordTypeName,omitempty"`
+	PicklistField  string `json:"picklistField"`
+	TargetObject   string `json:"targetObject"`
+	// ControllingField names the record field holding the controlling value
+	// when PicklistField is a dependent picklist.
+	ControllingField string `json:"controllingField,omitempty"`
+
+	re *regexp.Regexp
+}
+
+type EquipmentRecord struct {
+	ProgName    string `json:"Program_Name__c"`
+	MeasureName string `json:"Measure_Description__c"`
+	PicklistVal string `json:"Equipment_Type__c"`
+}
+type RecommendationRecord struct {
+	ProgName    string `json:"Program_Name__c"`
+	MeasureName string `json:"Measure_Description__c"`
+	PicklistVal string `json:"Recommendation__c"`
+}
+
+type EquipmentRecords []EquipmentRecord
+
+type RecommendationRecords []RecommendationRecord
+
+type PicklistMappedResp struct {
+	Eqs  EquipmentRecords      `json:"equipment_records,omitempty"`
+	Recs RecommendationRecords `json:"recommendation_records,omitempty"`
+}
+
+type PublishResult struct {
+	RunID    string           `json:"runId,omitempty"`
+	Accepted int              `json:"accepted"`
+	Failed   int              `json:"failed"`
+	Failures []PublishFailure `json:"failures,omitempty"`
+}
+
+// PublishFailure and BulkLoadJob are the store's types so a run keeps them
+// after it is saved.
+type PublishFailure = store.RunFailure
+
+// MappingRun tracks one GetPickBasedMappingRec call from publishing through
+// the automatic Bulk API load of its mapping rows.
+type MappingRun struct {
+	ID            string           `json:"id"`
+	CorrelationID string           `json:"correlationId,omitempty"`
+	State         string           `json:"state"`
+	Published     int              `json:"published"`
+	Succeeded     int              `json:"succeeded"`
+	Failed        int              `json:"failed"`
+	Failures      []PublishFailure `json:"failures,omitempty"`
+	Jobs          []BulkLoadJob    `json:"jobs,omitempty"`
+	Error         string           `json:"error,omitempty"`
+	CreatedAt     time.Time        `json:"createdAt"`
+	UpdatedAt     time.Time        `json:"updatedAt"`
+
+	reported map[string]bool
+	rows     map[string][]mappingRow
+	timer    *time.Timer
+	// seq numbers the snapshots taken for saving and saved is the last one
+	// written, so an older snapshot never overwrites a newer one.
+	seq   uint64
+	saved uint64
+}
+
+// mappingRow is one picklist value collected by a run, grouped by category.
+type mappingRow struct {
+	Program string
+	Measure string
+	Value   string
+}
+
+type BulkLoadJob = store.RunJob
+
+type BulkInsertResult struct {
+	HasErrors bool        `json:"hasErrors,omitempty"`
+	Results   interface{} `json:"results"`
+}
+
+type BulkInsert struct {
+	AllOrNone  bool        `json:"allOrNone"`
+	Operations []Operation `json:"operations"`
+}
+
+type Operation struct {
+	Type    string   `json:"type"`
+	Records []Record `json:"records"`
+}
+
+type Record struct {
+	APIName string      `json:"apiName"`
+	Fields  interface{} `json:"fields"`
+}
+
+type BulkCreateJobResult struct {
+	ID              string  `json:"id"`
+	Operation       string  `json:"operation"`
+	Object          string  `json:"object"`
+	CreatedByID     string  `json:"createdById,omitempty"`
+	CreatedDate     string  `json:"createdDate,omitempty"`
+	SystemModstamp  string  `json:"systemModstamp,omitempty"`
+	State           string  `json:"state,omitempty"`
+	ConcurrencyMode string  `json:"concurrencyMode,omitempty"`
+	ContentType     string  `json:"contentType,omitempty"`
+	APIVersion      float64 `json:"apiVersion,omitempty"`
+	ContentURL      string  `json:"contentUrl,omitempty"`
+	LineEnding      string  `json:"lineEnding,omitempty"`
+	ColumnDelimiter string  `json:"columnDelimiter,omitempty"`
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	rbmq "github.com/AmitSuresh/sfdataapp/rabbitmq"
+)
+
+// picklistCacheTTL bounds how long a run's picklist values are reused. Runs
+// normally finish well within it; entries of finished runs age out.
+const picklistCacheTTL = 15 * time.Minute
+
+// picklistKey identifies one picklist-values call within a run. Every field of
+// the object comes back in that call, so the field is not part of the key.
+type picklistKey struct {
+	run          string
+	object       string
+	recordTypeID string
+}
+
+type picklistCall struct {
+	done    chan struct{}
+	fields  map[string]rbmq.PicklistQueryResponse
+	err     error
+	expires time.Time
+}
+
+// picklistCache makes concurrent requests for the same key share a single
+// Salesforce call. Failed calls are not cached so a retry fetches again.
+type picklistCache struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	calls map[picklistKey]*picklistCall
+}
+
+func newPicklistCache(ttl time.Duration) *picklistCache {
+	return &picklistCache{ttl: ttl, calls: make(map[picklistKey]*picklistCall)}
+}
+
+func (c *picklistCache) get(key picklistKey, fetch func() (map[string]rbmq.PicklistQueryResponse, error)) (map[string]rbmq.PicklistQueryResponse, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	for k, call := range c.calls {
+		if !call.expires.IsZero() && now.After(call.expires) {
+			delete(c.calls, k)
+		}
+	}
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.fields, call.err
+	}
+	call := &picklistCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	call.fields, call.err = fetch()
+
+	c.mu.Lock()
+	if call.err != nil {
+		delete(c.calls, key)
+	} else {
+		call.expires = time.Now().Add(c.ttl)
+	}
+	c.mu.Unlock()
+	close(call.done)
+
+	return call.fields, call.err
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	rbmq "github.com/AmitSuresh/sfdataapp/rabbitmq"
+	"go.uber.org/zap"
+)
+
+// deadLetterIdle is how long the dead letter commands wait for another
+// message before deciding the queue has been drained.
+const deadLetterIdle = 2 * time.Second
+
+func runDeadLetterCommand(b rbmq.Broker, cmd string) error {
+	if err := rbmq.DeclarePicklistQueue(b); err != nil {
+		return err
+	}
+
+	switch cmd {
+	case "list":
+		return listDeadLetters(b)
+	case "replay":
+		return replayDeadLetters(b)
+	default:
+		return fmt.Errorf("unknown dead letter command %q", cmd)
+	}
+}
+
+// drainDeadLetters hands every dead-lettered message to fn without acking it,
+// so the messages stay unavailable to other consumers until fn decides.
+func drainDeadLetters(b rbmq.Broker, fn func(d rbmq.Delivery)) error {
+	msgs, err := b.Consume(rbmq.PicklistDeadLetterQueue, false)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case d, ok := <-msgs:
+			if !ok {
+				return nil
+			}
+			fn(d)
+		case <-time.After(deadLetterIdle):
+			return nil
+		}
+	}
+}
+
+type deadLetter struct {
+	CorrelationID string                     `json:"correlationId,omitempty"`
+	MessageID     string                     `json:"messageId,omitempty"`
+	Request       *rbmq.PicklistQueueRequest `json:"request"`
+}
+
+// listDeadLetters prints dead-lettered requests as JSON lines and puts them
+// back on the dead-letter queue.
+func listDeadLetters(b rbmq.Broker) error {
+	var held []rbmq.Delivery
+	err := drainDeadLetters(b, func(d rbmq.Delivery) {
+		held = append(held, d)
+
+		o := &rbmq.PicklistQueueRequest{}
+		if err := json.Unmarshal(d.Body, o); err != nil {
+			fmt.Fprintf(os.Stdout, "%s\n", d.Body)
+			return
+		}
+		dl := &deadLetter{CorrelationID: d.CorrelationID, MessageID: d.MessageID, Request: o}
+		if err := ToJSON(dl, os.Stdout); err != nil {
+			deliveryLogger(d).Error("error writing dead letter", zap.Error(err))
+		}
+	})
+
+	for _, d := range held {
+		d.Nack(true)
+	}
+	log.Info("listed dead letters", zap.Int("count", len(held)))
+	return err
+}
+
+// replayDeadLetters moves dead-lettered requests back onto the picklist
+// request queue with their attempt count reset.
+func replayDeadLetters(b rbmq.Broker) error {
+	replayed := 0
+	var skipped []rbmq.Delivery
+	err := drainDeadLetters(b, func(d rbmq.Delivery) {
+		l := deliveryLogger(d)
+		o := &rbmq.PicklistQueueRequest{}
+		if err := json.Unmarshal(d.Body, o); err != nil {
+			l.Error("skipping malformed dead letter", zap.Error(err))
+			skipped = append(skipped, d)
+			return
+		}
+
+		o.Attempts = 0
+		o.LastError = ""
+		if err := publishJSON(b, rbmq.PicklistQueryEvent, d.CorrelationID, d.MessageID, o); err != nil {
+			l.Error("error replaying dead letter", zap.String("id", o.CustomObj.Id), zap.Error(err))
+			skipped = append(skipped, d)
+			return
+		}
+		d.Ack()
+		replayed++
+	})
+
+	for _, d := range skipped {
+		d.Nack(true)
+	}
+	log.Info("replayed dead letters", zap.Int("replayed", replayed), zap.Int("skipped", len(skipped)))
+	return err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"html"
+	"path/filepath"
+	"sort"
+
+	"github.com/AmitSuresh/sfdataapp/files"
+	rbmq "github.com/AmitSuresh/sfdataapp/rabbitmq"
+	"github.com/AmitSuresh/sfdataapp/salesforce"
+	"go.uber.org/zap"
+)
+
+// validValues returns the picklist values a record may use. Values of an
+// independent picklist are all valid. For a dependent picklist only the values
+// valid for controllingValue are kept; without a controlling value, values
+// that no controlling value allows are dropped.
+func validValues(resp *rbmq.PicklistQueryResponse, controllingValue string) ([]rbmq.PicklistValue, error) {
+	if len(resp.ControllerValues) == 0 {
+		return resp.PicklistValues, nil
+	}
+
+	index := -1
+	if controllingValue != "" {
+		i, ok := resp.ControllerValues[controllingValue]
+		if !ok {
+			return nil, fmt.Errorf("%q is not a value of the controlling field", controllingValue)
+		}
+		index = i
+	}
+
+	var values []rbmq.PicklistValue
+	for _, v := range resp.PicklistValues {
+		if validFor(v, index) {
+			values = append(values, v)
+		}
+	}
+	return values, nil
+}
+
+// validFor reports whether v is valid for the controlling value at index, or
+// for any controlling value when index is negative.
+func validFor(v rbmq.PicklistValue, index int) bool {
+	if index < 0 {
+		return len(v.ValidFor) > 0
+	}
+	for _, i := range v.ValidFor {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
+
+// writeDependencyMatrices writes a CSV matrix for every dependent picklist in
+// fields to config.DependencyDir. Rows are dependent values, columns are
+// controlling values and an X marks a valid combination.
+func writeDependencyMatrices(object, recordTypeID string, fields map[string]rbmq.PicklistQueryResponse, l *zap.Logger) {
+	if config.DependencyDir == "" {
+		return
+	}
+
+	for field, resp := range fields {
+		if len(resp.ControllerValues) == 0 {
+			continue
+		}
+		if err := salesforce.ValidateName(field); err != nil {
+			l.Error("skipping dependency matrix", zap.String("field", field), zap.Error(err))
+			continue
+		}
+
+		name := filepath.Join(config.DependencyDir, files.FileName(fmt.Sprintf("%s.%s.%s", object, field, recordTypeID), "")+".csv")
+		if err := writeDependencyMatrix(name, &resp); err != nil {
+			l.Error("error writing dependency matrix", zap.String("file", name), zap.Error(err))
+			continue
+		}
+		l.Info("wrote dependency matrix", zap.String("file", name))
+	}
+}
+
+func writeDependencyMatrix(name string, resp *rbmq.PicklistQueryResponse) error {
+	controllers := make([]string, 0, len(resp.ControllerValues))
+	for v := range resp.ControllerValues {
+		controllers = append(controllers, v)
+	}
+	sort.Slice(controllers, func(i, j int) bool {
+		return resp.ControllerValues[controllers[i]] < resp.ControllerValues[controllers[j]]
+	})
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(append([]string{"value", "label"}, controllers...))
+	for _, v := range resp.PicklistValues {
+		row := []string{html.UnescapeString(v.PickValues), html.UnescapeString(v.Label)}
+		for _, c := range controllers {
+			cell := ""
+			if validFor(v, resp.ControllerValues[c]) {
+				cell = "X"
+			}
+			row = append(row, cell)
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+
+	return files.WriteFile(name, buf.Bytes())
+}
@@ -3,14 +3,49 @@ module github.com/AmitSuresh/sfdataapp/queue
 go 1.22.4
 
 require (
+	github.com/AmitSuresh/sfdataapp/files v0.0.0-00010101000000-000000000000
 	github.com/AmitSuresh/sfdataapp/rabbitmq v0.0.0-00010101000000-000000000000
-	github.com/rabbitmq/amqp091-go v1.10.0
+	github.com/AmitSuresh/sfdataapp/salesforce v0.0.0-00010101000000-000000000000
+	github.com/AmitSuresh/sfdataapp/store v0.0.0-00010101000000-000000000000
 	go.uber.org/zap v1.27.0
 )
 
 require (
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/golang-jwt/jwt/v5 v5.2.1 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
+	github.com/jackc/pgx/v5 v5.6.0 // indirect
+	github.com/jackc/puddle/v2 v2.2.1 // indirect
 	github.com/joho/godotenv v1.5.1 // indirect
+	github.com/klauspost/compress v1.17.2 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/nats-io/nats.go v1.37.0 // indirect
+	github.com/nats-io/nkeys v0.4.7 // indirect
+	github.com/nats-io/nuid v1.0.1 // indirect
+	github.com/ncruces/go-strftime v0.1.9 // indirect
+	github.com/rabbitmq/amqp091-go v1.10.0 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
 	go.uber.org/multierr v1.10.0 // indirect
+	golang.org/x/crypto v0.18.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
+	golang.org/x/sys v0.19.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	modernc.org/gc/v3 v3.0.0-20240107210532-573471604cb6 // indirect
+	modernc.org/libc v1.52.1 // indirect
+	modernc.org/mathutil v1.6.0 // indirect
+	modernc.org/memory v1.8.0 // indirect
+	modernc.org/sqlite v1.30.1 // indirect
+	modernc.org/strutil v1.2.0 // indirect
+	modernc.org/token v1.1.0 // indirect
 )
 
 replace github.com/AmitSuresh/sfdataapp/rabbitmq => ../rabbitmq
+
+replace github.com/AmitSuresh/sfdataapp/salesforce => ../salesforce
+
+replace github.com/AmitSuresh/sfdataapp/store => ../store
+
+replace github.com/AmitSuresh/sfdataapp/files => ../files
@@ -1,247 +1,459 @@
-package main
-
-import (
-	"encoding/json"
-	"fmt"
-	"html"
-	"io"
-	"net/http"
-	"os"
-	"os/signal"
-	"path/filepath"
-	"sync"
-	"syscall"
-
-	rbmq "github.com/AmitSuresh/sfdataapp/rabbitmq"
-	"github.com/rabbitmq/amqp091-go"
-	"go.uber.org/zap"
-)
-
-var (
-	config   *rbmq.Config
-	log      *zap.Logger
-	fileLock sync.Mutex
-)
-
-func init() {
-
-	log, _ = zap.NewProduction()
-	c, err := rbmq.LoadConfig(log)
-	if err != nil {
-		log.Fatal("failed to load configuration", zap.Error(err))
-	}
-	config = c
-}
-
-func main() {
-
-	ch, close, err := rbmq.ConnectAmqp(config, log)
-	if err != nil {
-		log.Fatal("failed to connect to RabbitMQ", zap.Error(err))
-	}
-	defer func() {
-		ch.Close()
-		close()
-	}()
-
-	go listen(ch)
-
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-
-	<-sigChan
-
-	log.Info("Shutdown signal received, shutting down...")
-
-	log.Sync()
-}
-
-func listen(ch *amqp091.Channel) {
-	q, err := ch.QueueDeclare(rbmq.PicklistQueryEvent, true, false, false, false, nil)
-	if err != nil {
-		log.Error("error queue", zap.Error(err))
-	}
-
-	msgs, err := ch.Consume(q.Name, "", true, false, false, false, nil)
-	if err != nil {
-		log.Error("error consuming messages", zap.Error(err))
-	}
-
-	forever := make(chan struct{})
-	go func() {
-		for d := range msgs {
-
-			o := &rbmq.PicklistQueueRequest{}
-			if err := json.Unmarshal(d.Body, o); err != nil {
-				d.Nack(false, false)
-				log.Error("error unmarshalling", zap.Error(err))
-				continue
-			}
-
-			req, err := http.NewRequest(o.Method, o.Url, o.Body)
-			if err != nil {
-				log.Error("error creating request", zap.Error(err))
-				continue
-			}
-			req.Header.Add("Authorization", "Bearer "+o.AccessToken)
-
-			client := &http.Client{}
-			resp, err := client.Do(req)
-			if err != nil {
-				log.Error("error sending request", zap.Error(err))
-				continue
-			}
-
-			pickResponse := new(rbmq.PicklistQueryResponse)
-			err = FromJSON(pickResponse, resp.Body)
-			if err != nil {
-				log.Error("error unmarshalling response", zap.Error(err))
-			}
-			log.Info("", zap.Any("amit ", pickResponse))
-
-			for _, val := range pickResponse.PicklistValues {
-				switch o.RecordType {
-				case "Recommendation":
-					updateRecPicksJSON(&rbmq.RecommendationRecord{
-						PicklistVal: html.UnescapeString(val.PickValues),
-						MeasureName: o.CustomObj.MeasureNameNew,
-						ProgName:    o.CustomObj.ProgRec.Name,
-					}, o.CustomObj.ProgRec.Name, log)
-				case "Direct Install":
-					updateEqPicksJSON(&rbmq.EquipmentRecord{
-						PicklistVal: html.UnescapeString(val.PickValues),
-						MeasureName: o.CustomObj.MeasureNameNew,
-						ProgName:    o.CustomObj.ProgRec.Name,
-					}, o.CustomObj.ProgRec.Name, log)
-				}
-			}
-		}
-	}()
-
-	<-forever
-}
-
-func createJSONFile(dir, fileName string) (*os.File, error) {
-	fName := fmt.Sprintf("%s.json", fileName)
-	newFilename := filepath.Join(dir, fName)
-	file, err := os.OpenFile(newFilename, os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return nil, err
-	}
-
-	return file, nil
-}
-
-func updateRecPicksJSON(targetRecords *rbmq.RecommendationRecord, programName string, log *zap.Logger) error {
-
-	picklistMappedValues := new(rbmq.PicklistMappedResp)
-
-	if err := os.MkdirAll(config.JsonDirPath, os.ModePerm); err != nil {
-		log.Error("error creating directory", zap.Error(err))
-		return err
-	}
-
-	fileLock.Lock()
-	defer fileLock.Unlock()
-	file, err := createJSONFile(config.JsonDirPath, programName)
-	if err != nil {
-		log.Error("error creating file in rec method", zap.Error(err))
-		return err
-	}
-	defer file.Close()
-
-	fName := fmt.Sprintf("%s/%s.json", config.JsonDirPath, programName)
-
-	dataa, err := os.ReadFile(fName)
-	if err != nil {
-		log.Error("error reading le", zap.Error(err))
-		return err
-	}
-	if len(dataa) > 0 {
-		if err := json.Unmarshal(dataa, picklistMappedValues); err != nil {
-			log.Error("error unmarshalling existing JSON file", zap.Error(err))
-			return err
-		}
-	}
-	picklistMappedValues.Recs = append(picklistMappedValues.Recs, rbmq.RecommendationRecord{
-		PicklistVal: targetRecords.PicklistVal,
-		MeasureName: targetRecords.MeasureName,
-		ProgName:    targetRecords.ProgName,
-	})
-
-	updatedData, err := json.Marshal(picklistMappedValues)
-	if err != nil {
-		log.Error("error marshalling updated picklist values", zap.Error(err))
-		return err
-	}
-
-	if _, err := file.Write(updatedData); err != nil {
-		log.Error("error writing to picks.json", zap.Error(err))
-		return err
-	}
-
-	log.Info("Successfully updated json file from Rec")
-	return nil
-}
-
-func updateEqPicksJSON(targetRecords *rbmq.EquipmentRecord, programName string, log *zap.Logger) error {
-
-	picklistMappedValues := new(rbmq.PicklistMappedResp)
-
-	if err := os.MkdirAll(config.JsonDirPath, os.ModePerm); err != nil {
-		log.Error("error creating directory", zap.Error(err))
-		return err
-	}
-
-	fileLock.Lock()
-	defer fileLock.Unlock()
-	file, err := createJSONFile(config.JsonDirPath, programName)
-	if err != nil {
-		log.Error("error creating file in eq method", zap.Error(err))
-		return err
-	}
-	defer file.Close()
-
-	fName := fmt.Sprintf("%s/%s.json", config.JsonDirPath, programName)
-
-	dataa, err := os.ReadFile(fName)
-	if err != nil {
-		log.Error("error reading le", zap.Error(err))
-		return err
-	}
-	if len(dataa) > 0 {
-		if err := json.Unmarshal(dataa, picklistMappedValues); err != nil {
-			log.Error("error unmarshalling existing JSON file", zap.Error(err))
-			return err
-		}
-	}
-	picklistMappedValues.Eqs = append(picklistMappedValues.Eqs, rbmq.EquipmentRecord{
-		PicklistVal: targetRecords.PicklistVal,
-		MeasureName: targetRecords.MeasureName,
-		ProgName:    targetRecords.ProgName,
-	})
-
-	updatedData, err := json.Marshal(picklistMappedValues)
-	if err != nil {
-		log.Error("error marshalling updated picklist values", zap.Error(err))
-		return err
-	}
-
-	if _, err := file.Write(updatedData); err != nil {
-		log.Error("error writing to picks.json", zap.Error(err))
-		return err
-	}
-
-	log.Info("Successfully updated json file from Eq")
-	return nil
-}
-
-func ToJSON(i interface{}, w io.Writer) error {
-	e := json.NewEncoder(w)
-	return e.Encode(i)
-}
-
-func FromJSON(i interface{}, r io.Reader) error {
-	e := json.NewDecoder(r)
-	return e.Decode(i)
-}
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	rbmq "github.com/AmitSuresh/sfdataapp/rabbitmq"
+	"github.com/AmitSuresh/sfdataapp/salesforce"
+	"github.com/AmitSuresh/sfdataapp/store"
+	"go.uber.org/zap"
+)
+
+const publishTimeout = 10 * time.Second
+
+// defaultAllowedPaths limits the worker to reading picklist values unless
+// sfAllowedPaths says otherwise.
+var defaultAllowedPaths = []string{
+	"/services/data/v*/ui-api/object-info/*/picklist-values/*",
+}
+
+var (
+	config       *rbmq.Config
+	log          *zap.Logger
+	httpClient   *http.Client
+	sfClient     *salesforce.Client
+	mappingStore store.Store
+	picklists    = newPicklistCache(picklistCacheTTL)
+)
+
+// setup loads the configuration and opens the Salesforce client and mapping
+// store the workers share.
+func setup() {
+	log, _ = zap.NewProduction()
+	c, err := rbmq.LoadConfig(log)
+	if err != nil {
+		log.Fatal("failed to load configuration", zap.Error(err))
+	}
+	config = c
+
+	httpClient = &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: config.Workers,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+
+	sfCfg := salesforce.ConfigFromEnv()
+	if len(sfCfg.AllowedPaths) == 0 {
+		sfCfg.AllowedPaths = defaultAllowedPaths
+	}
+	sfClient, err = salesforce.NewClient(sfCfg, httpClient, log)
+	if err != nil {
+		log.Fatal("failed to create salesforce client", zap.Error(err))
+	}
+
+	mappingStore, err = store.New(store.ConfigFromEnv(config.JsonDirPath), log)
+	if err != nil {
+		log.Fatal("failed to open mapping store", zap.Error(err))
+	}
+}
+
+func main() {
+	deadLetters := flag.String("deadletters", "", `inspect dead-lettered picklist requests: "list" or "replay"`)
+	flag.Parse()
+	setup()
+
+	b, err := rbmq.NewBroker(config, log)
+	if err != nil {
+		log.Fatal("failed to connect to message broker", zap.Error(err))
+	}
+	// Deferred calls run last first: the broker is closed before the store
+	// the workers write to.
+	defer mappingStore.Close()
+	defer b.Close()
+
+	if *deadLetters != "" {
+		if err := runDeadLetterCommand(b, *deadLetters); err != nil {
+			log.Error("dead letter command failed", zap.String("command", *deadLetters), zap.Error(err))
+		}
+		return
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		listen(ctx, b)
+	}()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	<-sigChan
+
+	log.Info("Shutdown signal received, shutting down...")
+	stop()
+	<-done
+
+	log.Sync()
+}
+
+// listen consumes picklist requests until ctx is cancelled or the broker
+// stops delivering, then waits for the workers to finish the requests they
+// were handed.
+func listen(ctx context.Context, b rbmq.Broker) {
+	if err := rbmq.DeclarePicklistQueue(b); err != nil {
+		log.Error("error declaring queue", zap.Error(err))
+		return
+	}
+	if err := rbmq.DeclarePicklistRetryQueue(b, config.RetryDelay); err != nil {
+		log.Error("error declaring retry queue", zap.Error(err))
+		return
+	}
+	if err := rbmq.DeclarePicklistResultQueue(b); err != nil {
+		log.Error("error declaring result queue", zap.Error(err))
+		return
+	}
+	if err := b.Qos(config.Prefetch); err != nil {
+		log.Error("error setting prefetch", zap.Error(err))
+		return
+	}
+
+	msgs, err := b.Consume(rbmq.PicklistQueryEvent, false)
+	if err != nil {
+		log.Error("error consuming messages", zap.Error(err))
+		return
+	}
+
+	workers := config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	shards := make([]chan job, workers)
+	var wg sync.WaitGroup
+	for i := range shards {
+		shards[i] = make(chan job, config.Prefetch)
+		wg.Add(1)
+		go func(jobs <-chan job) {
+			defer wg.Done()
+			for j := range jobs {
+				handleRequest(b, j.d, j.o, j.l)
+			}
+		}(shards[i])
+	}
+
+	dispatch(ctx, msgs, shards)
+
+	for _, s := range shards {
+		close(s)
+	}
+	wg.Wait()
+}
+
+// dispatch hands each request to its program's worker. A request that cannot
+// be handed over before ctx is cancelled is requeued.
+func dispatch(ctx context.Context, msgs <-chan rbmq.Delivery, shards []chan job) {
+	for {
+		var d rbmq.Delivery
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return
+		case d, ok = <-msgs:
+			if !ok {
+				return
+			}
+		}
+
+		l := deliveryLogger(d)
+		o := &rbmq.PicklistQueueRequest{}
+		if err := json.Unmarshal(d.Body, o); err != nil {
+			l.Error("error unmarshalling", zap.Error(err))
+			d.Nack(false)
+			continue
+		}
+		l = l.With(zap.String("runId", o.RunID))
+		select {
+		case shards[shardFor(o.CustomObj.ProgRec.Name, len(shards))] <- job{d: d, o: o, l: l}:
+		case <-ctx.Done():
+			d.Nack(true)
+			return
+		}
+	}
+}
+
+type job struct {
+	d rbmq.Delivery
+	o *rbmq.PicklistQueueRequest
+	l *zap.Logger
+}
+
+// deliveryLogger tags log lines with the IDs carried in the message headers.
+func deliveryLogger(d rbmq.Delivery) *zap.Logger {
+	return log.With(zap.String("correlationId", d.CorrelationID), zap.String("messageId", d.MessageID))
+}
+
+// shardFor picks the worker for a program. Requests for one program always go
+// to the same worker so writes to its JSON file happen in order.
+func shardFor(program string, workers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(program))
+	return int(h.Sum32() % uint32(workers))
+}
+
+// handleRequest acks a request once its picklist values are written and its
+// result is reported. Failed requests go to the retry queue until
+// config.MaxRetries is reached and then to the dead-letter queue. A request
+// whose result cannot be reported is requeued so the run does not miss it.
+func handleRequest(b rbmq.Broker, d rbmq.Delivery, o *rbmq.PicklistQueueRequest, l *zap.Logger) {
+	m, err := processRequest(o, l)
+	if err == nil {
+		if err := reportResult(b, d, o, m, nil); err != nil {
+			l.Error("error reporting result", zap.String("id", o.CustomObj.Id), zap.Error(err))
+			d.Nack(true)
+			return
+		}
+		if err := d.Ack(); err != nil {
+			l.Error("error acknowledging message", zap.Error(err))
+		}
+		return
+	}
+
+	o.Attempts++
+	o.LastError = err.Error()
+
+	target := rbmq.PicklistRetryQueue
+	var perm *permanentError
+	if errors.As(err, &perm) || o.Attempts > config.MaxRetries {
+		target = rbmq.PicklistDeadLetterQueue
+	}
+	l.Error("error processing picklist request",
+		zap.String("id", o.CustomObj.Id),
+		zap.Int("attempts", o.Attempts),
+		zap.String("requeuedTo", target),
+		zap.Error(err))
+
+	// The failure is reported before the request is dead-lettered: if the
+	// report fails the request is handled again, and a report sent twice is
+	// counted once by the run.
+	if target == rbmq.PicklistDeadLetterQueue {
+		if err := reportResult(b, d, o, nil, err); err != nil {
+			l.Error("error reporting result", zap.String("id", o.CustomObj.Id), zap.Error(err))
+			d.Nack(true)
+			return
+		}
+	}
+	if err := publishJSON(b, target, d.CorrelationID, d.MessageID, o); err != nil {
+		l.Error("error republishing message", zap.String("queue", target), zap.Error(err))
+		d.Nack(true)
+		return
+	}
+	if err := d.Ack(); err != nil {
+		l.Error("error acknowledging message", zap.Error(err))
+	}
+}
+
+// reportResult tells the run that published o how it ended. Requests without
+// a run ID are not reported. The result keeps the request's correlation ID.
+func reportResult(b rbmq.Broker, d rbmq.Delivery, o *rbmq.PicklistQueueRequest, m *rbmq.PicklistMappedResp, procErr error) error {
+	if o.RunID == "" {
+		return nil
+	}
+
+	res := &rbmq.PicklistQueryResult{RunID: o.RunID, RequestID: d.MessageID, RecordID: o.CustomObj.Id, RecordType: o.RecordType, Succeeded: procErr == nil}
+	if procErr != nil {
+		res.Error = procErr.Error()
+	}
+	if m != nil {
+		res.Mappings = *m
+	}
+
+	return publishJSON(b, rbmq.PicklistResultQueue, d.CorrelationID, "", res)
+}
+
+// permanentError marks failures that retrying cannot fix.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+
+func (e *permanentError) Unwrap() error { return e.err }
+
+// processRequest reads the picklist values for o and saves the resulting
+// mapping rows, which it also returns.
+func processRequest(o *rbmq.PicklistQueueRequest, l *zap.Logger) (*rbmq.PicklistMappedResp, error) {
+	for _, name := range []string{o.SObject, o.FieldName} {
+		if err := salesforce.ValidateName(name); err != nil {
+			return nil, &permanentError{err}
+		}
+	}
+	if err := salesforce.ValidateID(o.CustomObj.RecTypeId); err != nil {
+		return nil, &permanentError{err}
+	}
+
+	fields, err := picklists.get(picklistKey{run: o.RunID, object: o.SObject, recordTypeID: o.CustomObj.RecTypeId}, func() (map[string]rbmq.PicklistQueryResponse, error) {
+		fields, err := fetchPicklists(o.SObject, o.CustomObj.RecTypeId, l)
+		if err == nil {
+			writeDependencyMatrices(o.SObject, o.CustomObj.RecTypeId, fields, l)
+		}
+		return fields, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	pickResponse, ok := fields[o.FieldName]
+	if !ok {
+		return nil, &permanentError{fmt.Errorf("%s has no picklist %s for record type %s", o.SObject, o.FieldName, o.CustomObj.RecTypeId)}
+	}
+	values, err := validValues(&pickResponse, o.ControllingValue)
+	if err != nil {
+		return nil, &permanentError{fmt.Errorf("%s.%s: %w", o.SObject, o.FieldName, err)}
+	}
+
+	programName := o.CustomObj.ProgRec.Name
+	m := new(rbmq.PicklistMappedResp)
+	switch o.RecordType {
+	case store.RecordTypeRecommendation:
+		m.Recs = picklistRecords[rbmq.RecommendationRecord](o, values)
+	case store.RecordTypeDirectInstall:
+		m.Eqs = picklistRecords[rbmq.EquipmentRecord](o, values)
+	case "":
+		return nil, &permanentError{errors.New("record type is missing")}
+	default:
+		// Categories from custom classification rules share one row type.
+		for _, val := range values {
+			m.Other = append(m.Other, rbmq.MappingRecord{
+				RecordType:  o.RecordType,
+				ProgName:    programName,
+				MeasureName: o.CustomObj.MeasureNameNew,
+				PicklistVal: html.UnescapeString(val.PickValues),
+			})
+		}
+	}
+
+	if err := saveMappings(programName, m, l); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// fetchPicklists reads every picklist of object for one record type in a
+// single ui-api call.
+func fetchPicklists(object, recordTypeID string, l *zap.Logger) (map[string]rbmq.PicklistQueryResponse, error) {
+	pickURL := sfClient.DataURL(fmt.Sprintf("ui-api/object-info/%s/picklist-values/%s", object, recordTypeID))
+	req, err := http.NewRequest(http.MethodGet, pickURL, nil)
+	if err != nil {
+		return nil, &permanentError{err}
+	}
+
+	resp, err := sfClient.Do(req)
+	if err != nil {
+		if errors.Is(err, salesforce.ErrEndpointNotAllowed) {
+			return nil, &permanentError{err}
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("request failed with status: %s", resp.Status)
+		if resp.StatusCode < http.StatusInternalServerError && resp.StatusCode != http.StatusTooManyRequests {
+			return nil, &permanentError{err}
+		}
+		return nil, err
+	}
+
+	pickResponse := new(rbmq.PicklistRecordTypeResponse)
+	if err := FromJSON(pickResponse, resp.Body); err != nil {
+		return nil, err
+	}
+	l.Info("fetched picklist values", zap.String("object", object), zap.String("recordTypeId", recordTypeID), zap.Int("fields", len(pickResponse.PicklistFieldValues)))
+	return pickResponse.PicklistFieldValues, nil
+}
+
+// publishJSON publishes v with the given correlation and message IDs. An
+// empty messageID gets a new one.
+func publishJSON(b rbmq.Broker, queue, correlationID, messageID string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if messageID == "" {
+		if messageID, err = rbmq.NewMessageID(); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	return b.Publish(ctx, queue, rbmq.Message{
+		ContentType:   "application/json",
+		CorrelationID: correlationID,
+		MessageID:     messageID,
+		Body:          body,
+	})
+}
+
+// picklistRecord is satisfied by both mapping row types. They share their
+// fields and differ only in the JSON name of the picklist column.
+type picklistRecord interface {
+	rbmq.RecommendationRecord | rbmq.EquipmentRecord
+}
+
+type picklistEntry struct {
+	ProgName    string
+	MeasureName string
+	PicklistVal string
+}
+
+func picklistRecords[T picklistRecord](o *rbmq.PicklistQueueRequest, values []rbmq.PicklistValue) []T {
+	recs := make([]T, 0, len(values))
+	for _, val := range values {
+		recs = append(recs, T(picklistEntry{
+			ProgName:    o.CustomObj.ProgRec.Name,
+			MeasureName: o.CustomObj.MeasureNameNew,
+			PicklistVal: html.UnescapeString(val.PickValues),
+		}))
+	}
+	return recs
+}
+
+// saveMappings merges m into the mapping store for programName. The store
+// drops rows that are already present.
+func saveMappings(programName string, m *rbmq.PicklistMappedResp, l *zap.Logger) error {
+	if err := mappingStore.Save(context.Background(), programName, m); err != nil {
+		l.Error("error saving picklist mappings", zap.String("program", programName), zap.Error(err))
+		return err
+	}
+
+	l.Info("saved picklist mappings", zap.String("program", programName), zap.Int("rows", len(m.Recs)+len(m.Eqs)+len(m.Other)))
+	return nil
+}
+
+func ToJSON(i interface{}, w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(i)
+}
+
+func FromJSON(i interface{}, r io.Reader) error {
+	e := json.NewDecoder(r)
+	return e.Decode(i)
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	rbmq "github.com/AmitSuresh/sfdataapp/rabbitmq"
+	"github.com/AmitSuresh/sfdataapp/salesforce"
+	"github.com/AmitSuresh/sfdataapp/salesforce/sftest"
+	"github.com/AmitSuresh/sfdataapp/store"
+	"go.uber.org/zap"
+)
+
+const testRecordTypeID = "012000000000001AAA"
+
+// testWorker points the worker's globals at a fake Salesforce served by
+// picklistHandler and a temporary directory, and starts it on a memory
+// broker with the picklist queues declared.
+func testWorker(t *testing.T, picklistHandler http.HandlerFunc) (*rbmq.MemoryBroker, string) {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/services/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token"}`))
+	})
+	mux.HandleFunc("/services/data/v58.0/ui-api/object-info/", picklistHandler)
+	sf := httptest.NewServer(mux)
+	t.Cleanup(sf.Close)
+
+	dir := t.TempDir()
+	log = zap.NewNop()
+	config = &rbmq.Config{
+		JsonDirPath:   filepath.Join(dir, "mappings"),
+		DependencyDir: filepath.Join(dir, "dependencies"),
+		MaxRetries:    1,
+		RetryDelay:    10 * time.Millisecond,
+		Workers:       2,
+		Prefetch:      4,
+	}
+
+	var err error
+	sfClient, err = salesforce.NewClient(&salesforce.Config{
+		ClientID:     "client",
+		Username:     "user",
+		InstanceURL:  sf.URL,
+		SfEnv:        "test",
+		KeyPath:      sftest.KeyFile(t, dir),
+		APIVersion:   "58.0",
+		AllowedPaths: defaultAllowedPaths,
+	}, sf.Client(), log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mappingStore = store.NewFileStore(config.JsonDirPath, log)
+	picklists = newPicklistCache(picklistCacheTTL)
+
+	b := newTestBroker(t)
+	stop := startListening(b)
+	// The next test replaces the globals the workers read.
+	t.Cleanup(func() {
+		stop()
+		b.Close()
+	})
+	return b, dir
+}
+
+// newTestBroker returns a memory broker with the picklist queues declared.
+// listen declares them too, but only once it runs.
+func newTestBroker(t *testing.T) *rbmq.MemoryBroker {
+	t.Helper()
+	b := rbmq.NewMemoryBroker()
+	for _, declare := range []func() error{
+		func() error { return rbmq.DeclarePicklistQueue(b) },
+		func() error { return rbmq.DeclarePicklistRetryQueue(b, config.RetryDelay) },
+		func() error { return rbmq.DeclarePicklistResultQueue(b) },
+	} {
+		if err := declare(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b
+}
+
+// startListening runs listen on b and returns a func that stops consuming
+// and waits for the workers, as main does before closing the broker.
+func startListening(b rbmq.Broker) func() {
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		listen(ctx, b)
+	}()
+	return func() {
+		stop()
+		<-done
+	}
+}
+
+// picklistValues serves an independent Recommendation__c picklist and an
+// Equipment_Type__c picklist that depends on Fuel__c.
+func picklistValues(w http.ResponseWriter, r *http.Request) {
+	resp := rbmq.PicklistRecordTypeResponse{PicklistFieldValues: map[string]rbmq.PicklistQueryResponse{
+		"Recommendation__c": {PicklistValues: []rbmq.PicklistValue{{PickValues: "Seal &amp; Insulate", Label: "Seal"}}},
+		"Equipment_Type__c": {
+			ControllerValues: map[string]int{"Gas": 0, "Electric": 1},
+			PicklistValues: []rbmq.PicklistValue{
+				{PickValues: "Furnace", Label: "Furnace", ValidFor: []int{0}},
+				{PickValues: "Heat Pump", Label: "Heat Pump", ValidFor: []int{1}},
+			},
+		},
+	}}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func publishRequest(t *testing.T, b rbmq.Broker, messageID string, o *rbmq.PicklistQueueRequest) {
+	t.Helper()
+	if err := publishJSON(b, rbmq.PicklistQueryEvent, "trace-1", messageID, o); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func request(id string) *rbmq.PicklistQueueRequest {
+	return &rbmq.PicklistQueueRequest{
+		RunID:     "run-1",
+		SObject:   "Measure__c",
+		FieldName: "Recommendation__c",
+		CustomObj: rbmq.CustomRecords{
+			Id:             id,
+			MeasureNameNew: "Measure " + id,
+			RecTypeId:      testRecordTypeID,
+			ProgRec:        rbmq.ProgramRecord{Name: "Program A"},
+		},
+		RecordType: "Recommendation",
+	}
+}
+
+// TestWorkerPool checks that requests for two programs spread over the
+// workers and that none of the writes to a program's file are lost.
+func TestWorkerPool(t *testing.T) {
+	b, dir := testWorker(t, picklistValues)
+
+	for _, program := range []string{"Program A", "Program B"} {
+		for _, id := range []string{"1", "2", "3"} {
+			o := request(program + " " + id)
+			o.CustomObj.ProgRec.Name = program
+			publishRequest(t, b, "", o)
+		}
+	}
+
+	for _, program := range []string{"Program A", "Program B"} {
+		m := waitForMappings(t, filepath.Join(dir, "mappings", program+".json"), 3)
+		for _, rec := range m.Recs {
+			if rec.ProgName != program || rec.PicklistVal != "Seal & Insulate" {
+				t.Errorf("%s has %+v", program, rec)
+			}
+		}
+	}
+}
+
+// TestListenFinishesRequestsOnShutdown checks that shutting down waits for a
+// request a worker is handling and that its result is still reported.
+func TestListenFinishesRequestsOnShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	testWorker(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		picklistValues(w, r)
+	})
+	// testWorker's broker stays idle; this one is shut down mid-request.
+	b := newTestBroker(t)
+	t.Cleanup(func() { b.Close() })
+	shutdown := startListening(b)
+	results, err := b.Consume(rbmq.PicklistResultQueue, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publishRequest(t, b, "m1", request("a1"))
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the request")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		shutdown()
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("shutdown returned while a request was being handled")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	_, res := nextResult(t, results)
+	if res.RecordID != "a1" || !res.Succeeded {
+		t.Errorf("result = %+v, want a1 succeeding", res)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for shutdown")
+	}
+}
+
+// nextResult waits for the next result the worker reports.
+func nextResult(t *testing.T, results <-chan rbmq.Delivery) (rbmq.Delivery, *rbmq.PicklistQueryResult) {
+	t.Helper()
+	select {
+	case d := <-results:
+		d.Ack()
+		res := new(rbmq.PicklistQueryResult)
+		if err := json.Unmarshal(d.Body, res); err != nil {
+			t.Fatal(err)
+		}
+		return d, res
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a result")
+	}
+	return rbmq.Delivery{}, nil
+}
+
+func TestWorkerReportsResults(t *testing.T) {
+	b, _ := testWorker(t, picklistValues)
+	results, err := b.Consume(rbmq.PicklistResultQueue, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publishRequest(t, b, "m1", request("a1"))
+
+	d, res := nextResult(t, results)
+	want := rbmq.RecommendationRecords{{ProgName: "Program A", MeasureName: "Measure a1", PicklistVal: "Seal & Insulate"}}
+	if d.CorrelationID != "trace-1" || res.RunID != "run-1" || res.RequestID != "m1" || res.RecordID != "a1" || !res.Succeeded || !reflect.DeepEqual(res.Mappings.Recs, want) {
+		t.Errorf("result = %+v with correlation id %q, want m1 of run-1 succeeding with %+v and correlation id trace-1", res, d.CorrelationID, want)
+	}
+
+	// Requests without a run ID are not reported.
+	o := request("a2")
+	o.RunID = ""
+	if err := publishJSON(b, rbmq.PicklistQueryEvent, "trace-1", "m2", o); err != nil {
+		t.Fatal(err)
+	}
+	waitForMappings(t, filepath.Join(config.JsonDirPath, "Program A.json"), 2)
+	select {
+	case d := <-results:
+		t.Errorf("unexpected result %s", d.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWorkerMapsDependentPicklists(t *testing.T) {
+	b, dir := testWorker(t, picklistValues)
+	results, err := b.Consume(rbmq.PicklistResultQueue, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := request("a1")
+	o.RecordType = store.RecordTypeDirectInstall
+	o.FieldName = "Equipment_Type__c"
+	o.ControllingValue = "Electric"
+	publishRequest(t, b, "m1", o)
+
+	_, res := nextResult(t, results)
+	want := rbmq.EquipmentRecords{{ProgName: "Program A", MeasureName: "Measure a1", PicklistVal: "Heat Pump"}}
+	if !res.Succeeded || !reflect.DeepEqual(res.Mappings.Eqs, want) {
+		t.Errorf("result = %+v, want %+v", res, want)
+	}
+
+	o = request("a2")
+	o.RecordType = store.RecordTypeDirectInstall
+	o.FieldName = "Equipment_Type__c"
+	o.ControllingValue = "Solar"
+	publishRequest(t, b, "m2", o)
+	if _, res := nextResult(t, results); res.Succeeded {
+		t.Errorf("request with an unknown controlling value succeeded: %+v", res)
+	}
+
+	matrices, _ := filepath.Glob(filepath.Join(dir, "dependencies", "*.csv"))
+	if len(matrices) != 1 {
+		t.Fatalf("dependency matrices = %q, want one", matrices)
+	}
+	data, err := os.ReadFile(matrices[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantMatrix := "value,label,Gas,Electric\nFurnace,Furnace,X,\nHeat Pump,Heat Pump,,X\n"
+	if string(data) != wantMatrix {
+		t.Errorf("dependency matrix = %q, want %q", data, wantMatrix)
+	}
+}
+
+// waitForMappings polls a program's mapping file until it holds n rows.
+func waitForMappings(t *testing.T, name string, n int) *rbmq.PicklistMappedResp {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m := new(rbmq.PicklistMappedResp)
+		data, err := os.ReadFile(name)
+		if err == nil && json.Unmarshal(data, m) == nil && len(m.Recs)+len(m.Eqs) >= n {
+			return m
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s holds %q, want %d rows", name, data, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWorkerRetriesThenDeadLetters(t *testing.T) {
+	var calls atomic.Int32
+	b, _ := testWorker(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+	results, err := b.Consume(rbmq.PicklistResultQueue, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publishRequest(t, b, "m1", request("a1"))
+
+	d, res := nextResult(t, results)
+	if res.Succeeded || res.RecordID != "a1" || !strings.Contains(res.Error, "503") {
+		t.Errorf("result = %+v, want a failure of a1 with status 503", res)
+	}
+	if d.CorrelationID != "trace-1" {
+		t.Errorf("result correlation id = %q, want trace-1", d.CorrelationID)
+	}
+
+	o := deadLetters(t, b, 1)[0]
+	if o.Attempts != 2 || o.CustomObj.Id != "a1" || !strings.Contains(o.LastError, "503") {
+		t.Errorf("dead letter = %+v, want a1 after 2 attempts failing with status 503", o)
+	}
+	// The first attempt and one retry.
+	if n := calls.Load(); n != 2 {
+		t.Errorf("salesforce was called %d times, want 2", n)
+	}
+}
+
+func TestWorkerDeadLettersPermanentErrors(t *testing.T) {
+	var calls atomic.Int32
+	b, _ := testWorker(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		picklistValues(w, r)
+	})
+	results, err := b.Consume(rbmq.PicklistResultQueue, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missing := request("a1")
+	missing.FieldName = "Missing__c"
+	publishRequest(t, b, "m1", missing)
+	_, res := nextResult(t, results)
+	if res.Succeeded || !strings.Contains(res.Error, "no picklist Missing__c") {
+		t.Errorf("result = %+v, want a missing picklist failure", res)
+	}
+
+	bad := request("a2")
+	bad.FieldName = "Type__c/../../sobjects"
+	publishRequest(t, b, "m2", bad)
+
+	for _, o := range deadLetters(t, b, 2) {
+		if o.Attempts != 1 {
+			t.Errorf("dead letter %s attempts = %d, want 1", o.CustomObj.Id, o.Attempts)
+		}
+	}
+	// The request with an invalid field name never reaches Salesforce.
+	if n := calls.Load(); n != 1 {
+		t.Errorf("salesforce was called %d times, want 1", n)
+	}
+}
+
+// TestWorkerCachesPicklists checks that the requests of a run share one
+// picklist call per record type while another run fetches its own.
+func TestWorkerCachesPicklists(t *testing.T) {
+	var calls atomic.Int32
+	b, _ := testWorker(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		picklistValues(w, r)
+	})
+	results, err := b.Consume(rbmq.PicklistResultQueue, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"a1", "a2", "a3"} {
+		publishRequest(t, b, "", request(id))
+	}
+	o := request("a4")
+	o.RunID = "run-2"
+	publishRequest(t, b, "", o)
+	for i := 0; i < 4; i++ {
+		if _, res := nextResult(t, results); !res.Succeeded {
+			t.Fatalf("request %s failed: %s", res.RecordID, res.Error)
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("salesforce was called %d times, want 2", n)
+	}
+}
+
+// deadLetters waits for n requests on the dead-letter queue.
+func deadLetters(t *testing.T, b *rbmq.MemoryBroker, n int) []*rbmq.PicklistQueueRequest {
+	t.Helper()
+	msgs, err := b.Consume(rbmq.PicklistDeadLetterQueue, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dead []*rbmq.PicklistQueueRequest
+	for len(dead) < n {
+		select {
+		case d := <-msgs:
+			o := new(rbmq.PicklistQueueRequest)
+			if err := json.Unmarshal(d.Body, o); err != nil {
+				t.Fatal(err)
+			}
+			dead = append(dead, o)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for dead letter %d of %d", len(dead)+1, n)
+		}
+	}
+	return dead
+}
+
+func TestValidValues(t *testing.T) {
+	dependent := &rbmq.PicklistQueryResponse{
+		ControllerValues: map[string]int{"Gas": 0, "Electric": 1},
+		PicklistValues: []rbmq.PicklistValue{
+			{PickValues: "Furnace", ValidFor: []int{0}},
+			{PickValues: "Heat Pump", ValidFor: []int{1}},
+			{PickValues: "Boiler", ValidFor: []int{0, 1}},
+			{PickValues: "Retired"},
+		},
+	}
+	independent := &rbmq.PicklistQueryResponse{PicklistValues: []rbmq.PicklistValue{{PickValues: "A"}, {PickValues: "B"}}}
+
+	tests := []struct {
+		name       string
+		resp       *rbmq.PicklistQueryResponse
+		controller string
+		want       []string
+		wantErr    bool
+	}{
+		{"independent", independent, "", []string{"A", "B"}, false},
+		{"independent ignores the controller", independent, "Gas", []string{"A", "B"}, false},
+		{"controlled", dependent, "Gas", []string{"Furnace", "Boiler"}, false},
+		{"no controlling value", dependent, "", []string{"Furnace", "Heat Pump", "Boiler"}, false},
+		{"unknown controlling value", dependent, "Solar", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := validValues(tt.resp, tt.controller)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validValues error = %v, want error %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, v := range values {
+				got = append(got, v.PickValues)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("validValues = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
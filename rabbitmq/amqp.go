@@ -0,0 +1,481 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.uber.org/zap"
+)
+
+const (
+	amqpReconnectMin = 500 * time.Millisecond
+	amqpReconnectMax = 30 * time.Second
+)
+
+var (
+	ErrPublishNacked = errors.New("broker did not confirm the message")
+	ErrUnroutable    = errors.New("message could not be routed to a queue")
+)
+
+// AmqpBroker owns a RabbitMQ connection and keeps it alive. When the
+// connection or channel closes it redials with backoff, declares the known
+// queues again and resumes every consumer on the new channel. Publishers
+// block until a channel is available or their context is done.
+//
+// Channels run in confirm mode and messages are published as persistent and
+// mandatory, so Publish only succeeds once RabbitMQ has taken responsibility
+// for the message.
+type AmqpBroker struct {
+	config *Config
+	l      *zap.Logger
+
+	mu     sync.Mutex
+	conn   *amqp.Connection
+	ch     *amqp.Channel
+	ready  chan struct{}
+	queues map[string]QueueOptions
+
+	prefetch int
+
+	retMu sync.Mutex
+	// returned holds the message IDs Publish is waiting on, set to true once
+	// the message is returned.
+	returned map[string]bool
+	confirms map[*amqp.Channel]*amqpConfirms
+
+	done chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+func NewAmqpBroker(config *Config, l *zap.Logger) (*AmqpBroker, error) {
+	b := &AmqpBroker{
+		config: config,
+		l:      l,
+		ready:  make(chan struct{}),
+		queues: make(map[string]QueueOptions),
+		done:   make(chan struct{}),
+
+		returned: make(map[string]bool),
+		confirms: make(map[*amqp.Channel]*amqpConfirms),
+	}
+
+	conn, ch, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	b.setChannel(conn, ch)
+
+	b.wg.Add(1)
+	go b.supervise(conn, ch)
+
+	return b, nil
+}
+
+// dial opens a connection and puts its channel into confirm mode, watching
+// it for the mandatory messages RabbitMQ hands back as unroutable.
+func (b *AmqpBroker) dial() (*amqp.Connection, *amqp.Channel, error) {
+	conn, ch, err := dialAmqp(b.config, b.l)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b.mu.Lock()
+	prefetch := b.prefetch
+	b.mu.Unlock()
+	if prefetch > 0 {
+		if err := ch.Qos(prefetch, 0, false); err != nil {
+			b.l.Error("error setting prefetch", zap.Error(err))
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		b.l.Error("error enabling publisher confirms", zap.Error(err))
+		conn.Close()
+		return nil, nil, err
+	}
+
+	c := &amqpConfirms{advanced: make(chan struct{})}
+	b.retMu.Lock()
+	b.confirms[ch] = c
+	b.retMu.Unlock()
+	go b.watch(ch, c,
+		ch.NotifyReturn(make(chan amqp.Return)),
+		ch.NotifyPublish(make(chan amqp.Confirmation)))
+
+	return conn, ch, nil
+}
+
+// watch records returned messages and the confirms of ch. RabbitMQ sends the
+// return of an unroutable message before its confirm and the client hands
+// both over unbuffered, so reading them in one goroutine means a return is
+// recorded before the confirm that follows it is counted.
+func (b *AmqpBroker) watch(ch *amqp.Channel, c *amqpConfirms, returns <-chan amqp.Return, confirms <-chan amqp.Confirmation) {
+	defer func() {
+		b.retMu.Lock()
+		delete(b.confirms, ch)
+		b.retMu.Unlock()
+		c.close()
+	}()
+
+	for returns != nil || confirms != nil {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			b.l.Warn("message returned by broker",
+				zap.String("messageId", r.MessageId),
+				zap.String("routingKey", r.RoutingKey),
+				zap.String("reason", r.ReplyText))
+			b.retMu.Lock()
+			if _, waiting := b.returned[r.MessageId]; waiting {
+				b.returned[r.MessageId] = true
+			}
+			b.retMu.Unlock()
+		case conf, ok := <-confirms:
+			if !ok {
+				confirms = nil
+				continue
+			}
+			c.advance(conf.DeliveryTag)
+		}
+	}
+}
+
+// amqpConfirms tracks the highest delivery tag watch has seen confirmed on
+// a channel. Confirms arrive in order.
+type amqpConfirms struct {
+	mu       sync.Mutex
+	tag      uint64
+	closed   bool
+	advanced chan struct{}
+}
+
+func (c *amqpConfirms) advance(tag uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tag = tag
+	close(c.advanced)
+	c.advanced = make(chan struct{})
+}
+
+func (c *amqpConfirms) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.advanced)
+	}
+}
+
+// wait returns once the confirm of tag has been seen or the channel has
+// closed, after which any return for it has been recorded.
+func (c *amqpConfirms) wait(ctx context.Context, tag uint64) error {
+	for {
+		c.mu.Lock()
+		done, advanced := c.closed || c.tag >= tag, c.advanced
+		c.mu.Unlock()
+		if done {
+			return nil
+		}
+
+		select {
+		case <-advanced:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (b *AmqpBroker) setChannel(conn *amqp.Connection, ch *amqp.Channel) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conn, b.ch = conn, ch
+	close(b.ready)
+}
+
+// supervise waits for the current connection or channel to close and then
+// reconnects until it succeeds or the broker is closed.
+func (b *AmqpBroker) supervise(conn *amqp.Connection, ch *amqp.Channel) {
+	defer b.wg.Done()
+
+	for {
+		connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+		var reason *amqp.Error
+		select {
+		case reason = <-connClosed:
+		case reason = <-chClosed:
+		case <-b.done:
+			return
+		}
+		b.l.Warn("rabbitmq connection lost, reconnecting", zap.Any("reason", reason))
+
+		b.mu.Lock()
+		b.ch = nil
+		b.ready = make(chan struct{})
+		b.mu.Unlock()
+		if !conn.IsClosed() {
+			conn.Close()
+		}
+
+		var ok bool
+		conn, ch, ok = b.reconnect()
+		if !ok {
+			return
+		}
+		b.setChannel(conn, ch)
+		b.l.Info("rabbitmq connection restored")
+	}
+}
+
+func (b *AmqpBroker) reconnect() (*amqp.Connection, *amqp.Channel, bool) {
+	backoff := amqpReconnectMin
+	for {
+		select {
+		case <-time.After(backoff):
+		case <-b.done:
+			return nil, nil, false
+		}
+
+		conn, ch, err := b.dial()
+		if err == nil {
+			err = b.redeclare(ch)
+			if err == nil {
+				return conn, ch, true
+			}
+			b.l.Error("error redeclaring queues", zap.Error(err))
+			conn.Close()
+		}
+
+		backoff *= 2
+		if backoff > amqpReconnectMax {
+			backoff = amqpReconnectMax
+		}
+	}
+}
+
+func (b *AmqpBroker) redeclare(ch *amqp.Channel) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name, opts := range b.queues {
+		if _, err := ch.QueueDeclare(name, true, false, false, false, opts.table()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o QueueOptions) table() amqp.Table {
+	if o.DeadLetter == "" && o.MessageTTL == 0 {
+		return nil
+	}
+	args := amqp.Table{}
+	if o.DeadLetter != "" {
+		args["x-dead-letter-exchange"] = ""
+		args["x-dead-letter-routing-key"] = o.DeadLetter
+	}
+	if o.MessageTTL > 0 {
+		args["x-message-ttl"] = o.MessageTTL.Milliseconds()
+	}
+	return args
+}
+
+// channel returns the live channel, waiting for a reconnect if necessary.
+func (b *AmqpBroker) channel(ctx context.Context) (*amqp.Channel, error) {
+	for {
+		b.mu.Lock()
+		ch, ready := b.ch, b.ready
+		b.mu.Unlock()
+		if ch != nil {
+			return ch, nil
+		}
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-b.done:
+			return nil, ErrBrokerClosed
+		}
+	}
+}
+
+func (b *AmqpBroker) DeclareQueue(name string, opts QueueOptions) error {
+	ch, err := b.channel(context.Background())
+	if err != nil {
+		return err
+	}
+	if _, err := ch.QueueDeclare(name, true, false, false, false, opts.table()); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.queues[name] = opts
+	b.mu.Unlock()
+	return nil
+}
+
+// Publish waits for RabbitMQ to confirm the message. It returns
+// ErrPublishNacked if the broker refuses it and ErrUnroutable if no queue is
+// bound to the routing key.
+func (b *AmqpBroker) Publish(ctx context.Context, queue string, m Message) error {
+	ch, err := b.channel(ctx)
+	if err != nil {
+		return err
+	}
+
+	id := m.MessageID
+	if id == "" {
+		if id, err = NewMessageID(); err != nil {
+			return err
+		}
+	}
+
+	b.retMu.Lock()
+	b.returned[id] = false
+	b.retMu.Unlock()
+	defer func() {
+		b.retMu.Lock()
+		delete(b.returned, id)
+		b.retMu.Unlock()
+	}()
+
+	dc, err := ch.PublishWithDeferredConfirmWithContext(ctx, "", queue, true, false, amqp.Publishing{
+		ContentType:   m.ContentType,
+		DeliveryMode:  amqp.Persistent,
+		CorrelationId: m.CorrelationID,
+		MessageId:     id,
+		Timestamp:     time.Now(),
+		Body:          m.Body,
+	})
+	if err != nil {
+		return err
+	}
+
+	acked, err := dc.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return ErrPublishNacked
+	}
+
+	b.retMu.Lock()
+	c := b.confirms[ch]
+	b.retMu.Unlock()
+	if c != nil {
+		if err := c.wait(ctx, dc.DeliveryTag); err != nil {
+			return err
+		}
+	}
+
+	b.retMu.Lock()
+	returned := b.returned[id]
+	b.retMu.Unlock()
+	if returned {
+		return ErrUnroutable
+	}
+	return nil
+}
+
+// Qos sets the channel prefetch count. It is reapplied after reconnects.
+func (b *AmqpBroker) Qos(prefetch int) error {
+	b.mu.Lock()
+	b.prefetch = prefetch
+	b.mu.Unlock()
+
+	ch, err := b.channel(context.Background())
+	if err != nil {
+		return err
+	}
+	return ch.Qos(prefetch, 0, false)
+}
+
+// Consume returns a delivery channel that survives reconnects. Deliveries
+// received before a reconnect can no longer be acked; RabbitMQ redelivers
+// them on the new channel.
+func (b *AmqpBroker) Consume(queue string, autoAck bool) (<-chan Delivery, error) {
+	ch, err := b.channel(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := ch.Consume(queue, "", autoAck, false, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan Delivery)
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer close(out)
+		for {
+			for d := range msgs {
+				del := Delivery{Message: Message{
+					ContentType:   d.ContentType,
+					CorrelationID: d.CorrelationId,
+					MessageID:     d.MessageId,
+					Body:          d.Body,
+				}}
+				if !autoAck {
+					d := d
+					del.ack = func() error { return d.Ack(false) }
+					del.nack = func(requeue bool) error { return d.Nack(false, requeue) }
+				}
+				select {
+				case out <- del:
+				case <-b.done:
+					return
+				}
+			}
+
+			for {
+				ch, err := b.channel(context.Background())
+				if err != nil {
+					return
+				}
+				msgs, err = ch.Consume(queue, "", autoAck, false, false, false, nil)
+				if err == nil {
+					b.l.Info("resumed consuming", zap.String("queue", queue))
+					break
+				}
+				b.l.Error("error resuming consumer", zap.String("queue", queue), zap.Error(err))
+				select {
+				case <-time.After(amqpReconnectMin):
+				case <-b.done:
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (b *AmqpBroker) Close() error {
+	b.once.Do(func() { close(b.done) })
+
+	b.mu.Lock()
+	conn, ch := b.conn, b.ch
+	b.mu.Unlock()
+
+	if ch != nil {
+		if err := ch.Close(); err != nil {
+			b.l.Error("error closing channel", zap.Error(err))
+		}
+	}
+	var err error
+	if conn != nil && !conn.IsClosed() {
+		err = conn.Close()
+	}
+	b.wg.Wait()
+	return err
+}
@@ -0,0 +1,121 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.uber.org/zap"
+)
+
+// testAmqpBroker connects to the RabbitMQ named by the amqp* environment
+// variables, skipping the test when amqpHost is not set.
+func testAmqpBroker(t *testing.T) *AmqpBroker {
+	t.Helper()
+	if os.Getenv("amqpHost") == "" {
+		t.Skip("amqpHost is not set")
+	}
+	b, err := NewAmqpBroker(&Config{
+		AmqpUser: os.Getenv("amqpUser"),
+		AmqpPass: os.Getenv("amqpPass"),
+		AmqpHost: os.Getenv("amqpHost"),
+		AmqpPort: os.Getenv("amqpPort"),
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewAmqpBroker: %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func TestAmqpPublishUnroutable(t *testing.T) {
+	b := testAmqpBroker(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Every publish must see its own return, however quickly the confirm
+	// follows it.
+	for i := 0; i < 50; i++ {
+		err := b.Publish(ctx, "sfdataapp-test-unbound", Message{Body: []byte("{}")})
+		if !errors.Is(err, ErrUnroutable) {
+			t.Fatalf("publish %d: got %v, want ErrUnroutable", i, err)
+		}
+	}
+}
+
+func TestAmqpPublishRoutable(t *testing.T) {
+	b := testAmqpBroker(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const queue = "sfdataapp-test-bound"
+	if err := b.DeclareQueue(queue, QueueOptions{MessageTTL: time.Second}); err != nil {
+		t.Fatalf("DeclareQueue: %v", err)
+	}
+	if err := b.Publish(ctx, queue, Message{Body: []byte("{}")}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+}
+
+func TestAmqpConfirmsWait(t *testing.T) {
+	c := &amqpConfirms{advanced: make(chan struct{})}
+
+	done := make(chan error, 1)
+	go func() { done <- c.wait(context.Background(), 2) }()
+
+	c.advance(1)
+	select {
+	case err := <-done:
+		t.Fatalf("wait returned %v before tag 2 was confirmed", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	c.advance(2)
+	if err := <-done; err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.wait(ctx, 3); !errors.Is(err, context.Canceled) {
+		t.Fatalf("wait with a cancelled context: got %v", err)
+	}
+
+	c.close()
+	if err := c.wait(context.Background(), 3); err != nil {
+		t.Fatalf("wait after close: %v", err)
+	}
+}
+
+// TestAmqpWatchReturns checks that returns are only recorded for messages a
+// Publish call is still waiting on, so a late return does not leave an entry
+// behind.
+func TestAmqpWatchReturns(t *testing.T) {
+	b := &AmqpBroker{
+		l:        zap.NewNop(),
+		returned: map[string]bool{"waiting": false},
+		confirms: make(map[*amqp.Channel]*amqpConfirms),
+	}
+	returns := make(chan amqp.Return)
+	confirms := make(chan amqp.Confirmation)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.watch(nil, &amqpConfirms{advanced: make(chan struct{})}, returns, confirms)
+	}()
+
+	returns <- amqp.Return{MessageId: "waiting"}
+	returns <- amqp.Return{MessageId: "gone"}
+	close(returns)
+	close(confirms)
+	<-done
+
+	want := map[string]bool{"waiting": true}
+	if !reflect.DeepEqual(b.returned, want) {
+		t.Errorf("returned = %v, want %v", b.returned, want)
+	}
+}
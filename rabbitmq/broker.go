@@ -0,0 +1,148 @@
+package rabbitmq
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	BackendRabbitMQ = "rabbitmq"
+	BackendNats     = "nats"
+	BackendSqlite   = "sqlite"
+	BackendMemory   = "memory"
+)
+
+type Publisher interface {
+	Publish(ctx context.Context, queue string, m Message) error
+}
+
+// Consumer receives messages. Qos limits how many unacknowledged deliveries
+// each subsequent Consume call may hold; zero means no limit.
+type Consumer interface {
+	Qos(prefetch int) error
+	Consume(queue string, autoAck bool) (<-chan Delivery, error)
+}
+
+// Broker is the subset of messaging operations used by the handlers and the
+// queue consumer. It lets the picklist pipeline run against RabbitMQ, NATS,
+// a local SQLite file or an in-memory stand-in.
+type Broker interface {
+	Publisher
+	Consumer
+	DeclareQueue(name string, opts QueueOptions) error
+	Close() error
+}
+
+// QueueOptions mirror RabbitMQ's dead-letter and TTL queue arguments.
+// Messages nacked without requeue are moved to DeadLetter. When MessageTTL is
+// also set the queue acts as a delay queue: every message is moved to
+// DeadLetter once it has waited MessageTTL. Delay queues are not meant to be
+// consumed directly.
+type QueueOptions struct {
+	DeadLetter string
+	MessageTTL time.Duration
+}
+
+func (o QueueOptions) isDelay() bool {
+	return o.DeadLetter != "" && o.MessageTTL > 0
+}
+
+// NewBroker connects to the backend named by config.Broker, defaulting to
+// RabbitMQ.
+func NewBroker(config *Config, l *zap.Logger) (Broker, error) {
+	switch config.Broker {
+	case "", BackendRabbitMQ:
+		return NewAmqpBroker(config, l)
+	case BackendNats:
+		return NewNatsBroker(config, l)
+	case BackendSqlite:
+		return NewSqliteBroker(config, l)
+	case BackendMemory:
+		return NewMemoryBroker(), nil
+	default:
+		return nil, fmt.Errorf("unknown broker backend %q", config.Broker)
+	}
+}
+
+// Message is a queued payload. CorrelationID ties messages to the request
+// that caused them and MessageID identifies one message across retries; both
+// travel as message headers.
+type Message struct {
+	ContentType   string
+	CorrelationID string
+	MessageID     string
+	Body          []byte
+}
+
+func NewMessageID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Delivery is a message received from a queue. Ack and Nack are no-ops for
+// deliveries consumed with autoAck.
+type Delivery struct {
+	Message
+	ack  func() error
+	nack func(requeue bool) error
+}
+
+func (d Delivery) Ack() error {
+	if d.ack == nil {
+		return nil
+	}
+	return d.ack()
+}
+
+func (d Delivery) Nack(requeue bool) error {
+	if d.nack == nil {
+		return nil
+	}
+	return d.nack(requeue)
+}
+
+// limitInFlight emulates a prefetch limit for backends without one by holding
+// back further deliveries until earlier ones are acked or nacked.
+func limitInFlight(in <-chan Delivery, prefetch int) <-chan Delivery {
+	if prefetch <= 0 {
+		return in
+	}
+
+	sem := make(chan struct{}, prefetch)
+	out := make(chan Delivery)
+	go func() {
+		defer close(out)
+		for d := range in {
+			sem <- struct{}{}
+			var once sync.Once
+			release := func() { once.Do(func() { <-sem }) }
+
+			ack, nack := d.ack, d.nack
+			d.ack = func() error {
+				defer release()
+				if ack == nil {
+					return nil
+				}
+				return ack()
+			}
+			d.nack = func(requeue bool) error {
+				defer release()
+				if nack == nil {
+					return nil
+				}
+				return nack(requeue)
+			}
+			out <- d
+		}
+	}()
+	return out
+}
@@ -0,0 +1,200 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrBrokerClosed = errors.New("broker is closed")
+
+// MemoryBroker is an in-process Broker used to exercise the picklist pipeline
+// without a running RabbitMQ. Queues are unbounded and every message is handed
+// to exactly one consumer.
+type MemoryBroker struct {
+	mu       sync.Mutex
+	queues   map[string]*memQueue
+	prefetch int
+	closed   bool
+	done     chan struct{}
+}
+
+type memQueue struct {
+	opts    QueueOptions
+	mu      sync.Mutex
+	pending []Message
+	ready   chan struct{}
+}
+
+func errUnknownQueue(name string) error {
+	return fmt.Errorf("queue %q is not declared", name)
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		queues: make(map[string]*memQueue),
+		done:   make(chan struct{}),
+	}
+}
+
+func (b *MemoryBroker) DeclareQueue(name string, opts QueueOptions) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrBrokerClosed
+	}
+	if q, ok := b.queues[name]; ok {
+		if q.opts != opts {
+			return fmt.Errorf("queue %q already declared with different options", name)
+		}
+		return nil
+	}
+	b.queues[name] = &memQueue{opts: opts, ready: make(chan struct{}, 1)}
+	return nil
+}
+
+// deadLetter moves m to the dead-letter queue of q, dropping it if q has none.
+func (b *MemoryBroker) deadLetter(q *memQueue, m Message) {
+	if q.opts.DeadLetter == "" {
+		return
+	}
+	dl, err := b.queue(q.opts.DeadLetter)
+	if err != nil {
+		return
+	}
+	dl.push(m, false)
+}
+
+func (b *MemoryBroker) queue(name string) (*memQueue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrBrokerClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return nil, errUnknownQueue(name)
+	}
+	return q, nil
+}
+
+func (b *MemoryBroker) Publish(ctx context.Context, queue string, m Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	q, err := b.queue(queue)
+	if err != nil {
+		return err
+	}
+	if q.opts.isDelay() {
+		time.AfterFunc(q.opts.MessageTTL, func() { b.deadLetter(q, m) })
+		return nil
+	}
+	q.push(m, false)
+	return nil
+}
+
+func (b *MemoryBroker) Qos(prefetch int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.prefetch = prefetch
+	return nil
+}
+
+func (b *MemoryBroker) Consume(queue string, autoAck bool) (<-chan Delivery, error) {
+	q, err := b.queue(queue)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan Delivery)
+	go func() {
+		defer close(out)
+		for {
+			m, ok := q.pop()
+			if !ok {
+				select {
+				case <-q.ready:
+					continue
+				case <-b.done:
+					return
+				}
+			}
+
+			d := Delivery{Message: m}
+			if !autoAck {
+				d.nack = func(requeue bool) error {
+					if requeue {
+						q.push(m, true)
+					} else {
+						b.deadLetter(q, m)
+					}
+					return nil
+				}
+			}
+
+			select {
+			case out <- d:
+			case <-b.done:
+				return
+			}
+		}
+	}()
+
+	if autoAck {
+		return out, nil
+	}
+	b.mu.Lock()
+	prefetch := b.prefetch
+	b.mu.Unlock()
+	return limitInFlight(out, prefetch), nil
+}
+
+// Len reports the number of messages waiting in a queue.
+func (b *MemoryBroker) Len(queue string) int {
+	q, err := b.queue(queue)
+	if err != nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		close(b.done)
+	}
+	return nil
+}
+
+func (q *memQueue) push(m Message, front bool) {
+	q.mu.Lock()
+	if front {
+		q.pending = append([]Message{m}, q.pending...)
+	} else {
+		q.pending = append(q.pending, m)
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *memQueue) pop() (Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		return Message{}, false
+	}
+	m := q.pending[0]
+	q.pending = q.pending[1:]
+	return m, true
+}
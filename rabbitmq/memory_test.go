@@ -0,0 +1,190 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, msgs <-chan Delivery) Delivery {
+	t.Helper()
+	select {
+	case d, ok := <-msgs:
+		if !ok {
+			t.Fatal("delivery channel closed")
+		}
+		return d
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a delivery")
+	}
+	return Delivery{}
+}
+
+func noDelivery(t *testing.T, msgs <-chan Delivery) {
+	t.Helper()
+	select {
+	case d := <-msgs:
+		t.Fatalf("unexpected delivery %q", d.MessageID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryBrokerPublishConsume(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	ctx := context.Background()
+
+	if err := b.Publish(ctx, "q", Message{MessageID: "1"}); err == nil {
+		t.Error("Publish to an undeclared queue succeeded")
+	}
+	if err := b.DeclareQueue("q", QueueOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DeclareQueue("q", QueueOptions{DeadLetter: "dl"}); err == nil {
+		t.Error("declaring q again with different options succeeded")
+	}
+
+	for _, id := range []string{"1", "2"} {
+		if err := b.Publish(ctx, "q", Message{MessageID: id, CorrelationID: "run", Body: []byte(id)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := b.Len("q"); n != 2 {
+		t.Errorf("Len = %d, want 2", n)
+	}
+
+	msgs, err := b.Consume("q", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"1", "2"} {
+		d := receive(t, msgs)
+		if d.MessageID != id || d.CorrelationID != "run" || string(d.Body) != id {
+			t.Errorf("delivery = %+v, want message %s", d.Message, id)
+		}
+	}
+}
+
+func TestMemoryBrokerNack(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	ctx := context.Background()
+
+	if err := b.DeclareQueue("dl", QueueOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DeclareQueue("q", QueueOptions{DeadLetter: "dl"}); err != nil {
+		t.Fatal(err)
+	}
+	b.Publish(ctx, "q", Message{MessageID: "1"})
+
+	msgs, err := b.Consume("q", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := receive(t, msgs)
+	d.Nack(true)
+	if d = receive(t, msgs); d.MessageID != "1" {
+		t.Fatalf("redelivered %q, want 1", d.MessageID)
+	}
+	d.Nack(false)
+	b.Publish(ctx, "q", Message{MessageID: "2"})
+
+	dead, err := b.Consume("dl", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := receive(t, dead); d.MessageID != "1" {
+		t.Errorf("dead-lettered %q, want 1", d.MessageID)
+	}
+
+	d = receive(t, msgs)
+	if d.MessageID != "2" {
+		t.Errorf("delivered %q, want 2", d.MessageID)
+	}
+	d.Ack()
+	noDelivery(t, msgs)
+	noDelivery(t, dead)
+}
+
+func TestMemoryBrokerDelayQueue(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+
+	if err := b.DeclareQueue("q", QueueOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DeclareQueue("retry", QueueOptions{DeadLetter: "q", MessageTTL: 50 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err := b.Publish(context.Background(), "retry", Message{MessageID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := b.Consume("q", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := receive(t, msgs)
+	if d.MessageID != "1" {
+		t.Errorf("delivered %q, want 1", d.MessageID)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("delivered after %s, want at least the 50ms TTL", waited)
+	}
+}
+
+func TestMemoryBrokerPrefetch(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+
+	if err := b.DeclareQueue("q", QueueOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		b.Publish(context.Background(), "q", Message{MessageID: id})
+	}
+	if err := b.Qos(2); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := b.Consume("q", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := receive(t, msgs)
+	receive(t, msgs)
+	noDelivery(t, msgs)
+
+	first.Ack()
+	if d := receive(t, msgs); d.MessageID != "3" {
+		t.Errorf("delivered %q, want 3", d.MessageID)
+	}
+}
+
+func TestMemoryBrokerClose(t *testing.T) {
+	b := NewMemoryBroker()
+	if err := b.DeclareQueue("q", QueueOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := b.Consume("q", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	select {
+	case _, ok := <-msgs:
+		if ok {
+			t.Error("received a delivery after Close")
+		}
+	case <-time.After(time.Second):
+		t.Error("delivery channel was not closed")
+	}
+	if err := b.Publish(context.Background(), "q", Message{}); !errors.Is(err, ErrBrokerClosed) {
+		t.Errorf("Publish after Close: error = %v, want ErrBrokerClosed", err)
+	}
+}
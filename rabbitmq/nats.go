@@ -0,0 +1,273 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"go.uber.org/zap"
+)
+
+const (
+	natsConsumerName      = "sfdataapp-queue"
+	natsDelayConsumerName = "sfdataapp-delay"
+	natsOpTimeout         = 10 * time.Second
+)
+
+// NatsBroker maps each queue onto a JetStream stream with work-queue
+// retention, so a message is removed once a consumer acknowledges it. Dead
+// lettering and delay queues are emulated by republishing.
+type NatsBroker struct {
+	nc *nats.Conn
+	js jetstream.JetStream
+	l  *zap.Logger
+
+	mu       sync.Mutex
+	iters    []jetstream.MessagesContext
+	opts     map[string]QueueOptions
+	prefetch int
+
+	done chan struct{}
+	once sync.Once
+}
+
+func NewNatsBroker(config *Config, l *zap.Logger) (*NatsBroker, error) {
+	url := config.NatsURL
+	if url == "" {
+		url = nats.DefaultURL
+	}
+
+	nc, err := nats.Connect(url, nats.Name("sfdataapp"), nats.MaxReconnects(-1))
+	if err != nil {
+		l.Error("error connecting to nats", zap.Error(err))
+		return nil, err
+	}
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		l.Error("error initializing jetstream", zap.Error(err))
+		nc.Close()
+		return nil, err
+	}
+
+	return &NatsBroker{nc: nc, js: js, l: l, opts: make(map[string]QueueOptions), done: make(chan struct{})}, nil
+}
+
+// streamName converts a queue name into a valid stream name, which may not
+// contain dots.
+func streamName(queue string) string {
+	return strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_").Replace(queue)
+}
+
+func (b *NatsBroker) DeclareQueue(name string, opts QueueOptions) error {
+	ctx, cancel := context.WithTimeout(context.Background(), natsOpTimeout)
+	defer cancel()
+
+	_, err := b.js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:      streamName(name),
+		Subjects:  []string{name},
+		Retention: jetstream.WorkQueuePolicy,
+		Storage:   jetstream.FileStorage,
+	})
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	_, known := b.opts[name]
+	b.opts[name] = opts
+	b.mu.Unlock()
+
+	if opts.isDelay() && !known {
+		return b.moveDelayed(name, opts)
+	}
+	return nil
+}
+
+// moveDelayed republishes messages from a delay queue to its dead-letter
+// queue once they are older than the queue's TTL.
+func (b *NatsBroker) moveDelayed(name string, opts QueueOptions) error {
+	ctx, cancel := context.WithTimeout(context.Background(), natsOpTimeout)
+	defer cancel()
+
+	cons, err := b.js.CreateOrUpdateConsumer(ctx, streamName(name), jetstream.ConsumerConfig{
+		Durable:   natsDelayConsumerName,
+		AckPolicy: jetstream.AckExplicitPolicy,
+	})
+	if err != nil {
+		return err
+	}
+
+	it, err := cons.Messages()
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.iters = append(b.iters, it)
+	b.mu.Unlock()
+
+	go func() {
+		for {
+			msg, err := it.Next()
+			if err != nil {
+				if !errors.Is(err, jetstream.ErrMsgIteratorClosed) {
+					b.l.Error("error receiving delayed nats message", zap.Error(err))
+				}
+				return
+			}
+
+			meta, err := msg.Metadata()
+			if err == nil {
+				if wait := opts.MessageTTL - time.Since(meta.Timestamp); wait > 0 {
+					msg.NakWithDelay(wait)
+					continue
+				}
+			}
+			if err := b.republish(opts.DeadLetter, msg); err != nil {
+				b.l.Error("error moving delayed nats message", zap.String("queue", name), zap.Error(err))
+				msg.Nak()
+				continue
+			}
+			msg.Ack()
+		}
+	}()
+	return nil
+}
+
+func (b *NatsBroker) republish(queue string, msg jetstream.Msg) error {
+	ctx, cancel := context.WithTimeout(context.Background(), natsOpTimeout)
+	defer cancel()
+
+	out := nats.NewMsg(queue)
+	out.Data = msg.Data()
+	for k, v := range msg.Headers() {
+		out.Header[k] = v
+	}
+	_, err := b.js.PublishMsg(ctx, out)
+	return err
+}
+
+// Publish gives a message without a MessageID a new one, as AmqpBroker does,
+// so every delivery can be told apart across retries.
+func (b *NatsBroker) Publish(ctx context.Context, queue string, m Message) error {
+	msg := nats.NewMsg(queue)
+	msg.Data = m.Body
+	if m.ContentType != "" {
+		msg.Header.Set("Content-Type", m.ContentType)
+	}
+	if m.CorrelationID != "" {
+		msg.Header.Set("Correlation-Id", m.CorrelationID)
+	}
+	id := m.MessageID
+	if id == "" {
+		var err error
+		if id, err = NewMessageID(); err != nil {
+			return err
+		}
+	}
+	msg.Header.Set("Message-Id", id)
+	_, err := b.js.PublishMsg(ctx, msg)
+	return err
+}
+
+// Qos sets MaxAckPending on consumers created afterwards.
+func (b *NatsBroker) Qos(prefetch int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.prefetch = prefetch
+	return nil
+}
+
+func (b *NatsBroker) Consume(queue string, autoAck bool) (<-chan Delivery, error) {
+	b.mu.Lock()
+	opts, prefetch := b.opts[queue], b.prefetch
+	b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), natsOpTimeout)
+	defer cancel()
+
+	cons, err := b.js.CreateOrUpdateConsumer(ctx, streamName(queue), jetstream.ConsumerConfig{
+		Durable:       natsConsumerName,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		MaxAckPending: prefetch,
+	})
+	if err != nil {
+		if errors.Is(err, jetstream.ErrStreamNotFound) {
+			return nil, errUnknownQueue(queue)
+		}
+		return nil, err
+	}
+
+	it, err := cons.Messages()
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	b.iters = append(b.iters, it)
+	b.mu.Unlock()
+
+	out := make(chan Delivery)
+	go func() {
+		defer close(out)
+		for {
+			msg, err := it.Next()
+			if err != nil {
+				if !errors.Is(err, jetstream.ErrMsgIteratorClosed) {
+					b.l.Error("error receiving nats message", zap.Error(err))
+				}
+				return
+			}
+
+			d := Delivery{Message: Message{
+				ContentType:   msg.Headers().Get("Content-Type"),
+				CorrelationID: msg.Headers().Get("Correlation-Id"),
+				MessageID:     msg.Headers().Get("Message-Id"),
+				Body:          msg.Data(),
+			}}
+			if autoAck {
+				if err := msg.Ack(); err != nil {
+					b.l.Error("error acknowledging nats message", zap.Error(err))
+				}
+			} else {
+				d.ack = msg.Ack
+				d.nack = func(requeue bool) error {
+					if requeue {
+						return msg.Nak()
+					}
+					if opts.DeadLetter != "" {
+						if err := b.republish(opts.DeadLetter, msg); err != nil {
+							return err
+						}
+						return msg.Ack()
+					}
+					return msg.Term()
+				}
+			}
+			select {
+			case out <- d:
+			case <-b.done:
+				if !autoAck {
+					d.Nack(true)
+				}
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (b *NatsBroker) Close() error {
+	b.once.Do(func() { close(b.done) })
+	b.mu.Lock()
+	for _, it := range b.iters {
+		it.Stop()
+	}
+	b.iters = nil
+	b.mu.Unlock()
+
+	return b.nc.Drain()
+}
@@ -1,59 +1,133 @@
-package rabbitmq
-
-import (
-	"fmt"
-	"os"
-
-	"github.com/joho/godotenv"
-	amqp "github.com/rabbitmq/amqp091-go"
-	"go.uber.org/zap"
-)
-
-const (
-	PicklistQueryEvent = "picklistquery.created"
-)
-
-func ConnectAmqp(config *Config, l *zap.Logger) (*amqp.Channel, func() error, error) {
-
-	address := fmt.Sprintf("amqp://%s:%s@%s:%s/", config.AmqpUser, config.AmqpPass, config.AmqpHost, config.AmqpPort)
-
-	connection, err := amqp.Dial(address)
-	if err != nil {
-		l.Error("error initializing", zap.Error(err))
-		return nil, nil, err
-	}
-
-	channel, err := connection.Channel()
-	if err != nil {
-		l.Error("error connecting channel", zap.Error(err))
-		connection.Close()
-		return nil, nil, err
-	}
-
-	err = channel.ExchangeDeclare(PicklistQueryEvent, "fanout", true, false, false, false, nil)
-	if err != nil {
-		l.Error("error declaring picklist query event exchange", zap.Error(err))
-		channel.Close()
-		connection.Close()
-		return nil, nil, err
-	}
-
-	return channel, connection.Close, nil
-}
-
-func LoadConfig(l *zap.Logger) (*Config, error) {
-	if err := godotenv.Load(); err != nil {
-		l.Error("error loading .env file")
-		return nil, err
-	}
-
-	config := &Config{
-		AmqpUser:    os.Getenv("amqpUser"),
-		AmqpPass:    os.Getenv("amqpPass"),
-		AmqpHost:    os.Getenv("amqpHost"),
-		AmqpPort:    os.Getenv("amqpPort"),
-		JsonDirPath: os.Getenv("jsonDirPath"),
-	}
-
-	return config, nil
-}
+package rabbitmq
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/joho/godotenv"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.uber.org/zap"
+)
+
+const (
+	PicklistQueryEvent      = "picklistquery.created"
+	PicklistRetryQueue      = "picklistquery.retry"
+	PicklistDeadLetterQueue = "picklistquery.deadletter"
+	PicklistResultQueue     = "picklistquery.results"
+
+	defaultMaxRetries = 3
+	defaultRetryDelay = 30 * time.Second
+	defaultWorkers    = 4
+)
+
+// DeclarePicklistQueue declares the picklist request queue and the
+// dead-letter queue that receives requests the worker gives up on. Publishers
+// and consumers must declare it with the same options.
+func DeclarePicklistQueue(b Broker) error {
+	if err := b.DeclareQueue(PicklistDeadLetterQueue, QueueOptions{}); err != nil {
+		return err
+	}
+	return b.DeclareQueue(PicklistQueryEvent, QueueOptions{DeadLetter: PicklistDeadLetterQueue})
+}
+
+// DeclarePicklistRetryQueue declares the delay queue that feeds failed
+// requests back into the picklist request queue after delay.
+func DeclarePicklistRetryQueue(b Broker, delay time.Duration) error {
+	return b.DeclareQueue(PicklistRetryQueue, QueueOptions{DeadLetter: PicklistQueryEvent, MessageTTL: delay})
+}
+
+// DeclarePicklistResultQueue declares the queue the worker reports request
+// outcomes on.
+func DeclarePicklistResultQueue(b Broker) error {
+	return b.DeclareQueue(PicklistResultQueue, QueueOptions{})
+}
+
+func ConnectAmqp(config *Config, l *zap.Logger) (*amqp.Channel, func() error, error) {
+	connection, channel, err := dialAmqp(config, l)
+	if err != nil {
+		return nil, nil, err
+	}
+	return channel, connection.Close, nil
+}
+
+func dialAmqp(config *Config, l *zap.Logger) (*amqp.Connection, *amqp.Channel, error) {
+
+	address := fmt.Sprintf("amqp://%s:%s@%s:%s/", config.AmqpUser, config.AmqpPass, config.AmqpHost, config.AmqpPort)
+
+	connection, err := amqp.Dial(address)
+	if err != nil {
+		l.Error("error initializing", zap.Error(err))
+		return nil, nil, err
+	}
+
+	channel, err := connection.Channel()
+	if err != nil {
+		l.Error("error connecting channel", zap.Error(err))
+		connection.Close()
+		return nil, nil, err
+	}
+
+	err = channel.ExchangeDeclare(PicklistQueryEvent, "fanout", true, false, false, false, nil)
+	if err != nil {
+		l.Error("error declaring picklist query event exchange", zap.Error(err))
+		channel.Close()
+		connection.Close()
+		return nil, nil, err
+	}
+
+	return connection, channel, nil
+}
+
+func LoadConfig(l *zap.Logger) (*Config, error) {
+	if err := godotenv.Load(); err != nil {
+		l.Error("error loading .env file")
+		return nil, err
+	}
+
+	config := &Config{
+		Broker:        os.Getenv("brokerBackend"),
+		AmqpUser:      os.Getenv("amqpUser"),
+		AmqpPass:      os.Getenv("amqpPass"),
+		AmqpHost:      os.Getenv("amqpHost"),
+		AmqpPort:      os.Getenv("amqpPort"),
+		NatsURL:       os.Getenv("natsURL"),
+		QueueDBPath:   os.Getenv("queueDBPath"),
+		JsonDirPath:   os.Getenv("jsonDirPath"),
+		DependencyDir: os.Getenv("picklistDependencyDir"),
+	}
+
+	var err error
+	if config.MaxRetries, err = envInt(l, "maxRetries", defaultMaxRetries); err != nil {
+		return nil, err
+	}
+	retryDelay, err := envInt(l, "retryDelaySeconds", int(defaultRetryDelay/time.Second))
+	if err != nil {
+		return nil, err
+	}
+	config.RetryDelay = time.Duration(retryDelay) * time.Second
+	if config.Workers, err = envInt(l, "queueWorkers", defaultWorkers); err != nil {
+		return nil, err
+	}
+	if config.Prefetch, err = envInt(l, "queuePrefetch", 2*config.Workers); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// envInt reads an integer environment variable, falling back to def when it
+// is unset.
+func envInt(l *zap.Logger, key string, def int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		l.Error("invalid integer setting", zap.String("key", key), zap.String("value", v))
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,316 @@
+package rabbitmq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	defaultQueueDBPath = "sfdataapp-queue.db"
+	sqlitePollInterval = 500 * time.Millisecond
+	sqliteClaimTimeout = 5 * time.Minute
+)
+
+// sqliteMigrations[i] brings a queue database from version i to i+1. The
+// version is kept in PRAGMA user_version. Append to the list to change the
+// schema; never edit a migration that has shipped.
+var sqliteMigrations = []string{
+	`CREATE TABLE queues (
+		name TEXT PRIMARY KEY
+	);
+	CREATE TABLE messages (
+		id            INTEGER PRIMARY KEY AUTOINCREMENT,
+		queue         TEXT NOT NULL,
+		content_type  TEXT NOT NULL DEFAULT '',
+		body          BLOB NOT NULL,
+		claimed_until INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX messages_queue_idx ON messages (queue, id);`,
+
+	`ALTER TABLE queues ADD COLUMN dead_letter TEXT NOT NULL DEFAULT '';
+	ALTER TABLE queues ADD COLUMN ttl_ms INTEGER NOT NULL DEFAULT 0;`,
+
+	`ALTER TABLE messages ADD COLUMN correlation_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE messages ADD COLUMN message_id TEXT NOT NULL DEFAULT '';`,
+}
+
+// migrateSqlite applies the migrations the database has not seen, each in
+// its own transaction with the version it reaches. Transactions take the
+// write lock up front, so two processes opening the file at once migrate it
+// in turn.
+func migrateSqlite(db *sql.DB) error {
+	version, err := sqliteSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("queue database is at schema version %d, newer than the %d this build knows", version, len(sqliteMigrations))
+	}
+
+	for version < len(sqliteMigrations) {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		// Another process sharing the file may have migrated it meanwhile.
+		var current int
+		if err := tx.QueryRow("PRAGMA user_version").Scan(&current); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if current != version {
+			tx.Rollback()
+			version = current
+			continue
+		}
+		if _, err := tx.Exec(sqliteMigrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrating queue database to version %d: %w", version+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		version++
+	}
+	return nil
+}
+
+// sqliteSchemaVersion reads PRAGMA user_version. Databases created before the
+// version was kept report 0, so their version is worked out from the columns
+// they have and recorded.
+func sqliteSchemaVersion(db *sql.DB) (int, error) {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil || version > 0 {
+		return version, err
+	}
+
+	// The newest column each version added, newest version first.
+	for _, c := range []struct {
+		version       int
+		table, column string
+	}{
+		{3, "messages", "correlation_id"},
+		{2, "queues", "dead_letter"},
+		{1, "queues", "name"},
+	} {
+		var n int
+		err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, c.table, c.column).Scan(&n)
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			version = c.version
+			break
+		}
+	}
+	if version == 0 {
+		return 0, nil
+	}
+	_, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", version))
+	return version, err
+}
+
+// SqliteBroker is a single-machine queue stored in a SQLite file. The web
+// server and the queue worker can share it as long as they run on the same
+// host. A claimed message that is neither acked nor nacked becomes visible
+// again after sqliteClaimTimeout.
+type SqliteBroker struct {
+	db       *sql.DB
+	l        *zap.Logger
+	prefetch int
+
+	wake chan struct{}
+	done chan struct{}
+	once sync.Once
+	// wg tracks the consumer goroutines so Close can wait for them before
+	// closing the database.
+	wg sync.WaitGroup
+}
+
+func NewSqliteBroker(config *Config, l *zap.Logger) (*SqliteBroker, error) {
+	path := config.QueueDBPath
+	if path == "" {
+		path = defaultQueueDBPath
+	}
+
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		l.Error("error opening queue database", zap.Error(err))
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	if err := migrateSqlite(db); err != nil {
+		l.Error("error migrating queue database", zap.Error(err))
+		db.Close()
+		return nil, err
+	}
+
+	return &SqliteBroker{
+		db:   db,
+		l:    l,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}, nil
+}
+
+func (b *SqliteBroker) DeclareQueue(name string, opts QueueOptions) error {
+	_, err := b.db.Exec(`INSERT INTO queues (name, dead_letter, ttl_ms) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET dead_letter = excluded.dead_letter, ttl_ms = excluded.ttl_ms`,
+		name, opts.DeadLetter, opts.MessageTTL.Milliseconds())
+	return err
+}
+
+func (b *SqliteBroker) queueOptions(ctx context.Context, queue string) (QueueOptions, error) {
+	var (
+		opts QueueOptions
+		ttl  int64
+	)
+	err := b.db.QueryRowContext(ctx, `SELECT dead_letter, ttl_ms FROM queues WHERE name = ?`, queue).Scan(&opts.DeadLetter, &ttl)
+	if errors.Is(err, sql.ErrNoRows) {
+		return opts, errUnknownQueue(queue)
+	}
+	opts.MessageTTL = time.Duration(ttl) * time.Millisecond
+	return opts, err
+}
+
+// Publish stores the message. Messages for a delay queue are written straight
+// to its dead-letter queue but stay invisible until the TTL has passed.
+func (b *SqliteBroker) Publish(ctx context.Context, queue string, m Message) error {
+	opts, err := b.queueOptions(ctx, queue)
+	if err != nil {
+		return err
+	}
+
+	visibleAt := int64(0)
+	if opts.isDelay() {
+		queue = opts.DeadLetter
+		visibleAt = time.Now().Add(opts.MessageTTL).UnixMilli()
+	}
+
+	_, err = b.db.ExecContext(ctx, `INSERT INTO messages (queue, content_type, correlation_id, message_id, body, claimed_until) VALUES (?, ?, ?, ?, ?, ?)`,
+		queue, m.ContentType, m.CorrelationID, m.MessageID, m.Body, visibleAt)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Qos must be called before Consume.
+func (b *SqliteBroker) Qos(prefetch int) error {
+	b.prefetch = prefetch
+	return nil
+}
+
+func (b *SqliteBroker) Consume(queue string, autoAck bool) (<-chan Delivery, error) {
+	opts, err := b.queueOptions(context.Background(), queue)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan Delivery)
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer close(out)
+		ticker := time.NewTicker(sqlitePollInterval)
+		defer ticker.Stop()
+
+		for {
+			d, err := b.claim(queue, opts, autoAck)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				b.l.Error("error claiming message", zap.String("queue", queue), zap.Error(err))
+			}
+			if err != nil {
+				select {
+				case <-ticker.C:
+					continue
+				case <-b.wake:
+					continue
+				case <-b.done:
+					return
+				}
+			}
+
+			select {
+			case out <- d:
+			case <-b.done:
+				if !autoAck {
+					d.Nack(true)
+				}
+				return
+			}
+		}
+	}()
+
+	if autoAck {
+		return out, nil
+	}
+	return limitInFlight(out, b.prefetch), nil
+}
+
+// claim takes the oldest visible message off the queue. With autoAck the row
+// is deleted straight away, otherwise it is hidden until acked, nacked or the
+// claim expires.
+func (b *SqliteBroker) claim(queue string, opts QueueOptions, autoAck bool) (Delivery, error) {
+	now := time.Now()
+	var (
+		id int64
+		d  Delivery
+	)
+
+	if autoAck {
+		err := b.db.QueryRow(`DELETE FROM messages WHERE id = (
+			SELECT id FROM messages WHERE queue = ? AND claimed_until < ? ORDER BY id LIMIT 1
+		) RETURNING id, content_type, correlation_id, message_id, body`, queue, now.UnixMilli()).Scan(&id, &d.ContentType, &d.CorrelationID, &d.MessageID, &d.Body)
+		return d, err
+	}
+
+	err := b.db.QueryRow(`UPDATE messages SET claimed_until = ? WHERE id = (
+		SELECT id FROM messages WHERE queue = ? AND claimed_until < ? ORDER BY id LIMIT 1
+	) RETURNING id, content_type, correlation_id, message_id, body`, now.Add(sqliteClaimTimeout).UnixMilli(), queue, now.UnixMilli()).Scan(&id, &d.ContentType, &d.CorrelationID, &d.MessageID, &d.Body)
+	if err != nil {
+		return d, err
+	}
+
+	d.ack = func() error {
+		_, err := b.db.Exec(`DELETE FROM messages WHERE id = ?`, id)
+		return err
+	}
+	d.nack = func(requeue bool) error {
+		switch {
+		case requeue:
+			_, err := b.db.Exec(`UPDATE messages SET claimed_until = 0 WHERE id = ?`, id)
+			return err
+		case opts.DeadLetter != "":
+			_, err := b.db.Exec(`UPDATE messages SET queue = ?, claimed_until = 0 WHERE id = ?`, opts.DeadLetter, id)
+			return err
+		default:
+			return d.ack()
+		}
+	}
+	return d, nil
+}
+
+func (b *SqliteBroker) Close() error {
+	b.once.Do(func() { close(b.done) })
+	b.wg.Wait()
+	return b.db.Close()
+}
@@ -0,0 +1,97 @@
+package rabbitmq
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// TestSqliteBrokerMigrates opens queue databases left by older builds,
+// including ones created before the schema version was kept, and checks
+// they are brought up to date without losing queued messages.
+func TestSqliteBrokerMigrates(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup []string
+	}{
+		{"new database", nil},
+		{"first schema", []string{
+			sqliteMigrations[0],
+			`INSERT INTO queues (name) VALUES ('q')`,
+			`INSERT INTO messages (queue, body) VALUES ('q', 'old')`,
+		}},
+		{"unversioned current schema", []string{
+			sqliteMigrations[0], sqliteMigrations[1], sqliteMigrations[2],
+			`INSERT INTO queues (name) VALUES ('q')`,
+			`INSERT INTO messages (queue, correlation_id, message_id, body) VALUES ('q', 'run', 'm0', 'old')`,
+		}},
+		{"versioned second schema", []string{
+			sqliteMigrations[0], sqliteMigrations[1],
+			`INSERT INTO queues (name) VALUES ('q')`,
+			`INSERT INTO messages (queue, body) VALUES ('q', 'old')`,
+			`PRAGMA user_version = 2`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "queue.db")
+			if tt.setup != nil {
+				db, err := sql.Open("sqlite", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, stmt := range tt.setup {
+					if _, err := db.Exec(stmt); err != nil {
+						t.Fatalf("%s: %v", stmt, err)
+					}
+				}
+				db.Close()
+			}
+
+			// Opening twice checks a migrated database is left alone.
+			for i := 0; i < 2; i++ {
+				b, err := NewSqliteBroker(&Config{QueueDBPath: path}, zap.NewNop())
+				if err != nil {
+					t.Fatal(err)
+				}
+				var version int
+				if err := b.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+					t.Fatal(err)
+				}
+				if version != len(sqliteMigrations) {
+					t.Errorf("user_version = %d, want %d", version, len(sqliteMigrations))
+				}
+				b.Close()
+			}
+
+			b, err := NewSqliteBroker(&Config{QueueDBPath: path}, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+			if err := b.DeclareQueue("q", QueueOptions{DeadLetter: "dl"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Publish(context.Background(), "q", Message{CorrelationID: "run", MessageID: "m1", Body: []byte("new")}); err != nil {
+				t.Fatal(err)
+			}
+
+			msgs, err := b.Consume("q", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.setup != nil {
+				if d := receive(t, msgs); string(d.Body) != "old" {
+					t.Errorf("first delivery = %q, want the message queued before the migration", d.Body)
+				}
+			}
+			d := receive(t, msgs)
+			if string(d.Body) != "new" || d.CorrelationID != "run" || d.MessageID != "m1" {
+				t.Errorf("delivery = %+v, want m1 with correlation id run", d.Message)
+			}
+		})
+	}
+}
@@ -1,61 +1,116 @@
-package rabbitmq
-
-import "io"
-
-type Config struct {
-	AmqpUser    string
-	AmqpPass    string
-	AmqpHost    string
-	AmqpPort    string
-	JsonDirPath string
-}
-
-type PicklistQueueRequest struct {
-	Method      string        `json:"Method"`
-	Url         string        `json:"Url"`
-	Body        io.Reader     `json:"Body"`
-	AccessToken string        `json:"AccessToken"`
-	CustomObj   CustomRecords `json:"record"`
-	RecordType  string        `json:"recordType"`
-}
-
-type EquipmentRecord struct {
-	ProgName    string `json:"Program_Name__c"`
-	MeasureName string `json:"Measure_Description__c"`
-	PicklistVal string `json:"Equipment_Type__c"`
-}
-
-type RecommendationRecord struct {
-	ProgName    string `json:"Program_Name__c"`
-	MeasureName string `json:"Measure_Description__c"`
-	PicklistVal string `json:"Recommendation__c"`
-}
-
-type EquipmentRecords []EquipmentRecord
-
-type RecommendationRecords []RecommendationRecord
-
-type PicklistMappedResp struct {
-	Eqs  EquipmentRecords      `json:"equipment_records,omitempty"`
-	Recs RecommendationRecords `json:"recommendation_records,omitempty"`
-}
-
-type PicklistQueryResponse struct {
-	PicklistValues []PicklistValue `json:"Values"`
-}
-
-type PicklistValue struct {
-	PickValues string `json:"value"`
-}
-
-type CustomRecords struct {
-	Id             string        `json:"Id"`
-	MeasureNameNew string        `json:"Measure_Name_New__c,omitempty"`
-	RecTypeName    string        `json:"Record_Type_Name__c,omitempty"`
-	RecTypeId      string        `json:"Record_Type_Id__c,omitempty"`
-	ProgRec        ProgramRecord `json:"Program__r,omitempty"`
-}
-
-type ProgramRecord struct {
-	Name string `json:"Name,omitempty"`
-}
+package rabbitmq
+
+import "time"
+
+type Config struct {
+	Broker        string
+	AmqpUser      string
+	AmqpPass      string
+	AmqpHost      string
+	AmqpPort      string
+	NatsURL       string
+	QueueDBPath   string
+	JsonDirPath   string
+	DependencyDir string
+	MaxRetries    int
+	RetryDelay    time.Duration
+	Workers       int
+	Prefetch      int
+}
+
+// PicklistQueueRequest describes which picklist to read, not how to read it.
+// The worker builds the ui-api url and authenticates with its own credentials.
+type PicklistQueueRequest struct {
+	// RunID is the mapping run that published the request. The worker only
+	// reports results for requests that carry one.
+	RunID      string        `json:"runId,omitempty"`
+	SObject    string        `json:"sObject"`
+	FieldName  string        `json:"fieldName"`
+	CustomObj  CustomRecords `json:"record"`
+	RecordType string        `json:"recordType"`
+	// ControllingValue is the record's value of the controlling field when
+	// FieldName is a dependent picklist.
+	ControllingValue string `json:"controllingValue,omitempty"`
+	Attempts         int    `json:"attempts,omitempty"`
+	LastError        string `json:"lastError,omitempty"`
+}
+
+// PicklistQueryResult reports the outcome of one request back to the run
+// that published it, identified by RunID. It is sent once per request: after
+// the mapping rows are saved, or when the request is dead-lettered.
+type PicklistQueryResult struct {
+	RunID string `json:"runId"`
+	// RequestID is the MessageID of the request, which it keeps across
+	// retries, so each published request is counted once.
+	RequestID  string             `json:"requestId,omitempty"`
+	RecordID   string             `json:"recordId"`
+	RecordType string             `json:"recordType"`
+	Succeeded  bool               `json:"succeeded"`
+	Error      string             `json:"error,omitempty"`
+	Mappings   PicklistMappedResp `json:"mappings"`
+}
+
+type EquipmentRecord struct {
+	ProgName    string `json:"Program_Name__c"`
+	MeasureName string `json:"Measure_Description__c"`
+	PicklistVal string `json:"Equipment_Type__c"`
+}
+
+type RecommendationRecord struct {
+	ProgName    string `json:"Program_Name__c"`
+	MeasureName string `json:"Measure_Description__c"`
+	PicklistVal string `json:"Recommendation__c"`
+}
+
+type EquipmentRecords []EquipmentRecord
+
+type RecommendationRecords []RecommendationRecord
+
+// MappingRecord is a mapping row for a category defined by a classification
+// rule other than the built-in Recommendation and Direct Install ones.
+type MappingRecord struct {
+	RecordType  string `json:"recordType"`
+	ProgName    string `json:"Program_Name__c"`
+	MeasureName string `json:"Measure_Description__c"`
+	PicklistVal string `json:"value"`
+}
+
+type MappingRecords []MappingRecord
+
+type PicklistMappedResp struct {
+	Eqs   EquipmentRecords      `json:"equipment_records,omitempty"`
+	Recs  RecommendationRecords `json:"recommendation_records,omitempty"`
+	Other MappingRecords        `json:"other_records,omitempty"`
+}
+
+// PicklistQueryResponse holds the values of one picklist field. For a
+// dependent picklist ControllerValues maps each controlling field value to
+// the index used in PicklistValue.ValidFor.
+type PicklistQueryResponse struct {
+	ControllerValues map[string]int  `json:"controllerValues"`
+	PicklistValues   []PicklistValue `json:"Values"`
+}
+
+// PicklistRecordTypeResponse is the ui-api picklist-values response for a
+// record type, holding the values of every picklist field on the object.
+type PicklistRecordTypeResponse struct {
+	PicklistFieldValues map[string]PicklistQueryResponse `json:"picklistFieldValues"`
+}
+
+type PicklistValue struct {
+	PickValues string `json:"value"`
+	Label      string `json:"label"`
+	ValidFor   []int  `json:"validFor"`
+}
+
+type CustomRecords struct {
+	Id             string        `json:"Id"`
+	MeasureNameNew string        `json:"Measure_Name_New__c,omitempty"`
+	RecTypeName    string        `json:"Record_Type_Name__c,omitempty"`
+	RecTypeId      string        `json:"Record_Type_Id__c,omitempty"`
+	ProgRec        ProgramRecord `json:"Program__r,omitempty"`
+}
+
+type ProgramRecord struct {
+	Name string `json:"Name,omitempty"`
+}
@@ -0,0 +1,10 @@
+module github.com/AmitSuresh/sfdataapp/salesforce
+
+go 1.22.4
+
+require (
+	github.com/golang-jwt/jwt/v5 v5.2.1
+	go.uber.org/zap v1.27.0
+)
+
+require go.uber.org/multierr v1.10.0 // indirect
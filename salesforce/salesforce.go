@@ -0,0 +1,282 @@
+package salesforce
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+)
+
+const defaultAPIVersion = "58.0"
+
+var (
+	ErrEndpointNotAllowed = errors.New("salesforce endpoint is not allowed")
+	ErrInvalidName        = errors.New("invalid salesforce name")
+
+	apiNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+	idPattern      = regexp.MustCompile(`^[A-Za-z0-9]{15}([A-Za-z0-9]{3})?$`)
+)
+
+// ConfigFromEnv reads the same variables the web server uses for its JWT
+// bearer flow. sfAllowedPaths is a comma separated list of path patterns in
+// path.Match syntax.
+func ConfigFromEnv() *Config {
+	cfg := &Config{
+		ClientID:    os.Getenv("clientID"),
+		Username:    os.Getenv("username"),
+		InstanceURL: os.Getenv("instanceURL"),
+		SfEnv:       os.Getenv("sfEnv"),
+		KeyPath:     os.Getenv("keyPath"),
+		APIVersion:  strings.TrimPrefix(os.Getenv("version"), "v"),
+	}
+	if cfg.APIVersion == "" {
+		cfg.APIVersion = defaultAPIVersion
+	}
+	for _, p := range strings.Split(os.Getenv("sfAllowedPaths"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			cfg.AllowedPaths = append(cfg.AllowedPaths, p)
+		}
+	}
+	return cfg
+}
+
+// Client authenticates with the JWT bearer flow, caches the access token and
+// refreshes it when Salesforce rejects it. When cfg.AllowedPaths is set only
+// matching endpoints on the configured instance can be called.
+type Client struct {
+	cfg    *Config
+	base   *url.URL
+	client *http.Client
+	l      *zap.Logger
+
+	mu    sync.Mutex
+	token string
+}
+
+func NewClient(cfg *Config, client *http.Client, l *zap.Logger) (*Client, error) {
+	base, err := url.Parse(cfg.InstanceURL)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme == "" || base.Host == "" {
+		return nil, fmt.Errorf("instanceURL %q is not an absolute url", cfg.InstanceURL)
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &Client{cfg: cfg, base: base, client: client, l: l}, nil
+}
+
+// DataURL returns the REST API url for p, e.g. "ui-api/object-info/Account".
+func (c *Client) DataURL(p string) string {
+	return fmt.Sprintf("%s/services/data/v%s/%s", strings.TrimRight(c.cfg.InstanceURL, "/"), c.cfg.APIVersion, strings.TrimLeft(p, "/"))
+}
+
+// ValidateName rejects object and field API names that could alter a url path.
+func ValidateName(name string) error {
+	if !apiNamePattern.MatchString(name) {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	return nil
+}
+
+// ValidateID rejects anything that is not a 15 or 18 character record id.
+func ValidateID(id string) error {
+	if !idPattern.MatchString(id) {
+		return fmt.Errorf("%w: %q", ErrInvalidName, id)
+	}
+	return nil
+}
+
+// Query runs soql and calls fn with every page of records, following
+// nextRecordsUrl until Salesforce reports the result done.
+func (c *Client) Query(ctx context.Context, soql string, fn func(records []json.RawMessage) error) error {
+	next := c.DataURL("query?q=" + url.QueryEscape(soql))
+	for next != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, next, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := c.Do(req)
+		if err != nil {
+			return err
+		}
+		page := new(QueryResult)
+		err = func() error {
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+				return fmt.Errorf("query failed with status: %s: %s", resp.Status, body)
+			}
+			return FromJSON(page, resp.Body)
+		}()
+		if err != nil {
+			return err
+		}
+
+		if err := fn(page.Records); err != nil {
+			return err
+		}
+
+		next = ""
+		if !page.Done && page.NextRecordsURL != "" {
+			next = strings.TrimRight(c.cfg.InstanceURL, "/") + page.NextRecordsURL
+		}
+	}
+	return nil
+}
+
+func (c *Client) allowed(u *url.URL) bool {
+	if !strings.EqualFold(u.Scheme, c.base.Scheme) || !strings.EqualFold(u.Host, c.base.Host) {
+		return false
+	}
+	if len(c.cfg.AllowedPaths) == 0 {
+		return true
+	}
+	for _, p := range c.cfg.AllowedPaths {
+		if ok, _ := path.Match(p, u.EscapedPath()); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Do sends req with a bearer token. A 401 response triggers one token refresh
+// and retry when the request body can be replayed.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	if !c.allowed(req.URL) {
+		return nil, fmt.Errorf("%w: %s %s", ErrEndpointNotAllowed, req.Method, req.URL.Redacted())
+	}
+
+	token, err := c.Token(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := c.client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	c.l.Info("salesforce token rejected, refreshing")
+	token, err = c.refresh(req.Context(), token)
+	if err != nil {
+		return nil, err
+	}
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	retry.Header.Set("Authorization", "Bearer "+token)
+	return c.client.Do(retry)
+}
+
+// Token returns the cached access token, requesting one if needed.
+func (c *Client) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	token := c.token
+	c.mu.Unlock()
+	if token != "" {
+		return token, nil
+	}
+	return c.refresh(ctx, "")
+}
+
+// refresh requests a new token unless another caller already replaced stale.
+func (c *Client) refresh(ctx context.Context, stale string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && c.token != stale {
+		return c.token, nil
+	}
+
+	assertion, err := c.createJWT()
+	if err != nil {
+		return "", err
+	}
+
+	data := url.Values{}
+	data.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	data.Set("assertion", assertion)
+
+	tokenURL := strings.TrimRight(c.cfg.InstanceURL, "/") + "/services/oauth2/token"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("token request failed with status: %s: %s", resp.Status, body)
+	}
+
+	tr := new(tokenResponse)
+	if err := FromJSON(tr, resp.Body); err != nil {
+		return "", err
+	}
+	if tr.AccessToken == "" {
+		return "", errors.New("token response has no access_token")
+	}
+
+	c.token = tr.AccessToken
+	return c.token, nil
+}
+
+func (c *Client) createJWT() (string, error) {
+	keyData, err := os.ReadFile(c.cfg.KeyPath)
+	if err != nil {
+		return "", err
+	}
+
+	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(keyData)
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss": c.cfg.ClientID,
+		"sub": c.cfg.Username,
+		"aud": fmt.Sprintf("https://%s.salesforce.com", c.cfg.SfEnv),
+		"exp": time.Now().Add(3 * time.Minute).Unix(),
+	})
+	return token.SignedString(privateKey)
+}
+
+func ToJSON(i interface{}, w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(i)
+}
+
+func FromJSON(i interface{}, r io.Reader) error {
+	d := json.NewDecoder(r)
+	return d.Decode(i)
+}
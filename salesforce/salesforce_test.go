@@ -0,0 +1,153 @@
+package salesforce
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AmitSuresh/sfdataapp/salesforce/sftest"
+	"go.uber.org/zap"
+)
+
+// testClient returns a client for a fake Salesforce that issues token-1,
+// token-2, ... and serves api with the Authorization header it received.
+func testClient(t *testing.T, allowed []string, api http.HandlerFunc) (*Client, *atomic.Int32) {
+	t.Helper()
+	var issued atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/services/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"access_token":"token-%d"}`, issued.Add(1))
+	})
+	mux.HandleFunc("/services/data/", api)
+	sf := httptest.NewServer(mux)
+	t.Cleanup(sf.Close)
+
+	c, err := NewClient(&Config{
+		InstanceURL:  sf.URL,
+		SfEnv:        "test",
+		KeyPath:      sftest.KeyFile(t, t.TempDir()),
+		APIVersion:   defaultAPIVersion,
+		AllowedPaths: allowed,
+	}, sf.Client(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, &issued
+}
+
+func TestClientRefreshesRejectedToken(t *testing.T) {
+	c, issued := testClient(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token-2" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+
+	req, _ := http.NewRequest(http.MethodGet, c.DataURL("sobjects"), nil)
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200 after refreshing the token", resp.StatusCode)
+	}
+	if n := issued.Load(); n != 2 {
+		t.Errorf("%d tokens issued, want 2", n)
+	}
+}
+
+func TestClientAllowedPaths(t *testing.T) {
+	c, _ := testClient(t, []string{"/services/data/v*/ui-api/object-info/*/picklist-values/*/*"}, func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{c.DataURL("ui-api/object-info/Measure__c/picklist-values/012000000000001AAA/Type__c"), true},
+		{c.DataURL("sobjects/Measure__c"), false},
+		{c.DataURL("ui-api/object-info/Measure__c/picklist-values/012000000000001AAA/Type__c/extra"), false},
+		{"https://example.com/services/data/v58.0/ui-api/object-info/A/picklist-values/B/C", false},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+		resp, err := c.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if got := !errors.Is(err, ErrEndpointNotAllowed); got != tt.allowed {
+			t.Errorf("Do(%s) error = %v, want allowed %v", tt.url, err, tt.allowed)
+		}
+	}
+}
+
+func TestClientQueryFollowsNextRecordsURL(t *testing.T) {
+	var queries []string
+	c, _ := testClient(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/services/data/v" + defaultAPIVersion + "/query":
+			queries = append(queries, r.URL.Query().Get("q"))
+			fmt.Fprint(w, `{"totalSize":3,"done":false,"nextRecordsUrl":"/services/data/v`+defaultAPIVersion+`/query/01g-2000","records":[{"Id":"a1"},{"Id":"a2"}]}`)
+		case "/services/data/v" + defaultAPIVersion + "/query/01g-2000":
+			fmt.Fprint(w, `{"totalSize":3,"done":true,"records":[{"Id":"a3"}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	var pages []int
+	soql := "SELECT Id FROM Measure__c WHERE Name = 'A&B'"
+	err := c.Query(context.Background(), soql, func(records []json.RawMessage) error {
+		pages = append(pages, len(records))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pages, []int{2, 1}) {
+		t.Errorf("pages = %v, want [2 1]", pages)
+	}
+	if !reflect.DeepEqual(queries, []string{soql}) {
+		t.Errorf("queries = %q, want %q", queries, soql)
+	}
+}
+
+func TestClientQueryError(t *testing.T) {
+	c, _ := testClient(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `[{"errorCode":"MALFORMED_QUERY"}]`, http.StatusBadRequest)
+	})
+
+	err := c.Query(context.Background(), "SELECT", func([]json.RawMessage) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "MALFORMED_QUERY") {
+		t.Errorf("Query error = %v, want the response body", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, name := range []string{"Account", "Measure__c", "Program__r"} {
+		if err := ValidateName(name); err != nil {
+			t.Errorf("ValidateName(%q) = %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "Account/../x", "a b", "1Field"} {
+		if err := ValidateName(name); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("ValidateName(%q) = %v, want ErrInvalidName", name, err)
+		}
+	}
+	for _, id := range []string{"012000000000001", "012000000000001AAA"} {
+		if err := ValidateID(id); err != nil {
+			t.Errorf("ValidateID(%q) = %v", id, err)
+		}
+	}
+	for _, id := range []string{"", "0120000000000", "012000000000001AA", "../../sobjects"} {
+		if err := ValidateID(id); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("ValidateID(%q) = %v, want ErrInvalidName", id, err)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package salesforce
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMaxQueryLength is the longest a query may be once url encoded. It
+// leaves room for the /services/data/vXX.X/query?q= path within the REST
+// API's 16,384 character URI limit. SOQL itself allows 100,000 characters.
+const DefaultMaxQueryLength = 16000
+
+var ErrInvalidQuery = errors.New("invalid soql query")
+
+var soqlOperators = map[string]bool{
+	"=": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+	"LIKE": true, "IN": true, "NOT IN": true,
+}
+
+// Query describes a SOQL query. Values are written as escaped literals, never
+// spliced in as text. InField and InValues add an IN condition whose values
+// are split across as many queries as needed to keep each one under
+// MaxLength characters once url encoded; OrderBy then applies within each
+// query.
+type Query struct {
+	Object    string        `json:"object"`
+	Fields    []string      `json:"fields"`
+	Where     []Condition   `json:"where,omitempty"`
+	InField   string        `json:"inField,omitempty"`
+	InValues  []interface{} `json:"inValues,omitempty"`
+	OrderBy   []Order       `json:"orderBy,omitempty"`
+	Limit     int           `json:"limit,omitempty"`
+	MaxLength int           `json:"-"`
+}
+
+// Condition compares Field with Value. IN and NOT IN take a list of values.
+type Condition struct {
+	Field string      `json:"field"`
+	Op    string      `json:"op"`
+	Value interface{} `json:"value"`
+}
+
+type Order struct {
+	Field string `json:"field"`
+	Desc  bool   `json:"desc,omitempty"`
+}
+
+// Build returns the SOQL statements for q. Without InField there is exactly
+// one; with an empty InValues there are none, as no record can match.
+func (q *Query) Build() ([]string, error) {
+	maxLen := q.MaxLength
+	if maxLen <= 0 {
+		maxLen = DefaultMaxQueryLength
+	}
+
+	head, tail, err := q.parts()
+	if err != nil {
+		return nil, err
+	}
+
+	if q.InField == "" {
+		soql := head + tail
+		if n := encodedLen(soql); n > maxLen {
+			return nil, fmt.Errorf("%w: query is %d characters url encoded, the limit is %d", ErrInvalidQuery, n, maxLen)
+		}
+		return []string{soql}, nil
+	}
+
+	literals, err := uniqueLiterals(q.InValues)
+	if err != nil {
+		return nil, err
+	}
+
+	// head ends with "<InField> IN (" and tail starts with ")". Sizes are
+	// counted url encoded, where quotes, commas and non-ASCII characters
+	// take several characters each.
+	var queries []string
+	var chunk []string
+	base := encodedLen(head) + encodedLen(tail)
+	size := base
+	for _, lit := range literals {
+		add := encodedLen(lit)
+		if len(chunk) > 0 {
+			add += encodedLen(",")
+		}
+		if len(chunk) > 0 && size+add > maxLen {
+			queries = append(queries, head+strings.Join(chunk, ",")+tail)
+			chunk, size, add = nil, base, encodedLen(lit)
+		}
+		if size+add > maxLen {
+			return nil, fmt.Errorf("%w: a %d character value does not fit in a %d character query", ErrInvalidQuery, add, maxLen)
+		}
+		chunk = append(chunk, lit)
+		size += add
+	}
+	if len(chunk) > 0 {
+		queries = append(queries, head+strings.Join(chunk, ",")+tail)
+	}
+	return queries, nil
+}
+
+// encodedLen is the length of s in the q parameter of a query url.
+func encodedLen(s string) int {
+	return len(url.QueryEscape(s))
+}
+
+// parts renders the query around the IN list.
+func (q *Query) parts() (string, string, error) {
+	if err := ValidateName(q.Object); err != nil {
+		return "", "", err
+	}
+	if len(q.Fields) == 0 {
+		return "", "", fmt.Errorf("%w: no fields selected", ErrInvalidQuery)
+	}
+	for _, f := range q.Fields {
+		if err := validateField(f); err != nil {
+			return "", "", err
+		}
+	}
+
+	var head strings.Builder
+	fmt.Fprintf(&head, "SELECT %s FROM %s", strings.Join(q.Fields, ", "), q.Object)
+
+	var where []string
+	for _, c := range q.Where {
+		s, err := c.soql()
+		if err != nil {
+			return "", "", err
+		}
+		where = append(where, s)
+	}
+	if q.InField != "" {
+		if err := validateField(q.InField); err != nil {
+			return "", "", err
+		}
+		where = append(where, q.InField+" IN (")
+	}
+	if len(where) > 0 {
+		head.WriteString(" WHERE " + strings.Join(where, " AND "))
+	}
+
+	var tail strings.Builder
+	if q.InField != "" {
+		tail.WriteString(")")
+	}
+	if len(q.OrderBy) > 0 {
+		var order []string
+		for _, o := range q.OrderBy {
+			if err := validateField(o.Field); err != nil {
+				return "", "", err
+			}
+			if o.Desc {
+				order = append(order, o.Field+" DESC")
+			} else {
+				order = append(order, o.Field+" ASC")
+			}
+		}
+		tail.WriteString(" ORDER BY " + strings.Join(order, ", "))
+	}
+	if q.Limit < 0 {
+		return "", "", fmt.Errorf("%w: negative limit", ErrInvalidQuery)
+	}
+	if q.Limit > 0 {
+		tail.WriteString(" LIMIT " + strconv.Itoa(q.Limit))
+	}
+	return head.String(), tail.String(), nil
+}
+
+func (c Condition) soql() (string, error) {
+	if err := validateField(c.Field); err != nil {
+		return "", err
+	}
+	op := strings.ToUpper(strings.TrimSpace(c.Op))
+	if !soqlOperators[op] {
+		return "", fmt.Errorf("%w: unsupported operator %q", ErrInvalidQuery, c.Op)
+	}
+
+	if op == "IN" || op == "NOT IN" {
+		values, ok := c.Value.([]interface{})
+		if !ok {
+			if s, isStrings := c.Value.([]string); isStrings {
+				for _, v := range s {
+					values = append(values, v)
+				}
+			} else {
+				return "", fmt.Errorf("%w: %s %s needs a list of values", ErrInvalidQuery, c.Field, op)
+			}
+		}
+		if len(values) == 0 {
+			return "", fmt.Errorf("%w: %s %s needs at least one value", ErrInvalidQuery, c.Field, op)
+		}
+		literals, err := uniqueLiterals(values)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %s (%s)", c.Field, op, strings.Join(literals, ",")), nil
+	}
+
+	lit, err := Literal(c.Value)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s %s", c.Field, op, lit), nil
+}
+
+// Literal renders v as a SOQL literal. Strings are quoted and escaped, times
+// become UTC datetimes and nil becomes null.
+func Literal(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case nil:
+		return "null", nil
+	case string:
+		return "'" + EscapeString(t) + "'", nil
+	case bool:
+		return strconv.FormatBool(t), nil
+	case int:
+		return strconv.Itoa(t), nil
+	case int64:
+		return strconv.FormatInt(t, 10), nil
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), nil
+	case json.Number:
+		if _, err := t.Float64(); err != nil {
+			return "", fmt.Errorf("%w: %q is not a number", ErrInvalidQuery, t)
+		}
+		return t.String(), nil
+	case time.Time:
+		return t.UTC().Format("2006-01-02T15:04:05Z"), nil
+	default:
+		return "", fmt.Errorf("%w: unsupported value type %T", ErrInvalidQuery, v)
+	}
+}
+
+// EscapeString escapes s for use inside a quoted SOQL string literal.
+func EscapeString(s string) string {
+	return soqlEscaper.Replace(s)
+}
+
+var soqlEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`'`, `\'`,
+	`"`, `\"`,
+	"\n", `\n`,
+	"\r", `\r`,
+	"\t", `\t`,
+	"\b", `\b`,
+	"\f", `\f`,
+)
+
+func uniqueLiterals(values []interface{}) ([]string, error) {
+	seen := make(map[string]bool, len(values))
+	literals := make([]string, 0, len(values))
+	for _, v := range values {
+		lit, err := Literal(v)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[lit] {
+			seen[lit] = true
+			literals = append(literals, lit)
+		}
+	}
+	return literals, nil
+}
+
+// validateField accepts field names and relationship paths such as
+// Measure_Calculation__r.Name.
+func validateField(field string) error {
+	for _, part := range strings.Split(field, ".") {
+		if err := ValidateName(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QueryAll runs every statement q builds and calls fn with each page of
+// records. A positive Limit caps the merged result rather than each chunk.
+func (c *Client) QueryAll(ctx context.Context, q *Query, fn func(records []json.RawMessage) error) error {
+	queries, err := q.Build()
+	if err != nil {
+		return err
+	}
+
+	remaining := q.Limit
+	for _, soql := range queries {
+		err := c.Query(ctx, soql, func(records []json.RawMessage) error {
+			if q.Limit > 0 {
+				if remaining <= 0 {
+					return nil
+				}
+				if len(records) > remaining {
+					records = records[:remaining]
+				}
+				remaining -= len(records)
+			}
+			return fn(records)
+		})
+		if err != nil {
+			return err
+		}
+		if q.Limit > 0 && remaining <= 0 {
+			break
+		}
+	}
+	return nil
+}
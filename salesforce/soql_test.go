@@ -0,0 +1,210 @@
+package salesforce
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLiteral(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+		err   error
+	}{
+		{"nil", nil, "null", nil},
+		{"string", "Acme", "'Acme'", nil},
+		{"quote", "O'Brien", `'O\'Brien'`, nil},
+		{"injection", "x' OR Name != '", `'x\' OR Name != \''`, nil},
+		{"backslash", `a\b`, `'a\\b'`, nil},
+		{"control characters", "a\nb\tc\r", `'a\nb\tc\r'`, nil},
+		{"bool", true, "true", nil},
+		{"int", 42, "42", nil},
+		{"int64", int64(-7), "-7", nil},
+		{"float", 1.5, "1.5", nil},
+		{"json number", json.Number("3.25"), "3.25", nil},
+		{"bad json number", json.Number("1 OR 1=1"), "", ErrInvalidQuery},
+		{"time", time.Date(2024, 3, 1, 12, 30, 0, 0, time.FixedZone("", 3600)), "2024-03-01T11:30:00Z", nil},
+		{"unsupported", struct{}{}, "", ErrInvalidQuery},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Literal(tt.value)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Literal(%v) error = %v, want %v", tt.value, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("Literal(%v) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryBuild(t *testing.T) {
+	tests := []struct {
+		name  string
+		query Query
+		want  []string
+		err   error
+	}{
+		{
+			name:  "fields only",
+			query: Query{Object: "Account", Fields: []string{"Id", "Name"}},
+			want:  []string{"SELECT Id, Name FROM Account"},
+		},
+		{
+			name: "conditions, order and limit",
+			query: Query{
+				Object:  "Measure_Calculation__c",
+				Fields:  []string{"Id", "Program__r.Name"},
+				Where:   []Condition{{Field: "Program__r.Name", Op: "=", Value: "P'1"}, {Field: "Sequence__c", Op: ">=", Value: 2}},
+				OrderBy: []Order{{Field: "Sequence__c"}, {Field: "Name", Desc: true}},
+				Limit:   10,
+			},
+			want: []string{"SELECT Id, Program__r.Name FROM Measure_Calculation__c WHERE Program__r.Name = 'P\\'1' AND Sequence__c >= 2 ORDER BY Sequence__c ASC, Name DESC LIMIT 10"},
+		},
+		{
+			name:  "condition with a list",
+			query: Query{Object: "Account", Fields: []string{"Id"}, Where: []Condition{{Field: "Type", Op: "not in", Value: []string{"a", "b", "a"}}}},
+			want:  []string{"SELECT Id FROM Account WHERE Type NOT IN ('a','b')"},
+		},
+		{
+			name:  "in values",
+			query: Query{Object: "Account", Fields: []string{"Id"}, InField: "Id", InValues: []interface{}{"1", "2"}},
+			want:  []string{"SELECT Id FROM Account WHERE Id IN ('1','2')"},
+		},
+		{
+			name:  "empty in values",
+			query: Query{Object: "Account", Fields: []string{"Id"}, InField: "Id", InValues: []interface{}{}},
+			want:  nil,
+		},
+		{
+			name:  "invalid object",
+			query: Query{Object: "Account WHERE", Fields: []string{"Id"}},
+			err:   ErrInvalidName,
+		},
+		{
+			name:  "invalid field",
+			query: Query{Object: "Account", Fields: []string{"Id, (SELECT Id FROM Contacts)"}},
+			err:   ErrInvalidName,
+		},
+		{
+			name:  "no fields",
+			query: Query{Object: "Account"},
+			err:   ErrInvalidQuery,
+		},
+		{
+			name:  "unsupported operator",
+			query: Query{Object: "Account", Fields: []string{"Id"}, Where: []Condition{{Field: "Name", Op: "INCLUDES", Value: "a"}}},
+			err:   ErrInvalidQuery,
+		},
+		{
+			name:  "in without a list",
+			query: Query{Object: "Account", Fields: []string{"Id"}, Where: []Condition{{Field: "Name", Op: "IN", Value: "a"}}},
+			err:   ErrInvalidQuery,
+		},
+		{
+			name:  "negative limit",
+			query: Query{Object: "Account", Fields: []string{"Id"}, Limit: -1},
+			err:   ErrInvalidQuery,
+		},
+		{
+			name:  "too long",
+			query: Query{Object: "Account", Fields: []string{"Id"}, Where: []Condition{{Field: "Name", Op: "=", Value: strings.Repeat("x", 100)}}, MaxLength: 50},
+			err:   ErrInvalidQuery,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.query.Build()
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Build() error = %v, want %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Build() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryBuildChunks(t *testing.T) {
+	head := "SELECT Id FROM Account WHERE Id IN ("
+	tail := ") ORDER BY Id ASC"
+	q := Query{
+		Object:   "Account",
+		Fields:   []string{"Id"},
+		InField:  "Id",
+		InValues: []interface{}{"aaaa", "bbbb", "cccc", "dddd", "eeee", "aaaa"},
+		OrderBy:  []Order{{Field: "Id"}},
+		// Room for exactly two quoted literals and their comma, which take
+		// 10 and 3 characters url encoded.
+		MaxLength: len(url.QueryEscape(head)) + len(url.QueryEscape(tail)) + 23,
+	}
+
+	got, err := q.Build()
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	want := []string{
+		head + "'aaaa','bbbb'" + tail,
+		head + "'cccc','dddd'" + tail,
+		head + "'eeee'" + tail,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Build() = %q, want %q", got, want)
+	}
+	for _, soql := range got {
+		if n := len(url.QueryEscape(soql)); n > q.MaxLength {
+			t.Errorf("%q is %d characters url encoded, longer than %d", soql, n, q.MaxLength)
+		}
+	}
+
+	q.InValues = []interface{}{strings.Repeat("x", 20)}
+	if _, err := q.Build(); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("Build() with a value that cannot fit: error = %v, want ErrInvalidQuery", err)
+	}
+}
+
+// TestQueryBuildChunksSpecialCharacters checks that chunks are sized by their
+// url encoded length, which literals with quotes, spaces, symbols and
+// non-ASCII characters make much longer than the SOQL itself.
+func TestQueryBuildChunksSpecialCharacters(t *testing.T) {
+	values := []interface{}{"O'Brien & Sons", "50% off", "a+b=c", "Café #1", "Ünïcödé", `back\slash`, "plain"}
+	q := Query{Object: "Account", Fields: []string{"Id"}, InField: "Name", InValues: values, MaxLength: 150}
+
+	got, err := q.Build()
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	all, err := (&Query{Object: "Account", Fields: []string{"Id"}, InField: "Name", InValues: values}).Build()
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	if len(all[0]) > q.MaxLength {
+		t.Fatalf("the values take %d characters before url encoding, want them to fit in one query", len(all[0]))
+	}
+	if len(got) < 2 {
+		t.Fatalf("Build() = %q, want the values split once url encoded", got)
+	}
+
+	joined := strings.Join(got, "\n")
+	for _, v := range values {
+		lit, err := Literal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(joined, lit); n != 1 {
+			t.Errorf("%s appears in %d queries, want 1", lit, n)
+		}
+	}
+	for _, soql := range got {
+		if n := len(url.QueryEscape(soql)); n > q.MaxLength {
+			t.Errorf("%q is %d characters url encoded, longer than %d", soql, n, q.MaxLength)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package salesforce
+
+import "encoding/json"
+
+type Config struct {
+	ClientID     string
+	Username     string
+	InstanceURL  string
+	SfEnv        string
+	KeyPath      string
+	APIVersion   string
+	AllowedPaths []string
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	InstanceURL string `json:"instance_url"`
+}
+
+// QueryResult is one page of a query response. Records are left undecoded
+// so callers can read any sObject.
+type QueryResult struct {
+	TotalSize      int               `json:"totalSize"`
+	Done           bool              `json:"done"`
+	NextRecordsURL string            `json:"nextRecordsUrl,omitempty"`
+	Records        []json.RawMessage `json:"records"`
+}
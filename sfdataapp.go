@@ -1,98 +1,148 @@
-package main
-
-import (
-	"context"
-	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
-	"time"
-
-	"github.com/AmitSuresh/sfdataapp/handlers"
-	rbmq "github.com/AmitSuresh/sfdataapp/rabbitmq"
-	"github.com/gorilla/mux"
-	"github.com/joho/godotenv"
-	"go.uber.org/zap"
-)
-
-const (
-	shutdownTime   = 15 * time.Second
-	httpServerAddr = "localhost:9090"
-)
-
-var (
-	clientID, clientSecret, username, instanceURL, sfEnv, keyPath, version string
-	rbmqCfg                                                                *rbmq.Config
-)
-
-func main() {
-	l, _ := zap.NewProduction()
-	defer l.Sync()
-
-	err := godotenv.Load()
-	if err != nil {
-		l.Error("error loading .env file")
-	}
-
-	clientID = os.Getenv("clientID")
-	clientSecret = os.Getenv("clientSecret")
-	username = os.Getenv("username")
-	instanceURL = os.Getenv("instanceURL")
-	sfEnv = os.Getenv("sfEnv")
-	keyPath = os.Getenv("keyPath")
-	version = os.Getenv("version")
-
-	c, err := rbmq.LoadConfig(l)
-	if err != nil {
-		l.Fatal("failed to load configuration", zap.Error(err))
-	}
-	rbmqCfg = c
-
-	h, err := handlers.GetHandler(clientID, clientSecret, username, instanceURL, version, keyPath, sfEnv, rbmqCfg, l)
-	if err != nil {
-		l.Fatal("error creating a new handler", zap.Error(err))
-	}
-
-	sm := mux.NewRouter()
-
-	pR := sm.PathPrefix("/api").Subrouter()
-	getR := pR.Methods(http.MethodGet).Subrouter()
-	getR.HandleFunc("/queryrecords", h.QueryRecords)
-	getR.HandleFunc("/querypicklist", h.GetPickBasedMappingRec)
-
-	postR := pR.Methods(http.MethodPost).Subrouter()
-	postR.HandleFunc("/insertmappedrecords", h.CreateMappedRecords)
-	postR.HandleFunc("/insertbulkmappedrecords", h.CreateBulkMappedRecords)
-
-	httpServer := &http.Server{
-		Addr:         httpServerAddr,
-		Handler:      sm,
-		IdleTimeout:  120 * time.Second,
-		ReadTimeout:  60 * time.Second,
-		WriteTimeout: 60 * time.Second,
-		ErrorLog:     zap.NewStdLog(l),
-	}
-
-	go func() {
-		l.Info("[INFO]", zap.Any("starting http server on: ", httpServerAddr))
-		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			l.Fatal("[ERROR] error starting server", zap.Error(err))
-		}
-	}()
-
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	<-sigChan
-
-	l.Info("Shutdown signal received, shutting down servers...")
-
-	ctx, cancel := context.WithTimeout(context.Background(), shutdownTime)
-	defer cancel()
-
-	if err := httpServer.Shutdown(ctx); err != nil {
-		l.Error("error during http server shutdown", zap.Error(err))
-	}
-
-	l.Info("server shutdown complete.")
-
-}
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/AmitSuresh/sfdataapp/files"
+	"github.com/AmitSuresh/sfdataapp/handlers"
+	rbmq "github.com/AmitSuresh/sfdataapp/rabbitmq"
+	"github.com/AmitSuresh/sfdataapp/salesforce"
+	"github.com/AmitSuresh/sfdataapp/store"
+	"github.com/gorilla/mux"
+	"github.com/joho/godotenv"
+	"go.uber.org/zap"
+)
+
+const (
+	shutdownTime   = 15 * time.Second
+	httpServerAddr = "localhost:9090"
+)
+
+var rbmqCfg *rbmq.Config
+
+func main() {
+	l, _ := zap.NewProduction()
+	defer l.Sync()
+
+	err := godotenv.Load()
+	if err != nil {
+		l.Error("error loading .env file")
+	}
+
+	// The server shares the worker's JWT settings. sfAllowedPaths only
+	// restricts the worker; the server calls the REST, UI, Tooling and Bulk
+	// APIs.
+	sfCfg := salesforce.ConfigFromEnv()
+	sfCfg.AllowedPaths = nil
+	sf, err := salesforce.NewClient(sfCfg, nil, l)
+	if err != nil {
+		l.Fatal("failed to create salesforce client", zap.Error(err))
+	}
+
+	c, err := rbmq.LoadConfig(l)
+	if err != nil {
+		l.Fatal("failed to load configuration", zap.Error(err))
+	}
+	rbmqCfg = c
+
+	broker, err := rbmq.NewBroker(rbmqCfg, l)
+	if err != nil {
+		l.Fatal("failed to connect to message broker", zap.Error(err))
+	}
+	defer broker.Close()
+
+	mappings, err := store.New(store.ConfigFromEnv(rbmqCfg.JsonDirPath), l)
+	if err != nil {
+		l.Fatal("failed to open mapping store", zap.Error(err))
+	}
+	defer mappings.Close()
+
+	rules, err := handlers.LoadClassificationRules(os.Getenv("classificationRules"))
+	if err != nil {
+		l.Fatal("failed to load classification rules", zap.Error(err))
+	}
+
+	// The mapping files and the queue's dependency matrices can be
+	// downloaded. Directories that are not set are not served, as an empty
+	// path would serve the working directory and its .env.
+	fileDirs := make(map[string]string)
+	if rbmqCfg.JsonDirPath != "" {
+		fileDirs[handlers.FilesMappings] = rbmqCfg.JsonDirPath
+	}
+	if rbmqCfg.DependencyDir != "" {
+		fileDirs[handlers.FilesDependencies] = rbmqCfg.DependencyDir
+	}
+	fileServer, err := files.NewServer("sfdataapp", fileDirs)
+	if err != nil {
+		l.Warn("no output directories are set, file downloads are disabled", zap.Error(err))
+		fileServer = nil
+	}
+
+	h, err := handlers.GetHandler(sf, broker, mappings, rules, fileServer, l)
+	if err != nil {
+		l.Fatal("error creating a new handler", zap.Error(err))
+	}
+
+	if err := h.ConsumePicklistResults(); err != nil {
+		l.Fatal("error consuming picklist results", zap.Error(err))
+	}
+
+	sm := mux.NewRouter()
+	sm.Use(h.Correlate)
+
+	pR := sm.PathPrefix("/api").Subrouter()
+	getR := pR.Methods(http.MethodGet).Subrouter()
+	getR.HandleFunc("/queryrecords", h.QueryRecords)
+	getR.HandleFunc("/querypicklist", h.GetPickBasedMappingRec)
+	getR.HandleFunc("/mappings", h.GetMappings)
+	getR.HandleFunc("/runs/{id}", h.GetRun)
+	if fileServer != nil {
+		getR.HandleFunc("/files", h.ListFiles)
+		getR.HandleFunc("/files/{path:.+}", h.DownloadFile)
+		getR.HandleFunc("/archive", h.Archive)
+	}
+
+	postR := pR.Methods(http.MethodPost).Subrouter()
+	postR.HandleFunc("/insertmappedrecords", h.CreateMappedRecords)
+	postR.HandleFunc("/insertbulkmappedrecords", h.CreateBulkMappedRecords)
+	postR.HandleFunc("/picklists/compare", h.ComparePicklist)
+	postR.HandleFunc("/picklists/values", h.ChangePicklistValues)
+	postR.HandleFunc("/query", h.RunQuery)
+
+	httpServer := &http.Server{
+		Addr:         httpServerAddr,
+		Handler:      sm,
+		IdleTimeout:  120 * time.Second,
+		ReadTimeout:  60 * time.Second,
+		WriteTimeout: 60 * time.Second,
+		ErrorLog:     zap.NewStdLog(l),
+	}
+
+	go func() {
+		l.Info("[INFO]", zap.Any("starting http server on: ", httpServerAddr))
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			l.Fatal("[ERROR] error starting server", zap.Error(err))
+		}
+	}()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	<-sigChan
+
+	l.Info("Shutdown signal received, shutting down servers...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTime)
+	defer cancel()
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		l.Error("error during http server shutdown", zap.Error(err))
+	}
+
+	l.Info("server shutdown complete.")
+
+}
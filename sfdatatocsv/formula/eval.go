@@ -0,0 +1,346 @@
+package formula
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Record holds the field values a formula reads. Values are nil, numbers,
+// strings or booleans. Names are matched exactly first and then without
+// regard to case, as Salesforce field names are.
+type Record map[string]interface{}
+
+func (r Record) Get(name string) (interface{}, bool) {
+	if v, ok := r[name]; ok {
+		return v, true
+	}
+	for k, v := range r {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// EvalError reports a formula that parsed but could not be evaluated for a
+// record, such as a division by zero or text where a number is needed.
+type EvalError struct {
+	Pos int
+	Msg string
+}
+
+func (e *EvalError) Error() string {
+	return fmt.Sprintf("error at %d: %s", e.Pos, e.Msg)
+}
+
+// Eval evaluates the formula against rec. Fields missing from rec are NULL.
+// The result is nil, a float64, a string or a bool.
+func (e *Expr) Eval(rec Record) (interface{}, error) {
+	return e.root.eval(rec)
+}
+
+// Bool reports whether v, the result of a condition, is true. NULL is false.
+func Bool(v interface{}) (bool, error) {
+	switch t := v.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return t, nil
+	case string:
+		if b, err := strconv.ParseBool(t); err == nil {
+			return b, nil
+		}
+	}
+	return false, fmt.Errorf("%s is not a boolean", describe(v))
+}
+
+type node interface {
+	eval(rec Record) (interface{}, error)
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(Record) (interface{}, error) {
+	return n.value, nil
+}
+
+type fieldNode struct {
+	name string
+	pos  int
+}
+
+func (n *fieldNode) eval(rec Record) (interface{}, error) {
+	v, _ := rec.Get(n.name)
+	v, err := normalize(v)
+	if err != nil {
+		return nil, &EvalError{Pos: n.pos, Msg: fmt.Sprintf("field %s: %v", n.name, err)}
+	}
+	return v, nil
+}
+
+// normalize converts the values decoded from JSON or set by callers to the
+// types formulas work with.
+func normalize(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case nil, string, bool, float64:
+		return v, nil
+	case json.Number:
+		return t.Float64()
+	case int:
+		return float64(t), nil
+	case int64:
+		return float64(t), nil
+	case float32:
+		return float64(t), nil
+	default:
+		return nil, fmt.Errorf("unsupported value type %T", v)
+	}
+}
+
+type unaryNode struct {
+	op      string
+	operand node
+	pos     int
+}
+
+func (n *unaryNode) eval(rec Record) (interface{}, error) {
+	v, err := n.operand.eval(rec)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		b, err := Bool(v)
+		if err != nil {
+			return nil, &EvalError{Pos: n.pos, Msg: err.Error()}
+		}
+		return !b, nil
+	}
+	f, err := number(v)
+	if err != nil {
+		return nil, &EvalError{Pos: n.pos, Msg: err.Error()}
+	}
+	if n.op == "-" {
+		return -f, nil
+	}
+	return f, nil
+}
+
+type binaryNode struct {
+	op          string
+	left, right node
+	pos         int
+}
+
+func (n *binaryNode) eval(rec Record) (interface{}, error) {
+	l, err := n.left.eval(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "&&", "||":
+		lb, err := Bool(l)
+		if err != nil {
+			return nil, n.error(err)
+		}
+		if lb == (n.op == "||") {
+			return lb, nil
+		}
+		r, err := n.right.eval(rec)
+		if err != nil {
+			return nil, err
+		}
+		rb, err := Bool(r)
+		if err != nil {
+			return nil, n.error(err)
+		}
+		return rb, nil
+	}
+
+	r, err := n.right.eval(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "&":
+		return text(l) + text(r), nil
+	case "=", "==":
+		return equal(l, r), nil
+	case "!=", "<>":
+		return !equal(l, r), nil
+	case "<", "<=", ">", ">=":
+		c, ok, err := compare(l, r)
+		if err != nil {
+			return nil, n.error(err)
+		}
+		if !ok {
+			return false, nil
+		}
+		switch n.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	}
+
+	if l == nil || r == nil {
+		return nil, nil
+	}
+	if n.op == "+" {
+		ls, lok := l.(string)
+		rs, rok := r.(string)
+		if lok && rok {
+			return ls + rs, nil
+		}
+	}
+	a, err := number(l)
+	if err != nil {
+		return nil, n.error(err)
+	}
+	b, err := number(r)
+	if err != nil {
+		return nil, n.error(err)
+	}
+	switch n.op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return nil, n.error(fmt.Errorf("division by zero"))
+		}
+		return a / b, nil
+	default: // ^
+		return finite(math.Pow(a, b), n.pos)
+	}
+}
+
+func (n *binaryNode) error(err error) error {
+	return &EvalError{Pos: n.pos, Msg: fmt.Sprintf("%s: %v", n.op, err)}
+}
+
+type callNode struct {
+	name string
+	fn   *function
+	args []node
+	pos  int
+}
+
+func (n *callNode) eval(rec Record) (interface{}, error) {
+	v, err := n.fn.eval(n, rec)
+	if err != nil {
+		if _, ok := err.(*EvalError); ok {
+			return nil, err
+		}
+		return nil, &EvalError{Pos: n.pos, Msg: fmt.Sprintf("%s: %v", n.name, err)}
+	}
+	return v, nil
+}
+
+// number converts v to a number. Text is accepted when it holds one.
+func number(v interface{}) (float64, error) {
+	switch t := v.(type) {
+	case float64:
+		return t, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+		if err == nil {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("%s is not a number", describe(v))
+}
+
+func text(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(t)
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+func describe(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return fmt.Sprintf("text %q", v)
+	case bool:
+		return fmt.Sprintf("boolean %v", v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func isBlank(v interface{}) bool {
+	s, ok := v.(string)
+	return v == nil || ok && strings.TrimSpace(s) == ""
+}
+
+// equal compares numbers numerically, also when one side is numeric text,
+// and everything else exactly. NULL equals NULL and blank text.
+func equal(a, b interface{}) bool {
+	if isBlank(a) || isBlank(b) {
+		return isBlank(a) && isBlank(b)
+	}
+	c, ok, err := compare(a, b)
+	if err == nil && ok {
+		return c == 0
+	}
+	return a == b
+}
+
+// compare orders two numbers or two texts. ok is false when either is NULL.
+func compare(a, b interface{}) (int, bool, error) {
+	if a == nil || b == nil {
+		return 0, false, nil
+	}
+	as, aText := a.(string)
+	bs, bText := b.(string)
+	if aText && bText {
+		return strings.Compare(as, bs), true, nil
+	}
+	x, err := number(a)
+	if err != nil {
+		return 0, false, err
+	}
+	y, err := number(b)
+	if err != nil {
+		return 0, false, err
+	}
+	switch {
+	case x < y:
+		return -1, true, nil
+	case x > y:
+		return 1, true, nil
+	}
+	return 0, true, nil
+}
+
+func finite(f float64, pos int) (interface{}, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, &EvalError{Pos: pos, Msg: "result is not a finite number"}
+	}
+	return f, nil
+}
@@ -0,0 +1,152 @@
+package formula
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	rec := Record{
+		"Quantity__c":     json.Number("4"),
+		"Price__c":        2.5,
+		"Name":            "Widget",
+		"Active__c":       true,
+		"Empty__c":        nil,
+		"Blank__c":        "",
+		"Measure__r.Name": "Revenue",
+		"Colors__c":       "Red;Blue",
+	}
+
+	tests := []struct {
+		src  string
+		want interface{}
+	}{
+		{"1 + 2 * 3", 7.0},
+		{"(1 + 2) * 3", 9.0},
+		{"2 ^ 3 ^ 2", 512.0},
+		{"-2 ^ 2", -4.0},
+		{"10 / 4", 2.5},
+		{"Quantity__c * Price__c", 10.0},
+		{"quantity__c + 1", 5.0},
+		{"Name & '-' & \"x\"", "Widget-x"},
+		{"Measure__r.Name", "Revenue"},
+		{"Missing__c", nil},
+		{"Empty__c + 1", nil},
+		{"1 = 1.0", true},
+		{"1 == 2", false},
+		{"'a' <> 'b'", true},
+		{"'a' != 'a'", false},
+		{"2 < 3 && 3 <= 3", true},
+		{"2 > 3 || !Active__c", false},
+		{"IF(Active__c, 'on', 'off')", "on"},
+		{"IF(Empty__c, 1, 2)", 2.0},
+		{"IF(TRUE, 1, 1 / 0)", 1.0},
+		{"CASE(Name, 'Gadget', 1, 'Widget', 2, 0)", 2.0},
+		{"CASE(Name, 'Gadget', 1, 0)", 0.0},
+		{"AND(TRUE, Active__c)", true},
+		{"OR(FALSE, FALSE)", false},
+		{"NOT(FALSE)", true},
+		{"ISBLANK(Blank__c)", true},
+		{"ISBLANK(Empty__c)", true},
+		{"ISBLANK(Name)", false},
+		{"BLANKVALUE(Empty__c, 5)", 5.0},
+		{"NULLVALUE(Quantity__c, 5)", 4.0},
+		{"MIN(3, Quantity__c, 7)", 3.0},
+		{"MAX(3, Quantity__c, 7)", 7.0},
+		{"ABS(-2)", 2.0},
+		{"FLOOR(2.7) + CEILING(2.1)", 5.0},
+		{"ROUND(2.345, 2)", 2.35},
+		{"MOD(7, 3)", 1.0},
+		{"TEXT(Quantity__c)", "4"},
+		{"VALUE('12.5')", 12.5},
+		{"LEN(Name)", 6.0},
+		{"UPPER(Name) & LOWER('B') & TRIM('  c ')", "WIDGETbc"},
+		{"CONTAINS(Name, 'dg')", true},
+		{"BEGINS(Name, 'Wi')", true},
+		{"ISPICKVAL(Name, 'Widget')", true},
+		{"INCLUDES(Colors__c, 'Blue')", true},
+		{"INCLUDES(Colors__c, 'Green')", false},
+		{"if(true, 'a', 'b')", "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			e, err := Parse(tt.src)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			got, err := e.Eval(rec)
+			if err != nil {
+				t.Fatalf("Eval: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Eval = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"1 2",
+		"'unterminated",
+		"1 # 2",
+		"UNKNOWN(1)",
+		"IF(TRUE, 1)",
+		"NOT(TRUE, FALSE)",
+		"ROUND(1)",
+		"MIN()",
+		"CASE(1, 2, 3)",
+		"CASE(Name, 'Gadget', 1, 'Widget', 2)",
+		"IF(TRUE, 1, 2",
+	}
+	for _, src := range tests {
+		t.Run(src, func(t *testing.T) {
+			_, err := Parse(src)
+			var se *SyntaxError
+			if !errors.As(err, &se) {
+				t.Fatalf("Parse(%q) error = %v, want a *SyntaxError", src, err)
+			}
+		})
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	rec := Record{"Name": "Widget", "Odd__c": struct{}{}}
+	tests := []string{
+		"1 / 0",
+		"MOD(1, 0)",
+		"Name * 2",
+		"Name > 1",
+		"IF(Name, 1, 2)",
+		"VALUE('abc')",
+		"Odd__c",
+		"SQRT(-1)",
+	}
+	for _, src := range tests {
+		t.Run(src, func(t *testing.T) {
+			e, err := Parse(src)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if v, err := e.Eval(rec); err == nil {
+				t.Errorf("Eval = %#v, want an error", v)
+			}
+		})
+	}
+}
+
+func TestFields(t *testing.T) {
+	e, err := Parse("IF(b__c > a__C, B__c, Measure__r.Name) & A__c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Measure__r.Name", "a__C", "b__c"}
+	if got := e.Fields(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Fields() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,279 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// function is a built-in. Arguments are passed unevaluated so that IF, CASE
+// and the logical functions only evaluate the branches they need. max is -1
+// when the function takes any number of arguments.
+type function struct {
+	min, max int
+	eval     func(c *callNode, rec Record) (interface{}, error)
+	// even is set when the number of arguments must be even.
+	even bool
+}
+
+// accepts reports whether the function can be called with n arguments.
+func (f *function) accepts(n int) bool {
+	return n >= f.min && (f.max < 0 || n <= f.max) && (!f.even || n%2 == 0)
+}
+
+func (f *function) arity() string {
+	switch {
+	case f.max < 0 && f.even:
+		return fmt.Sprintf("an even number of arguments, at least %d", f.min)
+	case f.max < 0:
+		return fmt.Sprintf("at least %d arguments", f.min)
+	case f.min == f.max && f.min == 1:
+		return "1 argument"
+	case f.min == f.max:
+		return fmt.Sprintf("%d arguments", f.min)
+	default:
+		return fmt.Sprintf("%d to %d arguments", f.min, f.max)
+	}
+}
+
+var functions map[string]*function
+
+func init() {
+	functions = map[string]*function{
+		"IF":         {3, 3, fnIf, false},
+		"CASE":       {4, -1, fnCase, true},
+		"AND":        {1, -1, fnAnd, false},
+		"OR":         {1, -1, fnOr, false},
+		"NOT":        {1, 1, fnNot, false},
+		"ISBLANK":    {1, 1, fnIsBlank, false},
+		"ISNULL":     {1, 1, fnIsBlank, false},
+		"BLANKVALUE": {2, 2, fnBlankValue, false},
+		"NULLVALUE":  {2, 2, fnBlankValue, false},
+		"MIN":        {1, -1, fnMin, false},
+		"MAX":        {1, -1, fnMax, false},
+		"ABS":        {1, 1, math1(math.Abs), false},
+		"FLOOR":      {1, 1, math1(math.Floor), false},
+		"CEILING":    {1, 1, math1(math.Ceil), false},
+		"SQRT":       {1, 1, math1(math.Sqrt), false},
+		"EXP":        {1, 1, math1(math.Exp), false},
+		"LN":         {1, 1, math1(math.Log), false},
+		"ROUND":      {2, 2, fnRound, false},
+		"MOD":        {2, 2, fnMod, false},
+		"TEXT":       {1, 1, fnText, false},
+		"VALUE":      {1, 1, fnValue, false},
+		"LEN":        {1, 1, fnLen, false},
+		"UPPER":      {1, 1, text1(strings.ToUpper), false},
+		"LOWER":      {1, 1, text1(strings.ToLower), false},
+		"TRIM":       {1, 1, text1(strings.TrimSpace), false},
+		"CONTAINS":   {2, 2, text2(strings.Contains), false},
+		"BEGINS":     {2, 2, text2(strings.HasPrefix), false},
+		"ISPICKVAL":  {2, 2, text2(func(a, b string) bool { return a == b }), false},
+		"INCLUDES":   {2, 2, text2(includes), false},
+	}
+}
+
+func (c *callNode) arg(i int, rec Record) (interface{}, error) {
+	return c.args[i].eval(rec)
+}
+
+func (c *callNode) boolArg(i int, rec Record) (bool, error) {
+	v, err := c.arg(i, rec)
+	if err != nil {
+		return false, err
+	}
+	return Bool(v)
+}
+
+// numArg evaluates argument i as a number. null is true when it is NULL.
+func (c *callNode) numArg(i int, rec Record) (f float64, null bool, err error) {
+	v, err := c.arg(i, rec)
+	if err != nil || v == nil {
+		return 0, v == nil, err
+	}
+	f, err = number(v)
+	return f, false, err
+}
+
+func fnIf(c *callNode, rec Record) (interface{}, error) {
+	b, err := c.boolArg(0, rec)
+	if err != nil {
+		return nil, err
+	}
+	if b {
+		return c.arg(1, rec)
+	}
+	return c.arg(2, rec)
+}
+
+// fnCase is CASE(expr, value1, result1, ..., else).
+func fnCase(c *callNode, rec Record) (interface{}, error) {
+	v, err := c.arg(0, rec)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i+1 < len(c.args); i += 2 {
+		w, err := c.arg(i, rec)
+		if err != nil {
+			return nil, err
+		}
+		if equal(v, w) {
+			return c.arg(i+1, rec)
+		}
+	}
+	return c.arg(len(c.args)-1, rec)
+}
+
+func fnAnd(c *callNode, rec Record) (interface{}, error) {
+	for i := range c.args {
+		b, err := c.boolArg(i, rec)
+		if err != nil || !b {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func fnOr(c *callNode, rec Record) (interface{}, error) {
+	for i := range c.args {
+		b, err := c.boolArg(i, rec)
+		if err != nil || b {
+			return b, err
+		}
+	}
+	return false, nil
+}
+
+func fnNot(c *callNode, rec Record) (interface{}, error) {
+	b, err := c.boolArg(0, rec)
+	return !b, err
+}
+
+func fnIsBlank(c *callNode, rec Record) (interface{}, error) {
+	v, err := c.arg(0, rec)
+	return isBlank(v), err
+}
+
+func fnBlankValue(c *callNode, rec Record) (interface{}, error) {
+	v, err := c.arg(0, rec)
+	if err != nil || !isBlank(v) {
+		return v, err
+	}
+	return c.arg(1, rec)
+}
+
+func fnMin(c *callNode, rec Record) (interface{}, error) {
+	return fold(c, rec, math.Min)
+}
+
+func fnMax(c *callNode, rec Record) (interface{}, error) {
+	return fold(c, rec, math.Max)
+}
+
+// fold combines numeric arguments. Any NULL argument makes the result NULL.
+func fold(c *callNode, rec Record, f func(a, b float64) float64) (interface{}, error) {
+	var acc float64
+	for i := range c.args {
+		n, null, err := c.numArg(i, rec)
+		if err != nil || null {
+			return nil, err
+		}
+		if i == 0 {
+			acc = n
+		} else {
+			acc = f(acc, n)
+		}
+	}
+	return acc, nil
+}
+
+func math1(f func(float64) float64) func(*callNode, Record) (interface{}, error) {
+	return func(c *callNode, rec Record) (interface{}, error) {
+		n, null, err := c.numArg(0, rec)
+		if err != nil || null {
+			return nil, err
+		}
+		return finite(f(n), c.pos)
+	}
+}
+
+// fnRound rounds half away from zero to the given number of decimal places.
+func fnRound(c *callNode, rec Record) (interface{}, error) {
+	n, null, err := c.numArg(0, rec)
+	if err != nil || null {
+		return nil, err
+	}
+	places, null, err := c.numArg(1, rec)
+	if err != nil || null {
+		return nil, err
+	}
+	p := math.Pow(10, math.Trunc(places))
+	return finite(math.Round(n*p)/p, c.pos)
+}
+
+func fnMod(c *callNode, rec Record) (interface{}, error) {
+	a, null, err := c.numArg(0, rec)
+	if err != nil || null {
+		return nil, err
+	}
+	b, null, err := c.numArg(1, rec)
+	if err != nil || null {
+		return nil, err
+	}
+	if b == 0 {
+		return nil, fmt.Errorf("division by zero")
+	}
+	return math.Mod(a, b), nil
+}
+
+func fnText(c *callNode, rec Record) (interface{}, error) {
+	v, err := c.arg(0, rec)
+	return text(v), err
+}
+
+func fnValue(c *callNode, rec Record) (interface{}, error) {
+	v, err := c.arg(0, rec)
+	if err != nil || isBlank(v) {
+		return nil, err
+	}
+	return number(v)
+}
+
+func fnLen(c *callNode, rec Record) (interface{}, error) {
+	v, err := c.arg(0, rec)
+	return float64(len([]rune(text(v)))), err
+}
+
+func text1(f func(string) string) func(*callNode, Record) (interface{}, error) {
+	return func(c *callNode, rec Record) (interface{}, error) {
+		v, err := c.arg(0, rec)
+		if err != nil || v == nil {
+			return nil, err
+		}
+		return f(text(v)), nil
+	}
+}
+
+func text2(f func(a, b string) bool) func(*callNode, Record) (interface{}, error) {
+	return func(c *callNode, rec Record) (interface{}, error) {
+		a, err := c.arg(0, rec)
+		if err != nil {
+			return nil, err
+		}
+		b, err := c.arg(1, rec)
+		if err != nil {
+			return nil, err
+		}
+		return f(text(a), text(b)), nil
+	}
+}
+
+// includes reports whether the multi-select picklist value s, whose values
+// are separated by semicolons, contains v.
+func includes(s, v string) bool {
+	for _, p := range strings.Split(s, ";") {
+		if p == v {
+			return true
+		}
+	}
+	return false
+}
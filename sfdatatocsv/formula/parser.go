@@ -0,0 +1,224 @@
+// Package formula parses and evaluates measure formulas. The syntax follows
+// Salesforce formulas: numbers, 'text' or "text", TRUE, FALSE and NULL,
+// field names such as Quantity__c or Measure__r.Name, the operators
+// + - * / ^ & = == != <> < <= > >= && || ! and functions such as IF, CASE,
+// AND, OR, NOT, ISBLANK, BLANKVALUE, MIN, MAX, ROUND and TEXT. Function and
+// field names are case-insensitive.
+package formula
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SyntaxError reports where a formula could not be parsed. Pos is a byte
+// offset into the formula.
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at %d: %s", e.Pos, e.Msg)
+}
+
+// Expr is a parsed formula.
+type Expr struct {
+	src    string
+	root   node
+	fields []string
+}
+
+// Parse parses src. Unknown functions and wrong argument counts are syntax
+// errors.
+func Parse(src string) (*Expr, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	if p.peek().kind == tokEOF {
+		return nil, &SyntaxError{Pos: 0, Msg: "empty formula"}
+	}
+	root, err := p.expr(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf("unexpected %s", t)}
+	}
+
+	e := &Expr{src: src, root: root}
+	seen := make(map[string]bool)
+	walk(root, func(n node) {
+		if f, ok := n.(*fieldNode); ok && !seen[strings.ToLower(f.name)] {
+			seen[strings.ToLower(f.name)] = true
+			e.fields = append(e.fields, f.name)
+		}
+	})
+	sort.Strings(e.fields)
+	return e, nil
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Fields returns the field names the formula references.
+func (e *Expr) Fields() []string {
+	return e.fields
+}
+
+type parser struct {
+	toks []token
+	i    int
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+// Binding powers, loosest first. ^ binds right to left.
+var infix = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"=":  3, "==": 3, "!=": 3, "<>": 3,
+	"<": 4, "<=": 4, ">": 4, ">=": 4,
+	"&": 5,
+	"+": 6, "-": 6,
+	"*": 7, "/": 7,
+	"^": 9,
+}
+
+const prefixPower = 8
+
+func (p *parser) expr(minPower int) (node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		power, ok := infix[t.text]
+		if t.kind != tokOp || !ok || power <= minPower {
+			return left, nil
+		}
+		p.next()
+		rightMin := power
+		if t.text == "^" {
+			rightMin = power - 1
+		}
+		right, err := p.expr(rightMin)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: t.text, left: left, right: right, pos: t.pos}
+	}
+}
+
+func (p *parser) unary() (node, error) {
+	t := p.peek()
+	if t.kind == tokOp && (t.text == "-" || t.text == "+" || t.text == "!") {
+		p.next()
+		operand, err := p.expr(prefixPower)
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: t.text, operand: operand, pos: t.pos}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf("invalid number %q", t.text)}
+		}
+		return &literalNode{value: f}, nil
+	case tokString:
+		return &literalNode{value: t.text}, nil
+	case tokLParen:
+		n, err := p.expr(0)
+		if err != nil {
+			return nil, err
+		}
+		if c := p.next(); c.kind != tokRParen {
+			return nil, &SyntaxError{Pos: c.pos, Msg: fmt.Sprintf("expected ) but found %s", c)}
+		}
+		return n, nil
+	case tokIdent:
+		if p.peek().kind == tokLParen {
+			return p.call(t)
+		}
+		switch strings.ToUpper(t.text) {
+		case "TRUE":
+			return &literalNode{value: true}, nil
+		case "FALSE":
+			return &literalNode{value: false}, nil
+		case "NULL":
+			return &literalNode{value: nil}, nil
+		}
+		return &fieldNode{name: t.text, pos: t.pos}, nil
+	default:
+		return nil, &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf("unexpected %s", t)}
+	}
+}
+
+func (p *parser) call(name token) (node, error) {
+	fn, ok := functions[strings.ToUpper(name.text)]
+	if !ok {
+		return nil, &SyntaxError{Pos: name.pos, Msg: fmt.Sprintf("unknown function %s", name.text)}
+	}
+	p.next() // (
+
+	var args []node
+	if p.peek().kind != tokRParen {
+		for {
+			arg, err := p.expr(0)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if p.peek().kind != tokComma {
+				break
+			}
+			p.next()
+		}
+	}
+	if c := p.next(); c.kind != tokRParen {
+		return nil, &SyntaxError{Pos: c.pos, Msg: fmt.Sprintf("expected , or ) but found %s", c)}
+	}
+
+	if !fn.accepts(len(args)) {
+		return nil, &SyntaxError{Pos: name.pos, Msg: fmt.Sprintf("%s takes %s", strings.ToUpper(name.text), fn.arity())}
+	}
+	return &callNode{name: strings.ToUpper(name.text), fn: fn, args: args, pos: name.pos}, nil
+}
+
+func walk(n node, f func(node)) {
+	f(n)
+	switch n := n.(type) {
+	case *unaryNode:
+		walk(n.operand, f)
+	case *binaryNode:
+		walk(n.left, f)
+		walk(n.right, f)
+	case *callNode:
+		for _, a := range n.args {
+			walk(a, f)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/AmitSuresh/sfdataapp/sfdatatocsv/formula"
+	"go.uber.org/zap"
+)
+
+const (
+	fieldMCFormula   = "CLR_CNI_Mesaure_Formula__c"
+	fieldMCLIFormula = "Measure_Formula__c"
+	fieldCondition   = "Condition__c"
+)
+
+var (
+	errInvalidFormula = errors.New("not evaluated, the calculation has formula errors")
+	errNoFormula      = errors.New("the calculation has no formula or line items")
+	errNoProgram      = errors.New("program is required")
+)
+
+// calcPlan is a Measure Calculation with its formulas parsed. A calculation
+// with line items takes the formula of the first line item whose condition
+// is true, trying the line item without a condition last. Otherwise its own
+// formula is used.
+type calcPlan struct {
+	mc      MeasureCalcRecords
+	formula *formula.Expr
+	items   []itemPlan
+	invalid bool
+}
+
+type itemPlan struct {
+	id        string
+	condition *formula.Expr
+	formula   *formula.Expr
+}
+
+// Evaluate runs the Measure Calculations of one program in Sequence order
+// against the posted sample records. Each calculated value is stored in the
+// calculation's field so later calculations can use it. Syntax errors and
+// references to unknown fields are reported once, before the results.
+func (h *Handler) Evaluate(w http.ResponseWriter, r *http.Request) {
+	p := new(EvaluateRequest)
+	d := json.NewDecoder(r.Body)
+	d.UseNumber()
+	if err := d.Decode(p); err != nil {
+		h.l.Error("error decoding", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Programs calculate the same fields, so their calculations cannot run
+	// in one sequence.
+	if p.Program == "" {
+		http.Error(w, errNoProgram.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, mc := range p.MeasureCalcs {
+		if mc.ProgramName != "" && mc.ProgramName != p.Program {
+			http.Error(w, fmt.Sprintf("measure calculation %s belongs to program %s, not %s", mc.Name, mc.ProgramName, p.Program), http.StatusBadRequest)
+			return
+		}
+	}
+
+	mcs, items, err := h.calcSources(r.Context(), p.Program, p.MeasureCalcs, p.LineItems)
+	if err != nil {
+		h.l.Error("error querying line items", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	records := make([]formula.Record, len(p.Records))
+	for i, rec := range p.Records {
+		records[i] = make(formula.Record)
+		flatten(records[i], "", rec)
+	}
+
+	plans, errs := planCalcs(mcs, items, knownFields(records, p.Fields))
+	resp := &EvaluateResponse{Errors: errs, Results: make([]EvaluateResult, 0, len(records))}
+	for _, rec := range records {
+		resp.Results = append(resp.Results, evaluate(plans, rec))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := ToJSON(resp, w); err != nil {
+		h.l.Error("error writing response", zap.Error(err))
+	}
+}
+
+// calcSources returns the posted calculations and line items. Without
+// calculations the indexed ones are used, only those of program if it is
+// set, and without line items theirs are queried when Salesforce is
+// configured.
+func (h *Handler) calcSources(ctx context.Context, program string, mcs []MeasureCalcRecords, items []MCLIRecords) ([]MeasureCalcRecords, []MCLIRecords, error) {
+	if len(mcs) == 0 {
+		mcs = h.mcIndex.list(program)
+	}
+	if len(items) > 0 || len(mcs) == 0 || h.sf == nil {
+		return mcs, items, nil
+	}
+	err := h.sf.QueryAll(ctx, mcliQuery(mcs), func(records []json.RawMessage) error {
+		for _, raw := range records {
+			var mcli MCLIRecords
+			if err := json.Unmarshal(raw, &mcli); err != nil {
+				return err
+			}
+			items = append(items, mcli)
+		}
+		return nil
+	})
+	return mcs, items, err
+}
+
+// isLookup reports whether a calculation's formula only says that its value
+// comes from its line items.
+func isLookup(src string) bool {
+	return strings.EqualFold(strings.TrimSpace(src), "Lookup")
+}
+
+// flatten copies rec into dst, naming the fields of related records as
+// Salesforce does, such as Measure__r.Name. Record attributes are dropped.
+func flatten(dst formula.Record, prefix string, rec map[string]interface{}) {
+	for k, v := range rec {
+		if k == "attributes" {
+			continue
+		}
+		if m, ok := v.(map[string]interface{}); ok {
+			flatten(dst, prefix+k+".", m)
+			continue
+		}
+		dst[prefix+k] = v
+	}
+}
+
+// knownFields returns the lower-cased names of the input fields.
+func knownFields(records []formula.Record, fields []string) map[string]bool {
+	known := make(map[string]bool)
+	for _, rec := range records {
+		for k := range rec {
+			known[strings.ToLower(k)] = true
+		}
+	}
+	for _, f := range fields {
+		known[strings.ToLower(f)] = true
+	}
+	return known
+}
+
+// planCalcs sorts the calculations by Sequence and parses their formulas.
+// Unless known is empty, fields that are neither known nor calculated by an
+// earlier calculation are reported.
+func planCalcs(mcs []MeasureCalcRecords, items []MCLIRecords, known map[string]bool) ([]calcPlan, []FormulaError) {
+	checkFields := len(known) > 0
+	mcs = append([]MeasureCalcRecords(nil), mcs...)
+	sort.SliceStable(mcs, func(i, j int) bool { return mcs[i].Sequence < mcs[j].Sequence })
+
+	byCalc := make(map[string][]MCLIRecords)
+	for _, li := range items {
+		if !li.IsDeleted {
+			byCalc[li.MeasureCalc] = append(byCalc[li.MeasureCalc], li)
+		}
+	}
+
+	var (
+		plans []calcPlan
+		errs  []FormulaError
+	)
+	for _, mc := range mcs {
+		if mc.IsDeleted {
+			continue
+		}
+		c := calcPlan{mc: mc}
+		parse := func(liID, field, src string) *formula.Expr {
+			fe := FormulaError{MeasureCalc: mc.Name, MeasureCalcID: mc.Id, LineItemID: liID, Field: field, Formula: src}
+			e, err := formula.Parse(src)
+			if err != nil {
+				c.invalid = true
+				fe.Error = err.Error()
+				var se *formula.SyntaxError
+				if errors.As(err, &se) {
+					fe.Pos = se.Pos
+				}
+				errs = append(errs, fe)
+				return nil
+			}
+			if checkFields {
+				for _, f := range e.Fields() {
+					if !known[strings.ToLower(f)] {
+						fe.UnknownFields = append(fe.UnknownFields, f)
+					}
+				}
+				if len(fe.UnknownFields) > 0 {
+					errs = append(errs, fe)
+				}
+			}
+			return e
+		}
+
+		var defaults []itemPlan
+		for _, li := range byCalc[mc.Id] {
+			ip := itemPlan{id: li.Id, formula: parse(li.Id, fieldMCLIFormula, li.Formula)}
+			if strings.TrimSpace(li.Condition) == "" {
+				defaults = append(defaults, ip)
+				continue
+			}
+			ip.condition = parse(li.Id, fieldCondition, li.Condition)
+			c.items = append(c.items, ip)
+		}
+		c.items = append(c.items, defaults...)
+		if len(c.items) == 0 && strings.TrimSpace(mc.Formula) != "" && !isLookup(mc.Formula) {
+			c.formula = parse("", fieldMCFormula, mc.Formula)
+		}
+
+		plans = append(plans, c)
+		if mc.FieldToCalc != "" {
+			known[strings.ToLower(mc.FieldToCalc)] = true
+		}
+	}
+	return plans, errs
+}
+
+// evaluate runs the calculations against a copy of in.
+func evaluate(plans []calcPlan, in formula.Record) EvaluateResult {
+	rec := make(formula.Record, len(in))
+	for k, v := range in {
+		rec[k] = v
+	}
+
+	res := EvaluateResult{Values: make(map[string]interface{}), Steps: make([]EvaluateStep, 0, len(plans))}
+	for _, c := range plans {
+		step := EvaluateStep{MeasureCalc: c.mc.Name, Field: c.mc.FieldToCalc}
+		v, liID, err := c.eval(rec)
+		step.LineItemID = liID
+		if err != nil {
+			step.Error = err.Error()
+		} else {
+			step.Value = v
+			if c.mc.FieldToCalc != "" {
+				rec[c.mc.FieldToCalc] = v
+				res.Values[c.mc.FieldToCalc] = v
+			}
+		}
+		res.Steps = append(res.Steps, step)
+	}
+	return res
+}
+
+// eval returns the calculated value and the id of the line item that
+// calculated it. When no line item's condition is true the value is NULL.
+func (c *calcPlan) eval(rec formula.Record) (interface{}, string, error) {
+	switch {
+	case c.invalid:
+		return nil, "", errInvalidFormula
+	case c.formula != nil:
+		v, err := c.formula.Eval(rec)
+		return v, "", err
+	case len(c.items) == 0:
+		return nil, "", errNoFormula
+	}
+
+	for _, ip := range c.items {
+		if ip.condition != nil {
+			v, err := ip.condition.Eval(rec)
+			if err != nil {
+				return nil, ip.id, err
+			}
+			ok, err := formula.Bool(v)
+			if err != nil {
+				return nil, ip.id, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		v, err := ip.formula.Eval(rec)
+		return v, ip.id, err
+	}
+	return nil, "", nil
+}
@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Export writes the records of any Salesforce query response, or of a SOQL
+// query it runs itself, to <csvDirPath>/<file>.<format>, replacing the file
+// unless mode=append. The format defaults to csv and run puts the file in
+// that run's directory. Relationship fields become
+// dotted columns such as Measure_Calculation__r.Name and columns keep the
+// order of the query's fields. The file name defaults to the sObject type of
+// the records.
+func (h *Handler) Export(w http.ResponseWriter, r *http.Request) {
+	p := new(ExportRequest)
+	if err := FromJSON(p, r.Body); err != nil {
+		h.l.Error("error decoding", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if p.Query != "" {
+		if h.sf == nil {
+			http.Error(w, errNoSalesforce.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		err := h.sf.Query(r.Context(), p.Query, func(records []json.RawMessage) error {
+			p.Records = append(p.Records, records...)
+			return nil
+		})
+		if err != nil {
+			h.l.Error("error running query", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	t, err := flattenRecords(p.Records)
+	if err != nil {
+		h.l.Error("error flattening records", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(r.URL.Query().Get("file"))
+	if name == "" {
+		name = t.sobject
+	}
+	if name == "" {
+		http.Error(w, "file is required for records without a type", http.StatusBadRequest)
+		return
+	}
+
+	sink, err := h.requestSink(r, ModeOverwrite)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := h.writeTable(sink, name, t)
+	if err != nil {
+		h.l.Error("error writing csv", zap.String("file", name), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.l.Info("exported records", zap.String("file", res.File), zap.Int("rows", res.Rows))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := ToJSON(res, w); err != nil {
+		h.l.Error("error writing response", zap.Error(err))
+	}
+}
+
+// writeTable writes t to name and closes sink. When appending to a file that
+// already has rows, its header is kept, so t should have the same columns.
+// Workbooks get a single sheet named after the sObject.
+func (h *Handler) writeTable(sink *exportSink, name string, t *table) (*ExportResult, error) {
+	ef, err := sink.open(name, "", t.columns)
+	if err != nil {
+		sink.Close()
+		return nil, err
+	}
+	row := make([]string, len(t.columns))
+	for _, rec := range t.rows {
+		for i, col := range t.columns {
+			row[i] = rec[col]
+		}
+		if err := sink.write(name, "", t.sobject, t.columns, row); err != nil {
+			sink.Close()
+			return nil, err
+		}
+	}
+	if err := sink.Close(); err != nil {
+		return nil, err
+	}
+
+	return &ExportResult{
+		File:    ef.path,
+		Columns: t.columns,
+		Rows:    len(t.rows),
+	}, nil
+}
+
+// table is a flattened query result. Rows map column names to values.
+type table struct {
+	sobject string
+	columns []string
+	rows    []map[string]string
+
+	index map[string]bool
+	// nulls are columns seen only as a null relationship so far.
+	nulls map[string]bool
+}
+
+func flattenRecords(records []json.RawMessage) (*table, error) {
+	t := &table{index: make(map[string]bool), nulls: make(map[string]bool)}
+	for i, raw := range records {
+		row := make(map[string]string)
+		if err := t.flatten("", raw, row); err != nil {
+			return nil, fmt.Errorf("record %d: %w", i, err)
+		}
+		t.rows = append(t.rows, row)
+	}
+
+	// A relationship that was null in some records and set in others only
+	// needs its dotted columns.
+	columns := t.columns[:0]
+	for _, col := range t.columns {
+		if !t.nulls[col] || !t.hasChildren(col) {
+			columns = append(columns, col)
+		}
+	}
+	t.columns = columns
+	return t, nil
+}
+
+// flatten adds the fields of the JSON object raw to row, reading them in
+// order so the columns follow the query's field order.
+func (t *table) flatten(prefix string, raw json.RawMessage, row map[string]string) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if tok, err := dec.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('{') {
+		return errors.New("record is not a JSON object")
+	}
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key := tok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+
+		if key == "attributes" {
+			if prefix == "" && t.sobject == "" {
+				var a Attributes
+				if json.Unmarshal(value, &a) == nil {
+					t.sobject = a.Type
+				}
+			}
+			continue
+		}
+
+		col := prefix + key
+		switch value[0] {
+		case '{':
+			if isChildRelationship(value) {
+				t.set(row, col, compact(value))
+				continue
+			}
+			if err := t.flatten(col+".", value, row); err != nil {
+				return err
+			}
+		case '[':
+			t.set(row, col, compact(value))
+		case 'n':
+			if t.hasChildren(col) {
+				continue
+			}
+			if !t.index[col] {
+				t.nulls[col] = true
+			}
+			t.set(row, col, "")
+		case '"':
+			var s string
+			if err := json.Unmarshal(value, &s); err != nil {
+				return err
+			}
+			t.set(row, col, s)
+		default:
+			t.set(row, col, string(value))
+		}
+	}
+	_, err := dec.Token()
+	return err
+}
+
+func (t *table) set(row map[string]string, col, value string) {
+	row[col] = value
+	if t.index[col] {
+		return
+	}
+	t.index[col] = true
+	t.columns = t.insertAt(col)
+}
+
+// insertAt places a new column after the last column of its relationship, or
+// after the relationship's null placeholder, and otherwise at the end.
+func (t *table) insertAt(col string) []string {
+	pos := len(t.columns)
+	for parent := col; strings.Contains(parent, "."); {
+		parent = parent[:strings.LastIndex(parent, ".")]
+		found := -1
+		for i, c := range t.columns {
+			if c == parent || strings.HasPrefix(c, parent+".") {
+				found = i
+			}
+		}
+		if found >= 0 {
+			pos = found + 1
+			break
+		}
+	}
+	t.columns = append(t.columns, "")
+	copy(t.columns[pos+1:], t.columns[pos:])
+	t.columns[pos] = col
+	return t.columns
+}
+
+func (t *table) hasChildren(col string) bool {
+	for _, c := range t.columns {
+		if strings.HasPrefix(c, col+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// isChildRelationship reports whether raw is a nested query result, which is
+// kept as JSON in a single column rather than flattened.
+func isChildRelationship(raw json.RawMessage) bool {
+	var m map[string]json.RawMessage
+	if json.Unmarshal(raw, &m) != nil {
+		return false
+	}
+	_, records := m["records"]
+	_, size := m["totalSize"]
+	return records && size
+}
+
+func compact(raw json.RawMessage) string {
+	var b bytes.Buffer
+	if err := json.Compact(&b, raw); err != nil {
+		return string(raw)
+	}
+	return b.String()
+}
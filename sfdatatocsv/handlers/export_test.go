@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestFlattenRecords(t *testing.T) {
+	records := []json.RawMessage{
+		json.RawMessage(`{"attributes":{"type":"Measure__c"},"Id":"a1","Measure_Calculation__r":null,"Savings__c":1.50,"Active__c":true}`),
+		json.RawMessage(`{"attributes":{"type":"Measure__c"},"Id":"a2","Measure_Calculation__r":{"attributes":{"type":"Measure_Calculation__c"},"Name":"MC-1","Owner__r":{"Name":"Ann"}},"Savings__c":null,"Active__c":false,
+			"Contacts__r":{"totalSize":1,"done":true,"records":[{"Name":"Bo"}]}}`),
+	}
+
+	tbl, err := flattenRecords(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tbl.sobject != "Measure__c" {
+		t.Errorf("sobject = %q, want Measure__c", tbl.sobject)
+	}
+	wantColumns := []string{"Id", "Measure_Calculation__r.Name", "Measure_Calculation__r.Owner__r.Name", "Savings__c", "Active__c", "Contacts__r"}
+	if !reflect.DeepEqual(tbl.columns, wantColumns) {
+		t.Errorf("columns = %q, want %q", tbl.columns, wantColumns)
+	}
+
+	want := []map[string]string{
+		{"Id": "a1", "Measure_Calculation__r": "", "Savings__c": "1.50", "Active__c": "true"},
+		{"Id": "a2", "Measure_Calculation__r.Name": "MC-1", "Measure_Calculation__r.Owner__r.Name": "Ann", "Savings__c": "", "Active__c": "false",
+			"Contacts__r": `{"totalSize":1,"done":true,"records":[{"Name":"Bo"}]}`},
+	}
+	if !reflect.DeepEqual(tbl.rows, want) {
+		t.Errorf("rows = %q, want %q", tbl.rows, want)
+	}
+}
+
+func TestFlattenRecordsRejectsNonObjects(t *testing.T) {
+	if _, err := flattenRecords([]json.RawMessage{json.RawMessage(`[1]`)}); err == nil {
+		t.Error("flattenRecords accepted a record that is not an object")
+	}
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/AmitSuresh/sfdataapp/files"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// ListFiles lists the files below csvDirPath, or below its dir query
+// parameter, with their size and modification time.
+func (h *Handler) ListFiles(w http.ResponseWriter, r *http.Request) {
+	if h.filesDisabled(w) {
+		return
+	}
+	h.files.ServeList(w, r)
+}
+
+// DownloadFile serves one file from below csvDirPath.
+func (h *Handler) DownloadFile(w http.ResponseWriter, r *http.Request) {
+	if h.filesDisabled(w) {
+		return
+	}
+	h.files.ServeFile(w, r, mux.Vars(r)["path"])
+}
+
+// Archive bundles every file below csvDirPath, or below its dir query
+// parameter, into a zip or, with format=tar.gz, a gzipped tarball.
+func (h *Handler) Archive(w http.ResponseWriter, r *http.Request) {
+	if h.filesDisabled(w) {
+		return
+	}
+	h.files.ServeArchive(w, r)
+}
+
+// JobArchive bundles the files written by an export job.
+func (h *Handler) JobArchive(w http.ResponseWriter, r *http.Request) {
+	if h.filesDisabled(w) {
+		return
+	}
+	job, ok := h.jobs.get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	if job.State == JobRunning {
+		http.Error(w, "job is still running", http.StatusConflict)
+		return
+	}
+	h.files.ServeFiles(w, r, "job-"+job.ID, job.Files)
+}
+
+// ServesFiles reports whether csvDirPath is set, without which the file
+// endpoints would serve the working directory.
+func (h *Handler) ServesFiles() bool {
+	return h.files != nil
+}
+
+func (h *Handler) filesDisabled(w http.ResponseWriter) bool {
+	if h.files == nil {
+		http.Error(w, files.ErrNoRoot.Error(), http.StatusNotFound)
+		return true
+	}
+	return false
+}
+
+func (h *Handler) logFileError(r *http.Request, msg string, err error) {
+	h.l.Error(msg, zap.String("path", r.URL.Path), zap.Error(err))
+}
@@ -0,0 +1,325 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/xuri/excelize/v2"
+)
+
+var (
+	errInvalidFormat = errors.New("format must be csv, xlsx, jsonl or parquet")
+	errNoAppend      = errors.New("format can only overwrite files")
+)
+
+// rowWriter writes the rows of one export file. Formats without sheets
+// ignore the sheet a row belongs to.
+type rowWriter interface {
+	WriteRow(sheet string, row []string) error
+	Close() error
+}
+
+// exportFormat creates the writers of one output format. Appendable formats
+// get the file opened for appending and whether it already has content;
+// the others write a temporary file that replaces the export on Close.
+type exportFormat struct {
+	ext        string
+	appendable bool
+	create     func(f *os.File, header []string, hasContent bool) (rowWriter, error)
+}
+
+var exportFormats = map[string]*exportFormat{
+	"csv":     {ext: ".csv", appendable: true, create: newCSVWriter},
+	"jsonl":   {ext: ".jsonl", appendable: true, create: newJSONLWriter},
+	"xlsx":    {ext: ".xlsx", create: newXLSXWriter},
+	"parquet": {ext: ".parquet", create: newParquetWriter},
+}
+
+// lookupFormat returns the named format; an empty name is csv.
+func lookupFormat(name string) (*exportFormat, error) {
+	if name == "" {
+		name = "csv"
+	}
+	f, ok := exportFormats[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", errInvalidFormat, name)
+	}
+	return f, nil
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCSVWriter(f *os.File, header []string, hasContent bool) (rowWriter, error) {
+	w := &csvWriter{w: csv.NewWriter(f)}
+	if !hasContent {
+		if err := w.w.Write(header); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (w *csvWriter) WriteRow(_ string, row []string) error {
+	return w.w.Write(row)
+}
+
+func (w *csvWriter) Close() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// jsonlWriter writes one JSON object per row with the header as keys, in
+// column order.
+type jsonlWriter struct {
+	w      *bufio.Writer
+	header [][]byte
+}
+
+func newJSONLWriter(f *os.File, header []string, _ bool) (rowWriter, error) {
+	w := &jsonlWriter{w: bufio.NewWriter(f)}
+	for _, col := range header {
+		k, err := json.Marshal(col)
+		if err != nil {
+			return nil, err
+		}
+		w.header = append(w.header, k)
+	}
+	return w, nil
+}
+
+func (w *jsonlWriter) WriteRow(_ string, row []string) error {
+	w.w.WriteByte('{')
+	for i, k := range w.header {
+		if i > 0 {
+			w.w.WriteByte(',')
+		}
+		v := ""
+		if i < len(row) {
+			v = row[i]
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		w.w.Write(k)
+		w.w.WriteByte(':')
+		w.w.Write(b)
+	}
+	w.w.WriteString("}\n")
+	return nil
+}
+
+func (w *jsonlWriter) Close() error {
+	return w.w.Flush()
+}
+
+// xlsxWriter streams rows into a workbook with one sheet per sheet name,
+// each starting with the header.
+type xlsxWriter struct {
+	out    *os.File
+	f      *excelize.File
+	header []interface{}
+	sheets map[string]*xlsxSheet
+	order  []string
+	names  map[string]bool
+}
+
+type xlsxSheet struct {
+	sw   *excelize.StreamWriter
+	next int
+}
+
+const defaultSheet = "Sheet1"
+
+func newXLSXWriter(out *os.File, header []string, _ bool) (rowWriter, error) {
+	w := &xlsxWriter{
+		out:    out,
+		f:      excelize.NewFile(),
+		sheets: make(map[string]*xlsxSheet),
+		names:  make(map[string]bool),
+	}
+	for _, col := range header {
+		w.header = append(w.header, col)
+	}
+	return w, nil
+}
+
+func (w *xlsxWriter) WriteRow(sheet string, row []string) error {
+	s, err := w.sheet(sheet)
+	if err != nil {
+		return err
+	}
+	cells := make([]interface{}, len(row))
+	for i, v := range row {
+		cells[i] = v
+	}
+	return s.setRow(cells)
+}
+
+func (w *xlsxWriter) sheet(sheet string) (*xlsxSheet, error) {
+	if s, ok := w.sheets[sheet]; ok {
+		return s, nil
+	}
+
+	name := w.sheetName(sheet)
+	if len(w.order) == 0 {
+		// A new workbook comes with Sheet1; the first sheet takes its place.
+		if name != defaultSheet {
+			if err := w.f.SetSheetName(defaultSheet, name); err != nil {
+				return nil, err
+			}
+		}
+	} else if _, err := w.f.NewSheet(name); err != nil {
+		return nil, err
+	}
+	sw, err := w.f.NewStreamWriter(name)
+	if err != nil {
+		return nil, err
+	}
+	s := &xlsxSheet{sw: sw, next: 1}
+	if err := s.setRow(w.header); err != nil {
+		return nil, err
+	}
+	w.sheets[sheet] = s
+	w.order = append(w.order, sheet)
+	return s, nil
+}
+
+// sheetName makes a unique, valid sheet name: at most 31 characters and
+// none of : \ / ? * [ ].
+func (w *xlsxWriter) sheetName(sheet string) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`:\/?*[]`, r) {
+			return '-'
+		}
+		return r
+	}, sheet)
+	// Names cannot start or end with an apostrophe.
+	base := strings.Trim(truncateRunes(strings.TrimSpace(name), 31), " '")
+	if base == "" {
+		base = "None"
+	}
+	name = base
+	for i := 2; w.names[strings.ToLower(name)]; i++ {
+		suffix := fmt.Sprintf(" (%d)", i)
+		name = truncateRunes(base, 31-len(suffix)) + suffix
+	}
+	w.names[strings.ToLower(name)] = true
+	return name
+}
+
+func truncateRunes(s string, n int) string {
+	r := []rune(s)
+	if len(r) > n {
+		return string(r[:n])
+	}
+	return s
+}
+
+func (s *xlsxSheet) setRow(cells []interface{}) error {
+	cell, err := excelize.CoordinatesToCellName(1, s.next)
+	if err != nil {
+		return err
+	}
+	s.next++
+	return s.sw.SetRow(cell, cells)
+}
+
+func (w *xlsxWriter) Close() error {
+	defer w.f.Close()
+	if len(w.order) == 0 {
+		// Keep the header even when there are no rows.
+		if _, err := w.sheet(defaultSheet); err != nil {
+			return err
+		}
+	}
+	for _, sheet := range w.order {
+		if err := w.sheets[sheet].sw.Flush(); err != nil {
+			return err
+		}
+	}
+	return w.f.Write(w.out)
+}
+
+// parquetWriter writes every column as an optional UTF-8 string; empty
+// values are null. Parquet orders the columns of a group by name.
+type parquetWriter struct {
+	w       *parquet.Writer
+	columns []int
+	rows    []parquet.Row
+}
+
+const parquetRowBuffer = 1024
+
+func newParquetWriter(out *os.File, header []string, _ bool) (rowWriter, error) {
+	group := parquet.Group{}
+	for _, col := range header {
+		if _, dup := group[col]; dup {
+			return nil, fmt.Errorf("duplicate column %q", col)
+		}
+		group[col] = parquet.Optional(parquet.String())
+	}
+	schema := parquet.NewSchema("export", group)
+
+	sorted := append([]string(nil), header...)
+	sort.Strings(sorted)
+	index := make(map[string]int, len(sorted))
+	for i, col := range sorted {
+		index[col] = i
+	}
+	w := &parquetWriter{
+		w:       parquet.NewWriter(out, schema, parquet.Compression(&parquet.Snappy)),
+		columns: make([]int, len(header)),
+	}
+	for i, col := range header {
+		w.columns[i] = index[col]
+	}
+	return w, nil
+}
+
+func (w *parquetWriter) WriteRow(_ string, row []string) error {
+	values := make(parquet.Row, len(w.columns))
+	for i, c := range w.columns {
+		if i < len(row) && row[i] != "" {
+			values[c] = parquet.ByteArrayValue([]byte(row[i])).Level(0, 1, c)
+		} else {
+			values[c] = parquet.NullValue().Level(0, 0, c)
+		}
+	}
+	w.rows = append(w.rows, values)
+	if len(w.rows) >= parquetRowBuffer {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *parquetWriter) flush() error {
+	if _, err := w.w.WriteRows(w.rows); err != nil {
+		return err
+	}
+	w.rows = w.rows[:0]
+	return nil
+}
+
+func (w *parquetWriter) Close() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	return w.w.Close()
+}
+
+// tempFile creates a file next to path for a format that replaces the export
+// on Close.
+func tempFile(path string) (*os.File, error) {
+	return os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+}
@@ -1,281 +1,237 @@
-package handlers
-
-import (
-	"encoding/csv"
-	"fmt"
-	"net/http"
-	"net/url"
-	"os"
-	"path/filepath"
-	"strconv"
-	"strings"
-
-	"go.uber.org/zap"
-)
-
-func (h *Handler) GetMeasureCalcs(w http.ResponseWriter, r *http.Request) {
-	p := new(MeasureCalcsResponse)
-
-	err := FromJSON(p, r.Body)
-	if err != nil {
-		h.l.Error("error decoding", zap.Error(err))
-		return
-	}
-
-	filesCreated := make(map[string]*os.File)
-	defer func() {
-		for _, file := range filesCreated {
-			file.Close()
-		}
-	}()
-
-	for _, v := range p.MeasureCalcRecords {
-		fileName := strings.ReplaceAll(v.Name, "/", "-")
-		h.l.Info("", zap.Any("file Name is: ", fileName))
-
-		file, err := h.CreateCSVFile(h.cfg.JsonDirPath, fileName)
-		if err != nil {
-			h.l.Error("error creating or opening a csv file", zap.Error(err))
-			return
-		}
-		defer file.Close()
-
-		fileName = fmt.Sprintf("%s/%s.csv", h.cfg.JsonDirPath, fileName)
-
-		d, err := os.ReadFile(fileName)
-		if err != nil {
-			h.l.Error("error reading file", zap.Error(err))
-		}
-
-		var records [][]string
-
-		r := csv.NewReader(strings.NewReader(string(d)))
-
-		records, err = r.ReadAll()
-		if err != nil {
-			h.l.Error("error reading CSV data", zap.Error(err))
-		}
-
-		filesCreated[v.Name] = file
-		h.l.Info("size of first records", zap.Any("", len(records)))
-
-		switch len(records) {
-		case 0:
-			records = append(records, []string{"Id", "Name", "Program_Name__c", "CLR_CNI_Sequence__c", "CLI_CNR_Field_to_calculate__c", "CLR_CNI_Mesaure_Formula__c"})
-			fallthrough
-		default:
-			records = append(records, []string{
-				v.Id, v.Name, v.ProgramName, strconv.FormatFloat(float64(v.Sequence), 'f', -1, 32), v.FieldToCalc, v.Formula,
-			})
-		}
-
-		c := csv.NewWriter(file)
-
-		err = c.WriteAll(records)
-		if err != nil {
-			h.l.Error("error writing csv", zap.Error(err))
-		}
-		c.Flush()
-
-		if err := c.Error(); err != nil {
-			h.l.Error("error flushing CSV writer", zap.String("file", v.Name), zap.Error(err))
-		}
-	}
-	w.Write([]byte("success"))
-	w.WriteHeader(http.StatusOK)
-}
-
-func (h *Handler) GetMCLIToSearch(w http.ResponseWriter, r *http.Request) {
-	p := new(MeasureCalcsResponse)
-
-	err := FromJSON(p, r.Body)
-	if err != nil {
-		h.l.Error("error decoding", zap.Error(err))
-		return
-	}
-
-	filesCreated := make(map[string]*os.File)
-	defer func() {
-		for _, file := range filesCreated {
-			file.Close()
-		}
-	}()
-
-	for _, v := range p.MeasureCalcRecords {
-		fileName := "MCLI To Search"
-		h.l.Info("", zap.Any("file Name is: ", fileName))
-
-		file, err := h.CreateCSVFile(h.cfg.JsonDirPath, fileName)
-		if err != nil {
-			h.l.Error("error creating or opening a csv file", zap.Error(err))
-			return
-		}
-		defer file.Close()
-
-		fileName = fmt.Sprintf("%s/%s.csv", h.cfg.JsonDirPath, fileName)
-
-		d, err := os.ReadFile(fileName)
-		if err != nil {
-			h.l.Error("error reading file", zap.Error(err))
-		}
-
-		var records [][]string
-
-		r := csv.NewReader(strings.NewReader(string(d)))
-
-		records, err = r.ReadAll()
-		if err != nil {
-			h.l.Error("error reading CSV data", zap.Error(err))
-		}
-
-		filesCreated[v.Name] = file
-		h.l.Info("size of first records", zap.Any("", len(records)))
-
-		if strings.EqualFold(v.Formula, "Lookup") {
-			switch len(records) {
-			case 0:
-				records = append(records, []string{"Id", "Name", "Program_Name__c", "CLR_CNI_Sequence__c", "CLI_CNR_Field_to_calculate__c", "CLR_CNI_Mesaure_Formula__c"})
-				fallthrough
-			default:
-				records = append(records, []string{
-					v.Id, v.Name, v.ProgramName, strconv.FormatFloat(float64(v.Sequence), 'f', -1, 32), v.FieldToCalc, v.Formula,
-				})
-			}
-		}
-
-		h.mcIdMap[v.Id] = v
-
-		c := csv.NewWriter(file)
-
-		err = c.WriteAll(records)
-		if err != nil {
-			h.l.Error("error writing csv", zap.Error(err))
-		}
-		c.Flush()
-
-		if err := c.Error(); err != nil {
-			h.l.Error("error flushing CSV writer", zap.String("file", v.Name), zap.Error(err))
-		}
-	}
-	w.Write([]byte("success"))
-	w.WriteHeader(http.StatusOK)
-}
-
-func (h *Handler) Getmcliquery(w http.ResponseWriter, r *http.Request) {
-	p := new(MeasureCalcsResponse)
-
-	err := FromJSON(p, r.Body)
-	if err != nil {
-		h.l.Error("error decoding", zap.Error(err))
-		return
-	}
-
-	idMap := make(map[string]struct{})
-	for _, v := range p.MeasureCalcRecords {
-		idMap[v.Id] = struct{}{}
-	}
-
-	var ids []string
-	for id := range idMap {
-		ids = append(ids, fmt.Sprintf("'%s'", id))
-	}
-
-	result := strings.Join(ids, ",")
-	query := fmt.Sprintf("SELECT Condition__c,Id,Measure_Calculation__c,Measure_Formula__c FROM CLR_CNI_Measure_Calculations_Line_Item__c WHERE Measure_Calculation__c IN (%s)", result)
-	encodedQuery := url.QueryEscape(query)
-	w.Write([]byte(encodedQuery))
-	w.WriteHeader(http.StatusOK)
-}
-
-func (h *Handler) CreateCSVFile(dir, fileName string) (*os.File, error) {
-	fName := fmt.Sprintf("%s.csv", fileName)
-	newFilename := filepath.Join(dir, fName)
-
-	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
-		h.l.Error("error creating directory", zap.Error(err))
-		return nil, err
-	}
-
-	file, err := os.OpenFile(newFilename, os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return nil, err
-	}
-
-	return file, nil
-}
-
-func (h *Handler) GetMCLI(w http.ResponseWriter, r *http.Request) {
-	p := new(MCLIResponse)
-
-	err := FromJSON(p, r.Body)
-	if err != nil {
-		h.l.Error("error decoding", zap.Error(err))
-		return
-	}
-
-	filesCreated := make(map[string]*os.File)
-	defer func() {
-		for _, file := range filesCreated {
-			file.Close()
-		}
-	}()
-
-	for _, v := range p.MCLIRecords {
-		fileName := "AllMCLI"
-		h.l.Info("", zap.Any("file Name is: ", fileName))
-
-		file, err := h.CreateCSVFile(h.cfg.JsonDirPath, fileName)
-		if err != nil {
-			h.l.Error("error creating or opening a csv file", zap.Error(err))
-			return
-		}
-		defer file.Close()
-
-		fileName = fmt.Sprintf("%s/%s.csv", h.cfg.JsonDirPath, fileName)
-
-		d, err := os.ReadFile(fileName)
-		if err != nil {
-			h.l.Error("error reading file", zap.Error(err))
-		}
-
-		var records [][]string
-
-		r := csv.NewReader(strings.NewReader(string(d)))
-
-		records, err = r.ReadAll()
-		if err != nil {
-			h.l.Error("error reading CSV data", zap.Error(err))
-		}
-
-		filesCreated["AllMCLI"] = file
-		h.l.Info("size of first records", zap.Any("", len(records)))
-
-		switch len(records) {
-		case 0:
-			records = append(records, []string{"Condition__c", "Id", "Measure_Calculation__c", "Measure_Formula__c",
-				"Measure_Calculation__r.CLI_CNR_Field_to_calculate__c", "Measure_Calculation__r.Name", "Measure_Calculation__r.Program_Name__c",
-				"Measure_Calculation__r.CLR_CNI_Mesaure_Formula__c", "Measure_Calculation__r.Id",
-			})
-			fallthrough
-		default:
-			records = append(records, []string{
-				v.Condition, v.Id, v.MeasureCalc, v.Formula, h.mcIdMap[v.MeasureCalc].FieldToCalc, h.mcIdMap[v.MeasureCalc].Name, h.mcIdMap[v.MeasureCalc].ProgramName,
-				h.mcIdMap[v.MeasureCalc].Formula, h.mcIdMap[v.MeasureCalc].Id,
-			})
-		}
-
-		c := csv.NewWriter(file)
-
-		err = c.WriteAll(records)
-		if err != nil {
-			h.l.Error("error writing csv", zap.Error(err))
-		}
-		c.Flush()
-
-		if err := c.Error(); err != nil {
-			h.l.Error("error flushing CSV writer", zap.String("file", "AllMCLI"), zap.Error(err))
-		}
-	}
-	w.Write([]byte("success"))
-	w.WriteHeader(http.StatusOK)
-}
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/AmitSuresh/sfdataapp/files"
+	"github.com/AmitSuresh/sfdataapp/salesforce"
+	"go.uber.org/zap"
+)
+
+func (h *Handler) GetMeasureCalcs(w http.ResponseWriter, r *http.Request) {
+	p := new(MeasureCalcsResponse)
+
+	err := FromJSON(p, r.Body)
+	if err != nil {
+		h.l.Error("error decoding", zap.Error(err))
+		return
+	}
+
+	sink, err := h.requestSink(r, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = h.writeMeasureCalcs(sink, p.MeasureCalcRecords)
+	if cerr := sink.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		h.l.Error("error writing csv", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("success"))
+}
+
+// requestSink returns a sink for the format, mode, run and idSuffix query
+// parameters. With run the files go to the run's directory. Without mode,
+// these endpoints append where the format allows it as they are called once
+// per page of records.
+func (h *Handler) requestSink(r *http.Request, mode string) (*exportSink, error) {
+	q := r.URL.Query()
+	if q.Get("mode") != "" {
+		mode = q.Get("mode")
+	}
+	dir := h.cfg.JsonDirPath
+	if run := q.Get("run"); run != "" {
+		dir = h.runDir(run)
+	}
+	sink, err := newExportSink(dir, mode, q.Get("format"))
+	if err != nil {
+		return nil, err
+	}
+	sink.idSuffix, _ = strconv.ParseBool(q.Get("idSuffix"))
+	return sink, nil
+}
+
+// runDir is the directory of the named export run below csvDirPath.
+func (h *Handler) runDir(run string) string {
+	return filepath.Join(h.cfg.JsonDirPath, runsDir, files.FileName(run, ""))
+}
+
+var measureCalcHeader = []string{"Id", "Name", "Program_Name__c", "CLR_CNI_Sequence__c", "CLI_CNR_Field_to_calculate__c", "CLR_CNI_Mesaure_Formula__c"}
+
+func measureCalcRow(v MeasureCalcRecords) []string {
+	return []string{
+		v.Id, v.Name, v.ProgramName, strconv.FormatFloat(float64(v.Sequence), 'f', -1, 32), v.FieldToCalc, v.Formula,
+	}
+}
+
+// writeMeasureCalcs writes every Measure Calculation to a file named after it.
+func (h *Handler) writeMeasureCalcs(sink *exportSink, recs []MeasureCalcRecords) error {
+	for _, v := range recs {
+		if err := sink.write(v.Name, v.Id, v.ProgramName, measureCalcHeader, measureCalcRow(v)); err != nil {
+			h.l.Error("error writing csv", zap.String("name", v.Name), zap.Error(err))
+			return err
+		}
+	}
+	h.l.Info("wrote measure calculations", zap.Int("records", len(recs)))
+	return nil
+}
+
+func (h *Handler) GetMCLIToSearch(w http.ResponseWriter, r *http.Request) {
+	p := new(MeasureCalcsResponse)
+
+	err := FromJSON(p, r.Body)
+	if err != nil {
+		h.l.Error("error decoding", zap.Error(err))
+		return
+	}
+
+	sink, err := h.requestSink(r, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = h.writeMCLIToSearch(sink, p.MeasureCalcRecords)
+	if cerr := sink.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		h.l.Error("error writing csv", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("success"))
+}
+
+// writeMCLIToSearch lists the Lookup Measure Calculations in "MCLI To Search"
+// and indexes every Measure Calculation for writeMCLI.
+func (h *Handler) writeMCLIToSearch(sink *exportSink, recs []MeasureCalcRecords) error {
+	if err := h.mcIndex.put(recs); err != nil {
+		h.l.Error("error saving measure calculation index", zap.Error(err))
+		return err
+	}
+
+	const fileName = "MCLI To Search"
+	// Open the file even without lookups so an overwrite leaves just the header.
+	if _, err := sink.open(fileName, "", measureCalcHeader); err != nil {
+		h.l.Error("error creating or opening a csv file", zap.Error(err))
+		return err
+	}
+	for _, v := range recs {
+		if !strings.EqualFold(v.Formula, "Lookup") {
+			continue
+		}
+		if err := sink.write(fileName, "", v.ProgramName, measureCalcHeader, measureCalcRow(v)); err != nil {
+			h.l.Error("error writing csv", zap.String("file", fileName), zap.Error(err))
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handler) Getmcliquery(w http.ResponseWriter, r *http.Request) {
+	p := new(MeasureCalcsResponse)
+
+	err := FromJSON(p, r.Body)
+	if err != nil {
+		h.l.Error("error decoding", zap.Error(err))
+		return
+	}
+
+	queries, err := mcliQuery(p.MeasureCalcRecords).Build()
+	if err != nil {
+		h.l.Error("error building query", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Large id sets need several queries; each is written on its own line.
+	for _, q := range queries {
+		w.Write([]byte(url.QueryEscape(q) + "\n"))
+	}
+}
+
+// mcliQuery selects the line items of the given Measure Calculations.
+func mcliQuery(recs []MeasureCalcRecords) *salesforce.Query {
+	q := &salesforce.Query{
+		Object:  "CLR_CNI_Measure_Calculations_Line_Item__c",
+		Fields:  []string{"Condition__c", "Id", "Measure_Calculation__c", "Measure_Formula__c"},
+		InField: "Measure_Calculation__c",
+	}
+	for _, v := range recs {
+		q.InValues = append(q.InValues, v.Id)
+	}
+	return q
+}
+
+func (h *Handler) GetMCLI(w http.ResponseWriter, r *http.Request) {
+	p := new(MCLIResponse)
+
+	err := FromJSON(p, r.Body)
+	if err != nil {
+		h.l.Error("error decoding", zap.Error(err))
+		return
+	}
+
+	sink, err := h.requestSink(r, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, err = h.writeMCLI(sink, p.MCLIRecords)
+	if cerr := sink.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		h.l.Error("error writing csv", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("success"))
+}
+
+var mcliHeader = []string{"Condition__c", "Id", "Measure_Calculation__c", "Measure_Formula__c",
+	"Measure_Calculation__r.CLI_CNR_Field_to_calculate__c", "Measure_Calculation__r.Name", "Measure_Calculation__r.Program_Name__c",
+	"Measure_Calculation__r.CLR_CNI_Mesaure_Formula__c", "Measure_Calculation__r.Id", "Measure_Calculation_Missing",
+}
+
+// writeMCLI writes the line items to AllMCLI with the columns of their
+// Measure Calculation from the index built by writeMCLIToSearch. Line items
+// whose calculation is not in the index are flagged in
+// Measure_Calculation_Missing and counted in the result.
+func (h *Handler) writeMCLI(sink *exportSink, recs []MCLIRecords) (int, error) {
+	const fileName = "AllMCLI"
+	if _, err := sink.open(fileName, "", mcliHeader); err != nil {
+		h.l.Error("error creating or opening a csv file", zap.Error(err))
+		return 0, err
+	}
+
+	missing := 0
+	for _, v := range recs {
+		mc, ok := h.mcIndex.get(v.MeasureCalc)
+		parentMissing := ""
+		if !ok {
+			missing++
+			parentMissing = "true"
+		}
+		err := sink.write(fileName, "", mc.ProgramName, mcliHeader, []string{
+			v.Condition, v.Id, v.MeasureCalc, v.Formula, mc.FieldToCalc, mc.Name, mc.ProgramName,
+			mc.Formula, mc.Id, parentMissing,
+		})
+		if err != nil {
+			h.l.Error("error writing csv", zap.String("file", fileName), zap.Error(err))
+			return missing, err
+		}
+	}
+	if missing > 0 {
+		h.l.Warn("line items reference measure calculations that are not indexed", zap.Int("count", missing))
+	}
+	return missing, nil
+}
@@ -0,0 +1,390 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AmitSuresh/sfdataapp/files"
+	"github.com/AmitSuresh/sfdataapp/sfdatatocsv/formula"
+	"go.uber.org/zap"
+)
+
+const (
+	ProblemCycle          = "cycle"
+	ProblemSequence       = "sequence"
+	ProblemDuplicateField = "duplicate field"
+	ProblemSyntax         = "syntax error"
+	ProblemNoLineItems    = "lookup without line items"
+
+	graphFile    = "MeasureCalcGraph"
+	problemsFile = "MeasureCalcProblems"
+)
+
+var problemsHeader = []string{"Program_Name__c", "Kind", "Measure_Calculation__c", "Name", "Field", "Detail"}
+
+// Graph builds the dependency graph of the Measure Calculations selected as
+// for /evaluate and reports cycles, calculations sequenced before the
+// calculations they use, fields calculated more than once, formulas that do
+// not parse and Lookup calculations without line items. It writes
+// MeasureCalcGraph.dot, MeasureCalcGraph.json and a MeasureCalcProblems file
+// in the requested format with the problems by program, and returns the
+// graph as JSON or, with output=dot, as DOT.
+func (h *Handler) Graph(w http.ResponseWriter, r *http.Request) {
+	p := new(GraphRequest)
+	if err := FromJSON(p, r.Body); err != nil {
+		h.l.Error("error decoding", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	output := r.URL.Query().Get("output")
+	if output != "" && output != "json" && output != "dot" {
+		http.Error(w, "output must be json or dot", http.StatusBadRequest)
+		return
+	}
+	sink, err := h.requestSink(r, ModeOverwrite)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mcs, items, err := h.calcSources(r.Context(), p.Program, p.MeasureCalcs, p.LineItems)
+	if err != nil {
+		h.l.Error("error querying line items", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	g := buildGraph(mcs, items)
+	if err := h.writeGraph(sink, g); err != nil {
+		h.l.Error("error writing graph", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(g.Problems) > 0 {
+		h.l.Warn("measure calculation graph has problems", zap.Int("count", len(g.Problems)))
+	}
+
+	if output == "dot" {
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		if err := writeDOT(w, g); err != nil {
+			h.l.Error("error writing response", zap.Error(err))
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := ToJSON(g, w); err != nil {
+		h.l.Error("error writing response", zap.Error(err))
+	}
+}
+
+// writeGraph writes the DOT and JSON graphs next to the problems report and
+// records the files written, relative to csvDirPath, in g.Files.
+func (h *Handler) writeGraph(sink *exportSink, g *CalcGraph) (err error) {
+	graphNames := []string{graphFile + ".dot", graphFile + ".json"}
+	var names []string
+	defer func() {
+		names = append(names, sink.names()...)
+		if cerr := sink.Close(); err == nil {
+			err = cerr
+		}
+		if rel, rerr := filepath.Rel(h.cfg.JsonDirPath, sink.dir); rerr == nil && rel != "." {
+			for i, name := range names {
+				names[i] = filepath.ToSlash(filepath.Join(rel, name))
+			}
+		}
+		g.Files = names
+	}()
+
+	if _, err := sink.open(problemsFile, "", problemsHeader); err != nil {
+		return err
+	}
+	for _, p := range g.Problems {
+		row := []string{p.Program, p.Kind, p.MeasureCalcID, p.MeasureCalc, p.Field, p.Detail}
+		if err := sink.write(problemsFile, "", p.Program, problemsHeader, row); err != nil {
+			return err
+		}
+	}
+
+	var dot bytes.Buffer
+	if err := writeDOT(&dot, g); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+	contents := [][]byte{dot.Bytes(), data}
+	for i, name := range graphNames {
+		p, err := files.Resolve(sink.dir, name)
+		if err != nil {
+			return err
+		}
+		if err := files.WriteFile(p, contents[i]); err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+	return files.UpdateManifest(sink.dir, []files.ManifestEntry{
+		{Name: graphFile, File: graphNames[0]},
+		{Name: graphFile, File: graphNames[1]},
+	})
+}
+
+// buildGraph links calculations through the fields they calculate. Fields
+// only link calculations of the same program.
+func buildGraph(mcs []MeasureCalcRecords, items []MCLIRecords) *CalcGraph {
+	var calcs []MeasureCalcRecords
+	for _, mc := range mcs {
+		if !mc.IsDeleted {
+			calcs = append(calcs, mc)
+		}
+	}
+	sort.SliceStable(calcs, func(i, j int) bool {
+		a, b := calcs[i], calcs[j]
+		if a.ProgramName != b.ProgramName {
+			return a.ProgramName < b.ProgramName
+		}
+		if a.Sequence != b.Sequence {
+			return a.Sequence < b.Sequence
+		}
+		return a.Name < b.Name
+	})
+
+	byCalc := make(map[string][]MCLIRecords)
+	for _, li := range items {
+		if !li.IsDeleted {
+			byCalc[li.MeasureCalc] = append(byCalc[li.MeasureCalc], li)
+		}
+	}
+
+	g := &CalcGraph{Nodes: make([]GraphNode, 0, len(calcs)), Edges: []GraphEdge{}, Problems: []GraphProblem{}}
+	problem := func(mc MeasureCalcRecords, kind, field, detail string) {
+		g.Problems = append(g.Problems, GraphProblem{
+			Program: mc.ProgramName, Kind: kind, MeasureCalc: mc.Name, MeasureCalcID: mc.Id, Field: field, Detail: detail,
+		})
+	}
+
+	// producers maps program and lower-cased field to the calculations that
+	// calculate it.
+	producers := make(map[string]map[string][]int)
+	for i, mc := range calcs {
+		g.Nodes = append(g.Nodes, GraphNode{ID: mc.Id, Name: mc.Name, Program: mc.ProgramName, Field: mc.FieldToCalc, Sequence: mc.Sequence})
+		if mc.FieldToCalc == "" {
+			continue
+		}
+		if producers[mc.ProgramName] == nil {
+			producers[mc.ProgramName] = make(map[string][]int)
+		}
+		key := strings.ToLower(mc.FieldToCalc)
+		producers[mc.ProgramName][key] = append(producers[mc.ProgramName][key], i)
+	}
+	for i, mc := range calcs {
+		if mc.FieldToCalc == "" {
+			continue
+		}
+		var others []string
+		for _, j := range producers[mc.ProgramName][strings.ToLower(mc.FieldToCalc)] {
+			if j != i {
+				others = append(others, calcs[j].Name)
+			}
+		}
+		if len(others) > 0 {
+			problem(mc, ProblemDuplicateField, mc.FieldToCalc, "also calculated by "+strings.Join(others, ", "))
+		}
+	}
+
+	// adj[j] holds the calculations that use a field calculated by j.
+	adj := make([][]int, len(calcs))
+	for i, mc := range calcs {
+		type ref struct{ field, lineItem string }
+		var refs []ref
+		parse := func(lineItem, field, src string) {
+			e, err := formula.Parse(src)
+			if err != nil {
+				detail := err.Error()
+				if lineItem != "" {
+					detail = "line item " + lineItem + ": " + detail
+				}
+				problem(mc, ProblemSyntax, field, detail)
+				return
+			}
+			for _, f := range e.Fields() {
+				refs = append(refs, ref{f, lineItem})
+			}
+		}
+
+		lis := byCalc[mc.Id]
+		switch {
+		case len(lis) == 0 && isLookup(mc.Formula):
+			problem(mc, ProblemNoLineItems, fieldMCFormula, "the formula is Lookup but no line items were found")
+		case len(lis) == 0 && strings.TrimSpace(mc.Formula) != "":
+			parse("", fieldMCFormula, mc.Formula)
+		}
+		for _, li := range lis {
+			parse(li.Id, fieldMCLIFormula, li.Formula)
+			if strings.TrimSpace(li.Condition) != "" {
+				parse(li.Id, fieldCondition, li.Condition)
+			}
+		}
+
+		linked := make(map[int]bool)
+		for _, r := range refs {
+			for _, j := range producers[mc.ProgramName][strings.ToLower(r.field)] {
+				if linked[j] {
+					continue
+				}
+				linked[j] = true
+				adj[j] = append(adj[j], i)
+				g.Edges = append(g.Edges, GraphEdge{From: calcs[j].Id, To: mc.Id, Field: calcs[j].FieldToCalc, LineItemID: r.lineItem})
+			}
+		}
+	}
+
+	comp := make([]int, len(calcs))
+	for c, scc := range stronglyConnected(adj) {
+		for _, i := range scc {
+			comp[i] = c
+		}
+		if len(scc) == 1 && !contains(adj[scc[0]], scc[0]) {
+			continue
+		}
+		sort.Ints(scc)
+		names := make([]string, len(scc))
+		for k, i := range scc {
+			g.Nodes[i].InCycle = true
+			names[k] = calcs[i].Name
+		}
+		first := calcs[scc[0]]
+		detail := "uses its own field"
+		if len(scc) > 1 {
+			detail = "depends on itself through " + strings.Join(names, ", ")
+		}
+		problem(first, ProblemCycle, first.FieldToCalc, detail)
+	}
+
+	index := make(map[string]int, len(calcs))
+	for i, mc := range calcs {
+		index[mc.Id] = i
+	}
+	for k := range g.Edges {
+		e := &g.Edges[k]
+		from, to := index[e.From], index[e.To]
+		if comp[from] == comp[to] && g.Nodes[from].InCycle {
+			e.Problem = ProblemCycle
+			continue
+		}
+		if calcs[from].Sequence >= calcs[to].Sequence {
+			e.Problem = ProblemSequence
+			problem(calcs[to], ProblemSequence, e.Field, fmt.Sprintf("sequence %s uses %s, which %s calculates at sequence %s",
+				formatSequence(calcs[to].Sequence), e.Field, calcs[from].Name, formatSequence(calcs[from].Sequence)))
+		}
+	}
+
+	sort.SliceStable(g.Problems, func(i, j int) bool { return g.Problems[i].Program < g.Problems[j].Program })
+	return g
+}
+
+// stronglyConnected returns the strongly connected components of the graph
+// (Tarjan's algorithm).
+func stronglyConnected(adj [][]int) [][]int {
+	var (
+		index   = make([]int, len(adj))
+		low     = make([]int, len(adj))
+		onStack = make([]bool, len(adj))
+		stack   []int
+		sccs    [][]int
+		next    = 1
+		visit   func(v int)
+	)
+	visit = func(v int) {
+		index[v], low[v] = next, next
+		next++
+		stack = append(stack, v)
+		onStack[v] = true
+		for _, w := range adj[v] {
+			switch {
+			case index[w] == 0:
+				visit(w)
+				low[v] = min(low[v], low[w])
+			case onStack[w]:
+				low[v] = min(low[v], index[w])
+			}
+		}
+		if low[v] != index[v] {
+			return
+		}
+		var scc []int
+		for {
+			w := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[w] = false
+			scc = append(scc, w)
+			if w == v {
+				break
+			}
+		}
+		sccs = append(sccs, scc)
+	}
+	for v := range adj {
+		if index[v] == 0 {
+			visit(v)
+		}
+	}
+	return sccs
+}
+
+func contains(s []int, v int) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func formatSequence(seq float32) string {
+	return strconv.FormatFloat(float64(seq), 'f', -1, 32)
+}
+
+// writeDOT writes g for Graphviz with a cluster per program. Calculations in
+// a cycle and the edges of cycles and out-of-order sequences are red.
+func writeDOT(w io.Writer, g *CalcGraph) error {
+	var b bytes.Buffer
+	b.WriteString("digraph measure_calculations {\n\trankdir=LR;\n\tnode [shape=box];\n")
+	cluster := 0
+	for i, n := range g.Nodes {
+		if i == 0 || n.Program != g.Nodes[i-1].Program {
+			if i > 0 {
+				b.WriteString("\t}\n")
+			}
+			fmt.Fprintf(&b, "\tsubgraph cluster_%d {\n\t\tlabel=%s;\n", cluster, strconv.Quote(n.Program))
+			cluster++
+		}
+		attrs := ""
+		if n.InCycle {
+			attrs = ", color=red"
+		}
+		label := fmt.Sprintf("%s\n%s\nsequence %s", n.Name, n.Field, formatSequence(n.Sequence))
+		fmt.Fprintf(&b, "\t\t%s [label=%s%s];\n", strconv.Quote(n.ID), strconv.Quote(label), attrs)
+	}
+	if len(g.Nodes) > 0 {
+		b.WriteString("\t}\n")
+	}
+	for _, e := range g.Edges {
+		attrs := ""
+		if e.Problem != "" {
+			attrs = ", color=red"
+		}
+		fmt.Fprintf(&b, "\t%s -> %s [label=%s%s];\n", strconv.Quote(e.From), strconv.Quote(e.To), strconv.Quote(e.Field), attrs)
+	}
+	b.WriteString("}\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
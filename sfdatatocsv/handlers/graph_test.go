@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestStronglyConnected(t *testing.T) {
+	tests := []struct {
+		name string
+		adj  [][]int
+		want [][]int
+	}{
+		{"empty", [][]int{}, nil},
+		{"chain", [][]int{{1}, {2}, {}}, [][]int{{0}, {1}, {2}}},
+		{"self loop", [][]int{{0}}, [][]int{{0}}},
+		{"cycle", [][]int{{1}, {2}, {0}}, [][]int{{0, 1, 2}}},
+		{"two cycles", [][]int{{1}, {0, 2}, {3}, {2}}, [][]int{{0, 1}, {2, 3}}},
+		{"cycle with a tail", [][]int{{1}, {2}, {1, 3}, {}}, [][]int{{0}, {1, 2}, {3}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := stronglyConnected(tt.adj)
+			for _, scc := range got {
+				sort.Ints(scc)
+			}
+			sort.Slice(got, func(i, j int) bool { return got[i][0] < got[j][0] })
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("stronglyConnected(%v) = %v, want %v", tt.adj, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildGraph(t *testing.T) {
+	mcs := []MeasureCalcRecords{
+		{Id: "a", Name: "A", ProgramName: "P", Sequence: 1, FieldToCalc: "A__c", Formula: "Base__c * 2"},
+		{Id: "b", Name: "B", ProgramName: "P", Sequence: 2, FieldToCalc: "B__c", Formula: "a__c + C__c"},
+		{Id: "c", Name: "C", ProgramName: "P", Sequence: 3, FieldToCalc: "C__c", Formula: "B__c"},
+		{Id: "d", Name: "D", ProgramName: "P", Sequence: 4, FieldToCalc: "A__c", Formula: "1 +"},
+		{Id: "e", Name: "E", ProgramName: "Q", Sequence: 1, FieldToCalc: "E__c", Formula: "E__c + A__c"},
+		{Id: "f", Name: "F", ProgramName: "Q", Sequence: 2, FieldToCalc: "F__c", Formula: "Lookup"},
+		{Id: "x", Name: "X", ProgramName: "P", Sequence: 1, FieldToCalc: "X__c", IsDeleted: true},
+	}
+	g := buildGraph(mcs, nil)
+
+	if len(g.Nodes) != 6 {
+		t.Fatalf("got %d nodes, want 6", len(g.Nodes))
+	}
+
+	var edges []string
+	for _, e := range g.Edges {
+		edges = append(edges, e.From+">"+e.To+":"+e.Problem)
+	}
+	sort.Strings(edges)
+	// Q's E__c + A__c does not link to P's A__c.
+	wantEdges := []string{"a>b:", "b>c:cycle", "c>b:cycle", "d>b:sequence", "e>e:cycle"}
+	if !reflect.DeepEqual(edges, wantEdges) {
+		t.Errorf("edges = %q, want %q", edges, wantEdges)
+	}
+
+	var problems []string
+	for _, p := range g.Problems {
+		problems = append(problems, p.Program+" "+p.MeasureCalc+" "+p.Kind)
+	}
+	sort.Strings(problems)
+	wantProblems := []string{
+		"P A duplicate field",
+		"P B cycle",
+		"P B sequence",
+		"P D duplicate field",
+		"P D syntax error",
+		"Q E cycle",
+		"Q F lookup without line items",
+	}
+	if !reflect.DeepEqual(problems, wantProblems) {
+		t.Errorf("problems = %q, want %q", problems, wantProblems)
+	}
+
+	inCycle := make(map[string]bool)
+	for _, n := range g.Nodes {
+		inCycle[n.ID] = n.InCycle
+	}
+	want := map[string]bool{"a": false, "b": true, "c": true, "d": false, "e": true, "f": false}
+	if !reflect.DeepEqual(inCycle, want) {
+		t.Errorf("InCycle = %v, want %v", inCycle, want)
+	}
+}
+
+func TestBuildGraphSequence(t *testing.T) {
+	mcs := []MeasureCalcRecords{
+		{Id: "a", Name: "A", ProgramName: "P", Sequence: 2, FieldToCalc: "A__c", Formula: "1"},
+		{Id: "b", Name: "B", ProgramName: "P", Sequence: 2, FieldToCalc: "B__c"},
+	}
+	items := []MCLIRecords{
+		{Id: "li1", MeasureCalc: "b", Formula: "1", Condition: "A__c > 0"},
+		{Id: "li2", MeasureCalc: "b", Formula: "A__c", IsDeleted: true},
+	}
+	g := buildGraph(mcs, items)
+
+	if len(g.Edges) != 1 {
+		t.Fatalf("got %d edges, want 1: %+v", len(g.Edges), g.Edges)
+	}
+	e := g.Edges[0]
+	if e.From != "a" || e.To != "b" || e.LineItemID != "li1" || e.Problem != ProblemSequence {
+		t.Errorf("edge = %+v, want a sequence problem from a to b through li1", e)
+	}
+	if len(g.Problems) != 1 || g.Problems[0].Kind != ProblemSequence || g.Problems[0].MeasureCalc != "B" {
+		t.Errorf("problems = %+v, want one sequence problem for B", g.Problems)
+	}
+}
@@ -1,26 +1,51 @@
-package handlers
-
-import (
-	"encoding/json"
-	"io"
-
-	"go.uber.org/zap"
-)
-
-func GetHandler(l *zap.Logger, cfg *Config) (*Handler, error) {
-	return &Handler{
-		l:       l,
-		cfg:     cfg,
-		mcIdMap: map[string]MeasureCalcRecords{},
-	}, nil
-}
-
-func ToJSON(i interface{}, w io.Writer) error {
-	e := json.NewEncoder(w)
-	return e.Encode(i)
-}
-
-func FromJSON(i interface{}, r io.Reader) error {
-	d := json.NewDecoder(r)
-	return d.Decode(i)
-}
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/AmitSuresh/sfdataapp/files"
+	"github.com/AmitSuresh/sfdataapp/salesforce"
+	"go.uber.org/zap"
+)
+
+// GetHandler returns the csv handlers. sf may be nil, in which case only the
+// endpoints that are sent query responses work.
+func GetHandler(l *zap.Logger, cfg *Config, sf *salesforce.Client) (*Handler, error) {
+	indexPath := cfg.MCIndexPath
+	if indexPath == "" {
+		indexPath = filepath.Join(cfg.JsonDirPath, "measure-calculations.json")
+	}
+	idx, err := loadMCIndex(indexPath)
+	if err != nil {
+		return nil, fmt.Errorf("loading measure calculation index %s: %w", indexPath, err)
+	}
+	l.Info("loaded measure calculation index", zap.String("path", indexPath), zap.Int("calculations", idx.len()))
+
+	h := &Handler{
+		l:       l,
+		cfg:     cfg,
+		mcIndex: idx,
+		sf:      sf,
+		jobs:    newJobTracker(),
+	}
+	if h.files, err = files.NewServer("export", map[string]string{"": cfg.JsonDirPath}); err != nil {
+		l.Warn("csvDirPath is not set, file downloads are disabled", zap.Error(err))
+		h.files = nil
+	} else {
+		h.files.ErrorLog = h.logFileError
+	}
+	return h, nil
+}
+
+func ToJSON(i interface{}, w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(i)
+}
+
+func FromJSON(i interface{}, r io.Reader) error {
+	d := json.NewDecoder(r)
+	return d.Decode(i)
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/AmitSuresh/sfdataapp/files"
+)
+
+// mcIndex maps Measure Calculation ids to their records so line items can be
+// exported with their parent's columns. It is kept in a JSON file that is
+// loaded at startup and rewritten whenever calculations are added, so it
+// survives restarts.
+type mcIndex struct {
+	mu   sync.RWMutex
+	path string
+	recs map[string]MeasureCalcRecords
+}
+
+func loadMCIndex(path string) (*mcIndex, error) {
+	idx := &mcIndex{path: path, recs: make(map[string]MeasureCalcRecords)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return idx, nil
+	}
+	if err := json.Unmarshal(data, &idx.recs); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// put adds or replaces recs and saves the index.
+func (idx *mcIndex) put(recs []MeasureCalcRecords) error {
+	if len(recs) == 0 {
+		return nil
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, r := range recs {
+		idx.recs[r.Id] = r
+	}
+	return idx.save()
+}
+
+func (idx *mcIndex) get(id string) (MeasureCalcRecords, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	r, ok := idx.recs[id]
+	return r, ok
+}
+
+// list returns the indexed calculations, only those of program if it is set.
+func (idx *mcIndex) list(program string) []MeasureCalcRecords {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	var recs []MeasureCalcRecords
+	for _, r := range idx.recs {
+		if program == "" || r.ProgramName == program {
+			recs = append(recs, r)
+		}
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Id < recs[j].Id })
+	return recs
+}
+
+func (idx *mcIndex) len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.recs)
+}
+
+// save writes the index to a temporary file and renames it into place. The
+// caller holds idx.mu.
+func (idx *mcIndex) save() error {
+	data, err := json.Marshal(idx.recs)
+	if err != nil {
+		return err
+	}
+	return files.WriteFile(idx.path, data)
+}
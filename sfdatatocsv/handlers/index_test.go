@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMCIndexSurvivesReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index", "mcindex.json")
+	idx, err := loadMCIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.len() != 0 {
+		t.Fatalf("new index holds %d records", idx.len())
+	}
+
+	if err := idx.put([]MeasureCalcRecords{{Id: "m1", Name: "MC-1"}, {Id: "m2", Name: "MC-2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.put([]MeasureCalcRecords{{Id: "m1", Name: "MC-1 renamed"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := loadMCIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.len() != 2 {
+		t.Errorf("reloaded index holds %d records, want 2", reloaded.len())
+	}
+	if r, ok := reloaded.get("m1"); !ok || r.Name != "MC-1 renamed" {
+		t.Errorf("get(m1) = %+v, %v, want the replaced record", r, ok)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*.tmp")); len(tmp) > 0 {
+		t.Errorf("temporary files left behind: %q", tmp)
+	}
+}
+
+func TestLoadMCIndexEmptyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mcindex.json")
+	if err := os.WriteFile(path, []byte("\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := loadMCIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.len() != 0 {
+		t.Errorf("index of an empty file holds %d records", idx.len())
+	}
+}
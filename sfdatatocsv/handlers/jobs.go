@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/AmitSuresh/sfdataapp/files"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+const (
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+
+	jobTimeout = 30 * time.Minute
+
+	// runsDir holds a directory per export run below csvDirPath.
+	runsDir = "runs"
+)
+
+var errNoSalesforce = errors.New("no Salesforce connection is configured")
+
+// jobTracker keeps export jobs in memory for the lifetime of the process.
+type jobTracker struct {
+	mu   sync.Mutex
+	jobs map[string]*ExportJob
+}
+
+func newJobTracker() *jobTracker {
+	return &jobTracker{jobs: make(map[string]*ExportJob)}
+}
+
+func (t *jobTracker) start() *ExportJob {
+	b := make([]byte, 16)
+	rand.Read(b)
+	now := time.Now().UTC()
+	job := &ExportJob{ID: hex.EncodeToString(b), State: JobRunning, CreatedAt: now, UpdatedAt: now}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.jobs[job.ID] = job
+	c := *job
+	return &c
+}
+
+func (t *jobTracker) update(id string, f func(j *ExportJob)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if j, ok := t.jobs[id]; ok {
+		f(j)
+		j.UpdatedAt = time.Now().UTC()
+	}
+}
+
+func (t *jobTracker) get(id string) (ExportJob, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	j, ok := t.jobs[id]
+	if !ok {
+		return ExportJob{}, false
+	}
+	return *j, true
+}
+
+// ExportMeasureCalcs starts a job that runs the posted Measure Calculation
+// query, writes the per-calculation and "MCLI To Search" files, queries the
+// line items of those calculations and writes AllMCLI. The files are
+// replaced unless the request's mode is append; with runDir they go to a
+// directory of their own, runs/<job id>. It replaces calling
+// getmeasurecalcsmap, getmclitosearch, getmcliquery and getallmcli by hand.
+func (h *Handler) ExportMeasureCalcs(w http.ResponseWriter, r *http.Request) {
+	if h.sf == nil {
+		http.Error(w, errNoSalesforce.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	p := new(ExportJobRequest)
+	if err := FromJSON(p, r.Body); err != nil {
+		h.l.Error("error decoding", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if p.Query == "" {
+		p.Query = h.cfg.MeasureCalcQuery
+	}
+	if p.Query == "" {
+		http.Error(w, "query is required", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	p.Mode, err = exportMode(p.Mode, ModeOverwrite)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Check the format and mode before starting the job.
+	if _, err := newExportSink(h.cfg.JsonDirPath, p.Mode, p.Format); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job := h.jobs.start()
+	if p.RunDir {
+		job.Dir = filepath.ToSlash(filepath.Join(runsDir, files.FileName(job.ID, "")))
+		h.jobs.update(job.ID, func(j *ExportJob) { j.Dir = job.Dir })
+	}
+	go h.runExportJob(job.ID, p)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := ToJSON(job, w); err != nil {
+		h.l.Error("error writing response", zap.Error(err))
+	}
+}
+
+func (h *Handler) runExportJob(id string, p *ExportJobRequest) {
+	l := h.l.With(zap.String("jobId", id))
+	ctx, cancel := context.WithTimeout(context.Background(), jobTimeout)
+	defer cancel()
+
+	err := h.exportMeasureCalcs(ctx, id, p)
+	h.jobs.update(id, func(j *ExportJob) {
+		j.State = JobCompleted
+		if err != nil {
+			j.State = JobFailed
+			j.Error = err.Error()
+		}
+	})
+	if err != nil {
+		l.Error("error running export job", zap.Error(err))
+		return
+	}
+	l.Info("export job completed")
+}
+
+func (h *Handler) exportMeasureCalcs(ctx context.Context, id string, p *ExportJobRequest) (err error) {
+	dir := h.cfg.JsonDirPath
+	if p.RunDir {
+		dir = h.runDir(id)
+	}
+	sink, err := newExportSink(dir, p.Mode, p.Format)
+	if err != nil {
+		return err
+	}
+	sink.idSuffix = p.IDSuffix
+	defer func() {
+		names := sink.names()
+		if cerr := sink.Close(); err == nil {
+			err = cerr
+		}
+		// Job files are listed relative to csvDirPath.
+		if rel, rerr := filepath.Rel(h.cfg.JsonDirPath, dir); rerr == nil && rel != "." {
+			for i, name := range names {
+				names[i] = filepath.ToSlash(filepath.Join(rel, name))
+			}
+		}
+		h.jobs.update(id, func(j *ExportJob) { j.Files = names })
+	}()
+
+	var mcs []MeasureCalcRecords
+	if err := h.sf.Query(ctx, p.Query, func(records []json.RawMessage) error {
+		for _, raw := range records {
+			var mc MeasureCalcRecords
+			if err := json.Unmarshal(raw, &mc); err != nil {
+				return err
+			}
+			mcs = append(mcs, mc)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	h.jobs.update(id, func(j *ExportJob) { j.MeasureCalcs = len(mcs) })
+
+	if err := h.writeMeasureCalcs(sink, mcs); err != nil {
+		return err
+	}
+	if err := h.writeMCLIToSearch(sink, mcs); err != nil {
+		return err
+	}
+	if len(mcs) == 0 {
+		_, err := h.writeMCLI(sink, nil)
+		return err
+	}
+
+	var mclis []MCLIRecords
+	if err := h.sf.QueryAll(ctx, mcliQuery(mcs), func(records []json.RawMessage) error {
+		for _, raw := range records {
+			var mcli MCLIRecords
+			if err := json.Unmarshal(raw, &mcli); err != nil {
+				return err
+			}
+			mclis = append(mclis, mcli)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	h.jobs.update(id, func(j *ExportJob) { j.LineItems = len(mclis) })
+
+	missing, err := h.writeMCLI(sink, mclis)
+	h.jobs.update(id, func(j *ExportJob) { j.MissingParents = missing })
+	return err
+}
+
+func (h *Handler) GetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.jobs.get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := ToJSON(job, w); err != nil {
+		h.l.Error("error writing response", zap.Error(err))
+	}
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/AmitSuresh/sfdataapp/files"
+)
+
+const (
+	// ModeAppend adds rows to existing files and writes the header only to
+	// new or empty ones.
+	ModeAppend = "append"
+	// ModeOverwrite truncates each file the first time it is written.
+	ModeOverwrite = "overwrite"
+)
+
+var errInvalidMode = errors.New("mode must be append or overwrite")
+
+// exportSink streams rows to files in a directory. Each file is opened once,
+// on its first row, and stays open until Close. File names follow
+// files.FileName and are recorded in the directory's manifest.
+type exportSink struct {
+	dir    string
+	mode   string
+	format *exportFormat
+	// idSuffix adds the record id to file names taken from records.
+	idSuffix bool
+	files    map[string]*exportFile
+	order    []string
+	manifest []files.ManifestEntry
+}
+
+type exportFile struct {
+	f    *os.File
+	w    rowWriter
+	path string
+	// tmp is set for formats that write a temporary file and rename it.
+	tmp bool
+}
+
+// exportMode returns mode, or def when it is empty.
+func exportMode(mode, def string) (string, error) {
+	switch mode {
+	case "":
+		return def, nil
+	case ModeAppend, ModeOverwrite:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("%w: %q", errInvalidMode, mode)
+	}
+}
+
+// newExportSink returns a sink writing format files to dir. An empty mode
+// appends when the format can.
+func newExportSink(dir, mode, format string) (*exportSink, error) {
+	f, err := lookupFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	def := ModeAppend
+	if !f.appendable {
+		def = ModeOverwrite
+	}
+	mode, err = exportMode(mode, def)
+	if err != nil {
+		return nil, err
+	}
+	if mode == ModeAppend && !f.appendable {
+		return nil, fmt.Errorf("%w: %s", errNoAppend, format)
+	}
+	if dir == "" {
+		// Without csvDirPath files have always been written to the working
+		// directory; they are just not served from there.
+		dir = "."
+	}
+	return &exportSink{dir: dir, mode: mode, format: f, files: make(map[string]*exportFile)}, nil
+}
+
+// open opens the file for name, and id when the sink adds ids, and writes
+// header unless the file is being appended to and already has content.
+func (s *exportSink) open(name, id string, header []string) (*exportFile, error) {
+	if !s.idSuffix {
+		id = ""
+	}
+	file := files.FileName(name, id)
+	if ef, ok := s.files[file]; ok {
+		return ef, nil
+	}
+
+	// Keep the file in dir even if a symlink is in the way.
+	if _, err := files.Resolve(s.dir, file+s.format.ext); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	ef := &exportFile{path: s.path(file), tmp: !s.format.appendable}
+
+	var err error
+	hasContent := false
+	if ef.tmp {
+		ef.f, err = tempFile(ef.path)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		flag := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		if s.mode == ModeOverwrite {
+			flag = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		}
+		ef.f, err = os.OpenFile(ef.path, flag, 0644)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := ef.f.Stat()
+		if err != nil {
+			ef.f.Close()
+			return nil, err
+		}
+		hasContent = fi.Size() > 0
+	}
+
+	ef.w, err = s.format.create(ef.f, header, hasContent)
+	if err != nil {
+		ef.discard()
+		return nil, err
+	}
+	s.files[file] = ef
+	s.order = append(s.order, file)
+	s.manifest = append(s.manifest, files.ManifestEntry{Name: name, ID: id, File: file + s.format.ext})
+	return ef, nil
+}
+
+// write adds row to the file for name and id, opening it with header if
+// needed. The row goes to sheet in formats that have sheets.
+func (s *exportSink) write(name, id, sheet string, header, row []string) error {
+	ef, err := s.open(name, id, header)
+	if err != nil {
+		return err
+	}
+	return ef.w.WriteRow(sheet, row)
+}
+
+// names returns the files the sink has written, and its manifest, relative
+// to its directory.
+func (s *exportSink) names() []string {
+	names := make([]string, 0, len(s.order)+1)
+	for _, file := range s.order {
+		names = append(names, file+s.format.ext)
+	}
+	if len(names) > 0 {
+		names = append(names, files.ManifestFile)
+	}
+	return names
+}
+
+func (s *exportSink) path(file string) string {
+	return filepath.Join(s.dir, file+s.format.ext)
+}
+
+// Close finishes every file, updates the manifest and returns the first
+// error. A file that fails to finish is left as it was before the export
+// when the format replaces files.
+func (s *exportSink) Close() error {
+	var first error
+	for _, file := range s.order {
+		if err := s.files[file].close(); err != nil && first == nil {
+			first = fmt.Errorf("writing %s: %w", s.path(file), err)
+		}
+	}
+	if err := files.UpdateManifest(s.dir, s.manifest); err != nil && first == nil {
+		first = fmt.Errorf("writing manifest: %w", err)
+	}
+	s.files = make(map[string]*exportFile)
+	s.order = nil
+	s.manifest = nil
+	return first
+}
+
+func (ef *exportFile) close() error {
+	if err := ef.w.Close(); err != nil {
+		ef.discard()
+		return err
+	}
+	if err := ef.f.Close(); err != nil {
+		if ef.tmp {
+			os.Remove(ef.f.Name())
+		}
+		return err
+	}
+	if !ef.tmp {
+		return nil
+	}
+	if err := os.Chmod(ef.f.Name(), 0644); err != nil {
+		os.Remove(ef.f.Name())
+		return err
+	}
+	if err := os.Rename(ef.f.Name(), ef.path); err != nil {
+		os.Remove(ef.f.Name())
+		return err
+	}
+	return nil
+}
+
+func (ef *exportFile) discard() {
+	ef.f.Close()
+	if ef.tmp {
+		os.Remove(ef.f.Name())
+	}
+}
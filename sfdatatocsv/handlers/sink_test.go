@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/AmitSuresh/sfdataapp/files"
+	"github.com/xuri/excelize/v2"
+)
+
+func writeRows(t *testing.T, dir, mode, format string, rows ...[]string) {
+	t.Helper()
+	s, err := newExportSink(dir, mode, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range rows {
+		if err := s.write("out", "", r[0], []string{"Id", "Name"}, r[1:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportSinkModes(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "out.csv")
+
+	writeRows(t, dir, "", "", []string{"", "a1", "A"}, []string{"", "a2", "B, Inc."})
+	writeRows(t, dir, ModeAppend, "csv", []string{"", "a3", "C"})
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Id,Name\na1,A\na2,\"B, Inc.\"\na3,C\n"; string(data) != want {
+		t.Errorf("after append %q, want %q", data, want)
+	}
+
+	writeRows(t, dir, ModeOverwrite, "csv", []string{"", "b1", "D"})
+	data, err = os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Id,Name\nb1,D\n"; string(data) != want {
+		t.Errorf("after overwrite %q, want %q", data, want)
+	}
+}
+
+func TestExportSinkJSONLines(t *testing.T) {
+	dir := t.TempDir()
+	writeRows(t, dir, "", "jsonl", []string{"", "a1", `say "hi"`}, []string{"", "a2"})
+
+	data, err := os.ReadFile(filepath.Join(dir, "out.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "{\"Id\":\"a1\",\"Name\":\"say \\\"hi\\\"\"}\n{\"Id\":\"a2\",\"Name\":\"\"}\n"; string(data) != want {
+		t.Errorf("jsonl = %q, want %q", data, want)
+	}
+}
+
+func TestExportSinkXLSXSheets(t *testing.T) {
+	dir := t.TempDir()
+	writeRows(t, dir, "", "xlsx", []string{"Program A", "a1", "A"}, []string{"Program B", "b1", "B"}, []string{"Program A", "a2", "C"})
+
+	f, err := excelize.OpenFile(filepath.Join(dir, "out.xlsx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if sheets := f.GetSheetList(); !reflect.DeepEqual(sheets, []string{"Program A", "Program B"}) {
+		t.Errorf("sheets = %q, want Program A and Program B", sheets)
+	}
+	rows, err := f.GetRows("Program A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{"Id", "Name"}, {"a1", "A"}, {"a2", "C"}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("Program A rows = %q, want %q", rows, want)
+	}
+}
+
+func TestNewExportSinkErrors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := newExportSink(dir, "replace", "csv"); !errors.Is(err, errInvalidMode) {
+		t.Errorf("invalid mode: error = %v, want errInvalidMode", err)
+	}
+	if _, err := newExportSink(dir, "", "pdf"); !errors.Is(err, errInvalidFormat) {
+		t.Errorf("invalid format: error = %v, want errInvalidFormat", err)
+	}
+	if _, err := newExportSink(dir, ModeAppend, "parquet"); !errors.Is(err, errNoAppend) {
+		t.Errorf("appending parquet: error = %v, want errNoAppend", err)
+	}
+}
+
+func TestExportSinkSanitizesNames(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newExportSink(dir, "", "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.write("Program A/B", "", "", []string{"Id"}, []string{"a1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file := files.FileName("Program A/B", "") + ".csv"
+	if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+		t.Errorf("export file: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, files.ManifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest []files.ManifestEntry
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if want := []files.ManifestEntry{{Name: "Program A/B", File: file}}; !reflect.DeepEqual(manifest, want) {
+		t.Errorf("manifest = %+v, want %+v", manifest, want)
+	}
+}
@@ -1,49 +1,206 @@
-package handlers
-
-import "go.uber.org/zap"
-
-type Handler struct {
-	l       *zap.Logger
-	cfg     *Config
-	mcIdMap map[string]MeasureCalcRecords
-}
-
-type MeasureCalcsResponse struct {
-	TotalSize          int                  `json:"totalSize"`
-	Done               bool                 `json:"done"`
-	MeasureCalcRecords []MeasureCalcRecords `json:"records"`
-}
-
-type MeasureCalcRecords struct {
-	Attributes  Attributes `json:"attributes"`
-	FieldToCalc string     `json:"CLI_CNR_Field_to_calculate__c"`
-	Formula     string     `json:"CLR_CNI_Mesaure_Formula__c"`
-	Sequence    float32    `json:"CLR_CNI_Sequence__c"`
-	Id          string     `json:"Id"`
-	Name        string     `json:"Name"`
-	ProgramName string     `json:"Program_Name__c"`
-	IsDeleted   bool       `json:"IsDeleted"`
-}
-
-type MCLIResponse struct {
-	TotalSize   int           `json:"totalSize"`
-	Done        bool          `json:"done"`
-	MCLIRecords []MCLIRecords `json:"records"`
-}
-
-type MCLIRecords struct {
-	Attributes  Attributes `json:"attributes"`
-	Condition   string     `json:"Condition__c"`
-	Formula     string     `json:"Measure_Formula__c"`
-	Id          string     `json:"Id"`
-	MeasureCalc string     `json:"Measure_Calculation__c"`
-	IsDeleted   bool       `json:"IsDeleted"`
-}
-
-type Attributes struct {
-	Type string `json:"type"`
-}
-
-type Config struct {
-	JsonDirPath string
-}
+package handlers
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/AmitSuresh/sfdataapp/files"
+	"github.com/AmitSuresh/sfdataapp/salesforce"
+	"go.uber.org/zap"
+)
+
+type Handler struct {
+	l       *zap.Logger
+	cfg     *Config
+	mcIndex *mcIndex
+	sf      *salesforce.Client
+	jobs    *jobTracker
+	// files serves csvDirPath; it is nil when csvDirPath is not set.
+	files *files.Server
+}
+
+type MeasureCalcsResponse struct {
+	TotalSize          int                  `json:"totalSize"`
+	Done               bool                 `json:"done"`
+	MeasureCalcRecords []MeasureCalcRecords `json:"records"`
+}
+
+type MeasureCalcRecords struct {
+	Attributes  Attributes `json:"attributes"`
+	FieldToCalc string     `json:"CLI_CNR_Field_to_calculate__c"`
+	Formula     string     `json:"CLR_CNI_Mesaure_Formula__c"`
+	Sequence    float32    `json:"CLR_CNI_Sequence__c"`
+	Id          string     `json:"Id"`
+	Name        string     `json:"Name"`
+	ProgramName string     `json:"Program_Name__c"`
+	IsDeleted   bool       `json:"IsDeleted"`
+}
+
+type MCLIResponse struct {
+	TotalSize   int           `json:"totalSize"`
+	Done        bool          `json:"done"`
+	MCLIRecords []MCLIRecords `json:"records"`
+}
+
+type MCLIRecords struct {
+	Attributes  Attributes `json:"attributes"`
+	Condition   string     `json:"Condition__c"`
+	Formula     string     `json:"Measure_Formula__c"`
+	Id          string     `json:"Id"`
+	MeasureCalc string     `json:"Measure_Calculation__c"`
+	IsDeleted   bool       `json:"IsDeleted"`
+}
+
+// QueryResponse is a Salesforce query response whose records have not been
+// decoded, so that any sObject can be exported.
+type QueryResponse struct {
+	TotalSize      int               `json:"totalSize"`
+	Done           bool              `json:"done"`
+	NextRecordsURL string            `json:"nextRecordsUrl,omitempty"`
+	Records        []json.RawMessage `json:"records"`
+}
+
+// ExportRequest is either a query response to export or, when Query is set,
+// a SOQL query to run against Salesforce.
+type ExportRequest struct {
+	Query string `json:"query,omitempty"`
+	QueryResponse
+}
+
+type ExportResult struct {
+	File    string   `json:"file"`
+	Columns []string `json:"columns"`
+	Rows    int      `json:"rows"`
+}
+
+type Attributes struct {
+	Type string `json:"type"`
+}
+
+type Config struct {
+	JsonDirPath      string
+	MeasureCalcQuery string
+	MCIndexPath      string
+}
+
+type ExportJobRequest struct {
+	Query string `json:"query"`
+	// Mode is overwrite (the default) or append.
+	Mode string `json:"mode,omitempty"`
+	// Format is csv (the default), xlsx, jsonl or parquet.
+	Format string `json:"format,omitempty"`
+	// RunDir writes the files to runs/<job id> below csvDirPath.
+	RunDir bool `json:"runDir,omitempty"`
+	// IDSuffix adds the record id to file names taken from record names.
+	IDSuffix bool `json:"idSuffix,omitempty"`
+}
+
+type ExportJob struct {
+	ID           string `json:"id"`
+	State        string `json:"state"`
+	Error        string `json:"error,omitempty"`
+	MeasureCalcs int    `json:"measureCalculations"`
+	LineItems    int    `json:"lineItems"`
+	// MissingParents counts line items whose Measure Calculation is unknown.
+	MissingParents int `json:"missingParents"`
+	// Dir is the job's run directory, relative to csvDirPath.
+	Dir string `json:"dir,omitempty"`
+	// Files are the files the job wrote, relative to csvDirPath.
+	Files     []string  `json:"files,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// EvaluateRequest runs the Measure Calculations of Program against sample
+// records. Without MeasureCalcs the program's indexed calculations are used.
+// Without LineItems the line items are queried from Salesforce when a
+// connection is configured.
+type EvaluateRequest struct {
+	Program      string                   `json:"program"`
+	MeasureCalcs []MeasureCalcRecords     `json:"measureCalculations,omitempty"`
+	LineItems    []MCLIRecords            `json:"lineItems,omitempty"`
+	Records      []map[string]interface{} `json:"records"`
+	// Fields are input field names that are known even though no sample
+	// record sets them.
+	Fields []string `json:"fields,omitempty"`
+}
+
+// FormulaError is a formula that cannot be parsed or that references a field
+// that is neither an input field nor calculated by an earlier calculation.
+type FormulaError struct {
+	MeasureCalc   string   `json:"measureCalculation"`
+	MeasureCalcID string   `json:"measureCalculationId"`
+	LineItemID    string   `json:"lineItemId,omitempty"`
+	Field         string   `json:"field"`
+	Formula       string   `json:"formula"`
+	Error         string   `json:"error,omitempty"`
+	Pos           int      `json:"pos,omitempty"`
+	UnknownFields []string `json:"unknownFields,omitempty"`
+}
+
+type EvaluateResponse struct {
+	Errors  []FormulaError   `json:"errors,omitempty"`
+	Results []EvaluateResult `json:"results"`
+}
+
+// EvaluateResult holds the values calculated for one sample record, by field,
+// and the steps that calculated them in Sequence order.
+type EvaluateResult struct {
+	Values map[string]interface{} `json:"values"`
+	Steps  []EvaluateStep         `json:"steps"`
+}
+
+type EvaluateStep struct {
+	MeasureCalc string      `json:"measureCalculation"`
+	Field       string      `json:"field"`
+	LineItemID  string      `json:"lineItemId,omitempty"`
+	Value       interface{} `json:"value"`
+	Error       string      `json:"error,omitempty"`
+}
+
+// GraphRequest selects the Measure Calculations to graph. Without
+// MeasureCalcs the indexed calculations are used, only those of Program if
+// it is set.
+type GraphRequest struct {
+	Program      string               `json:"program,omitempty"`
+	MeasureCalcs []MeasureCalcRecords `json:"measureCalculations,omitempty"`
+	LineItems    []MCLIRecords        `json:"lineItems,omitempty"`
+}
+
+// CalcGraph links each Measure Calculation to the calculations whose fields
+// its formulas, or its line items' formulas and conditions, use.
+type CalcGraph struct {
+	Nodes    []GraphNode    `json:"nodes"`
+	Edges    []GraphEdge    `json:"edges"`
+	Problems []GraphProblem `json:"problems"`
+	Files    []string       `json:"files,omitempty"`
+}
+
+type GraphNode struct {
+	ID       string  `json:"id"`
+	Name     string  `json:"name"`
+	Program  string  `json:"program"`
+	Field    string  `json:"field"`
+	Sequence float32 `json:"sequence"`
+	InCycle  bool    `json:"inCycle,omitempty"`
+}
+
+// GraphEdge says that To uses Field, which From calculates. LineItemID is set
+// when the field is used by one of To's line items. Problem is cycle or
+// sequence when the edge is part of one.
+type GraphEdge struct {
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Field      string `json:"field"`
+	LineItemID string `json:"lineItemId,omitempty"`
+	Problem    string `json:"problem,omitempty"`
+}
+
+type GraphProblem struct {
+	Program       string `json:"program"`
+	Kind          string `json:"kind"`
+	MeasureCalc   string `json:"measureCalculation"`
+	MeasureCalcID string `json:"measureCalculationId"`
+	Field         string `json:"field,omitempty"`
+	Detail        string `json:"detail"`
+}
@@ -0,0 +1,209 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/AmitSuresh/sfdataapp/files"
+	rbmq "github.com/AmitSuresh/sfdataapp/rabbitmq"
+	"go.uber.org/zap"
+)
+
+// FileStore keeps the original layout: one <program>.json file per program
+// holding a PicklistMappedResp. Program names are turned into file names by
+// files.FileName and recorded in the directory's manifest.
+type FileStore struct {
+	dir   string
+	l     *zap.Logger
+	locks keyedMutex
+}
+
+func NewFileStore(dir string, l *zap.Logger) *FileStore {
+	return &FileStore{dir: dir, l: l}
+}
+
+func (s *FileStore) path(program string) string {
+	return filepath.Join(s.dir, files.FileName(program, "")+".json")
+}
+
+func (s *FileStore) Save(ctx context.Context, program string, m *rbmq.PicklistMappedResp) error {
+	if err := os.MkdirAll(s.dir, os.ModePerm); err != nil {
+		s.l.Error("error creating directory", zap.Error(err))
+		return err
+	}
+
+	defer s.locks.Lock(program)()
+
+	fName := s.path(program)
+	_, statErr := os.Stat(fName)
+	existing, err := readMapping(fName)
+	if err != nil {
+		s.l.Error("error reading existing JSON file", zap.String("file", fName), zap.Error(err))
+		return err
+	}
+
+	existing.Recs = dedupe(append(existing.Recs, m.Recs...))
+	existing.Eqs = dedupe(append(existing.Eqs, m.Eqs...))
+	existing.Other = dedupe(append(existing.Other, m.Other...))
+
+	data, err := json.Marshal(existing)
+	if err != nil {
+		s.l.Error("error marshalling updated picklist values", zap.Error(err))
+		return err
+	}
+
+	if err := files.WriteFile(fName, data); err != nil {
+		s.l.Error("error writing file", zap.String("file", fName), zap.Error(err))
+		return err
+	}
+
+	if errors.Is(statErr, os.ErrNotExist) {
+		entry := files.ManifestEntry{Name: program, File: filepath.Base(fName)}
+		if err := files.UpdateManifest(s.dir, []files.ManifestEntry{entry}); err != nil {
+			s.l.Error("error updating manifest", zap.Error(err))
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileStore) Find(ctx context.Context, q Query) (*rbmq.PicklistMappedResp, error) {
+	var paths []string
+	if q.Program != "" {
+		paths = []string{s.path(q.Program)}
+	} else {
+		var err error
+		paths, err = filepath.Glob(filepath.Join(s.dir, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := new(rbmq.PicklistMappedResp)
+	for _, f := range paths {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if filepath.Base(f) == files.ManifestFile {
+			continue
+		}
+		m, err := readMapping(f)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range m.Recs {
+			if q.matches(r.ProgName, r.MeasureName, RecordTypeRecommendation) {
+				res.Recs = append(res.Recs, r)
+			}
+		}
+		for _, r := range m.Eqs {
+			if q.matches(r.ProgName, r.MeasureName, RecordTypeDirectInstall) {
+				res.Eqs = append(res.Eqs, r)
+			}
+		}
+		for _, r := range m.Other {
+			if q.matches(r.ProgName, r.MeasureName, r.RecordType) {
+				res.Other = append(res.Other, r)
+			}
+		}
+	}
+	return res, nil
+}
+
+// runPath keeps run files under <dir>/runs. IDs that are not plain file names
+// are rejected.
+func (s *FileStore) runPath(id string) (string, error) {
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return "", fmt.Errorf("invalid run id %q", id)
+	}
+	return filepath.Join(s.dir, "runs", id+".json"), nil
+}
+
+func (s *FileStore) SaveRun(ctx context.Context, run *Run) error {
+	fName, err := s.runPath(run.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fName), os.ModePerm); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	return files.WriteFile(fName, data)
+}
+
+func (s *FileStore) FindRun(ctx context.Context, id string) (*Run, error) {
+	fName, err := s.runPath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(fName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrRunNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	run := new(Run)
+	if err := json.Unmarshal(data, run); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+func (s *FileStore) Close() error {
+	return nil
+}
+
+// readMapping loads a program file, treating a missing file as empty.
+func readMapping(name string) (*rbmq.PicklistMappedResp, error) {
+	m := new(rbmq.PicklistMappedResp)
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return m, nil
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// keyedMutex serializes work per key, here per program file, while letting
+// different keys proceed in parallel.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func (k *keyedMutex) Lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*sync.Mutex)
+	}
+	m, ok := k.locks[key]
+	if !ok {
+		m = &sync.Mutex{}
+		k.locks[key] = m
+	}
+	k.mu.Unlock()
+
+	m.Lock()
+	return m.Unlock
+}
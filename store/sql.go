@@ -0,0 +1,275 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	rbmq "github.com/AmitSuresh/sfdataapp/rabbitmq"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"go.uber.org/zap"
+	_ "modernc.org/sqlite"
+)
+
+const mappingSchema = `
+CREATE TABLE IF NOT EXISTS picklist_mappings (
+	program        TEXT NOT NULL,
+	measure        TEXT NOT NULL,
+	record_type    TEXT NOT NULL,
+	picklist_value TEXT NOT NULL,
+	PRIMARY KEY (program, measure, record_type, picklist_value)
+);
+CREATE INDEX IF NOT EXISTS picklist_mappings_measure_idx ON picklist_mappings (measure);
+CREATE INDEX IF NOT EXISTS picklist_mappings_record_type_idx ON picklist_mappings (record_type);
+CREATE TABLE IF NOT EXISTS picklist_runs (
+	id             TEXT PRIMARY KEY,
+	correlation_id TEXT NOT NULL DEFAULT '',
+	state          TEXT NOT NULL,
+	published      INTEGER NOT NULL DEFAULT 0,
+	succeeded      INTEGER NOT NULL DEFAULT 0,
+	failed         INTEGER NOT NULL DEFAULT 0,
+	error          TEXT NOT NULL DEFAULT '',
+	failures       TEXT NOT NULL DEFAULT '',
+	jobs           TEXT NOT NULL DEFAULT '',
+	created_at     BIGINT NOT NULL,
+	updated_at     BIGINT NOT NULL
+);
+`
+
+// addedRunColumns were added to picklist_runs after it was first released and
+// are added to older databases when the store is opened. failures and jobs
+// hold JSON.
+var addedRunColumns = []string{"failures", "jobs", "correlation_id"}
+
+// SQLStore keeps one row per (program, measure, record type, picklist value).
+// The same queries run on SQLite and Postgres; only placeholders differ.
+type SQLStore struct {
+	db       *sql.DB
+	l        *zap.Logger
+	numbered bool
+}
+
+func NewSqliteStore(path string, l *zap.Logger) (*SQLStore, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		l.Error("error opening mapping database", zap.Error(err))
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return newSQLStore(db, false, l)
+}
+
+func NewPostgresStore(url string, l *zap.Logger) (*SQLStore, error) {
+	if url == "" {
+		return nil, fmt.Errorf("mappingPostgresURL is not set")
+	}
+	db, err := sql.Open("pgx", url)
+	if err != nil {
+		l.Error("error opening mapping database", zap.Error(err))
+		return nil, err
+	}
+	return newSQLStore(db, true, l)
+}
+
+func newSQLStore(db *sql.DB, numbered bool, l *zap.Logger) (*SQLStore, error) {
+	s := &SQLStore{db: db, l: l, numbered: numbered}
+	for _, stmt := range strings.Split(mappingSchema, ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		if _, err := db.Exec(stmt); err != nil {
+			l.Error("error creating mapping schema", zap.Error(err))
+			db.Close()
+			return nil, err
+		}
+	}
+	if err := s.addRunColumns(); err != nil {
+		l.Error("error migrating mapping schema", zap.Error(err))
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// addRunColumns adds the addedRunColumns a database created by an older
+// version lacks. Probing with a SELECT works on SQLite and Postgres.
+func (s *SQLStore) addRunColumns() error {
+	for _, c := range addedRunColumns {
+		if _, err := s.db.Exec("SELECT " + c + " FROM picklist_runs WHERE 1 = 0"); err == nil {
+			continue
+		}
+		if _, err := s.db.Exec("ALTER TABLE picklist_runs ADD COLUMN " + c + " TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebind rewrites ? placeholders as $1, $2, ... for Postgres.
+func (s *SQLStore) rebind(query string) string {
+	if !s.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *SQLStore) Save(ctx context.Context, program string, m *rbmq.PicklistMappedResp) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, s.rebind(`INSERT INTO picklist_mappings (program, measure, record_type, picklist_value)
+		VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING`))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, r := range m.Recs {
+		if _, err := stmt.ExecContext(ctx, r.ProgName, r.MeasureName, RecordTypeRecommendation, r.PicklistVal); err != nil {
+			return err
+		}
+	}
+	for _, r := range m.Eqs {
+		if _, err := stmt.ExecContext(ctx, r.ProgName, r.MeasureName, RecordTypeDirectInstall, r.PicklistVal); err != nil {
+			return err
+		}
+	}
+	for _, r := range m.Other {
+		if _, err := stmt.ExecContext(ctx, r.ProgName, r.MeasureName, r.RecordType, r.PicklistVal); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) Find(ctx context.Context, q Query) (*rbmq.PicklistMappedResp, error) {
+	var (
+		where []string
+		args  []interface{}
+	)
+	if q.Program != "" {
+		where = append(where, "program = ?")
+		args = append(args, q.Program)
+	}
+	if q.Measure != "" {
+		where = append(where, "measure = ?")
+		args = append(args, q.Measure)
+	}
+	if q.RecordType != "" {
+		where = append(where, "record_type = ?")
+		args = append(args, q.RecordType)
+	}
+
+	query := `SELECT program, measure, record_type, picklist_value FROM picklist_mappings`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY program, measure, picklist_value"
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := new(rbmq.PicklistMappedResp)
+	for rows.Next() {
+		var program, measure, recordType, value string
+		if err := rows.Scan(&program, &measure, &recordType, &value); err != nil {
+			return nil, err
+		}
+		switch recordType {
+		case RecordTypeRecommendation:
+			res.Recs = append(res.Recs, rbmq.RecommendationRecord{ProgName: program, MeasureName: measure, PicklistVal: value})
+		case RecordTypeDirectInstall:
+			res.Eqs = append(res.Eqs, rbmq.EquipmentRecord{ProgName: program, MeasureName: measure, PicklistVal: value})
+		default:
+			res.Other = append(res.Other, rbmq.MappingRecord{RecordType: recordType, ProgName: program, MeasureName: measure, PicklistVal: value})
+		}
+	}
+	return res, rows.Err()
+}
+
+// SaveRun upserts the run. Timestamps are stored as Unix milliseconds and
+// failures and jobs as JSON so the schema is the same on both databases.
+func (s *SQLStore) SaveRun(ctx context.Context, run *Run) error {
+	failures, err := marshalDetails(run.Failures)
+	if err != nil {
+		return err
+	}
+	jobs, err := marshalDetails(run.Jobs)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, s.rebind(`INSERT INTO picklist_runs (id, correlation_id, state, published, succeeded, failed, error, failures, jobs, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET state = excluded.state, published = excluded.published,
+			succeeded = excluded.succeeded, failed = excluded.failed, error = excluded.error,
+			failures = excluded.failures, jobs = excluded.jobs, updated_at = excluded.updated_at`),
+		run.ID, run.CorrelationID, run.State, run.Published, run.Succeeded, run.Failed, run.Error, failures, jobs,
+		run.CreatedAt.UnixMilli(), run.UpdatedAt.UnixMilli())
+	return err
+}
+
+func (s *SQLStore) FindRun(ctx context.Context, id string) (*Run, error) {
+	run := &Run{ID: id}
+	var failures, jobs string
+	var created, updated int64
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT correlation_id, state, published, succeeded, failed, error, failures, jobs, created_at, updated_at
+		FROM picklist_runs WHERE id = ?`), id).
+		Scan(&run.CorrelationID, &run.State, &run.Published, &run.Succeeded, &run.Failed, &run.Error, &failures, &jobs, &created, &updated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRunNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := unmarshalDetails(failures, &run.Failures); err != nil {
+		return nil, err
+	}
+	if err := unmarshalDetails(jobs, &run.Jobs); err != nil {
+		return nil, err
+	}
+	run.CreatedAt = time.UnixMilli(created).UTC()
+	run.UpdatedAt = time.UnixMilli(updated).UTC()
+	return run, nil
+}
+
+// marshalDetails encodes a run's failures or jobs, storing none as an empty
+// string.
+func marshalDetails[T any](v []T) (string, error) {
+	if len(v) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+func unmarshalDetails[T any](data string, v *[]T) error {
+	if data == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(data), v)
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	rbmq "github.com/AmitSuresh/sfdataapp/rabbitmq"
+	"go.uber.org/zap"
+)
+
+const (
+	BackendFile     = "file"
+	BackendSqlite   = "sqlite"
+	BackendPostgres = "postgres"
+
+	RecordTypeRecommendation = "Recommendation"
+	RecordTypeDirectInstall  = "Direct Install"
+
+	defaultSqlitePath = "sfdataapp-mappings.db"
+)
+
+var ErrRunNotFound = errors.New("run not found")
+
+// Store persists picklist mapping rows and run progress. Save merges rows into
+// what is already stored for a program and ignores rows that are already
+// present. SaveRun replaces the stored progress of run.ID.
+type Store interface {
+	Save(ctx context.Context, program string, m *rbmq.PicklistMappedResp) error
+	Find(ctx context.Context, q Query) (*rbmq.PicklistMappedResp, error)
+	SaveRun(ctx context.Context, run *Run) error
+	FindRun(ctx context.Context, id string) (*Run, error)
+	Close() error
+}
+
+// ConfigFromEnv reads mappingStore ("file", "sqlite" or "postgres"),
+// mappingDBPath and mappingPostgresURL. The file backend writes to dir.
+func ConfigFromEnv(dir string) *Config {
+	return &Config{
+		Backend:     os.Getenv("mappingStore"),
+		Dir:         dir,
+		SqlitePath:  os.Getenv("mappingDBPath"),
+		PostgresURL: os.Getenv("mappingPostgresURL"),
+	}
+}
+
+// New opens the backend named by cfg.Backend, defaulting to one JSON file per
+// program under cfg.Dir.
+func New(cfg *Config, l *zap.Logger) (Store, error) {
+	switch cfg.Backend {
+	case "", BackendFile:
+		return NewFileStore(cfg.Dir, l), nil
+	case BackendSqlite:
+		path := cfg.SqlitePath
+		if path == "" {
+			path = defaultSqlitePath
+		}
+		return NewSqliteStore(path, l)
+	case BackendPostgres:
+		return NewPostgresStore(cfg.PostgresURL, l)
+	default:
+		return nil, fmt.Errorf("unknown mapping store %q", cfg.Backend)
+	}
+}
+
+// matches reports whether a row of recordType for program and measure is
+// selected by q.
+func (q Query) matches(program, measure, recordType string) bool {
+	return (q.Program == "" || q.Program == program) &&
+		(q.Measure == "" || q.Measure == measure) &&
+		(q.RecordType == "" || q.RecordType == recordType)
+}
+
+func dedupe[T comparable](recs []T) []T {
+	seen := make(map[T]struct{}, len(recs))
+	out := recs[:0]
+	for _, r := range recs {
+		if _, ok := seen[r]; ok {
+			continue
+		}
+		seen[r] = struct{}{}
+		out = append(out, r)
+	}
+	return out
+}
@@ -0,0 +1,153 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	rbmq "github.com/AmitSuresh/sfdataapp/rabbitmq"
+	"go.uber.org/zap"
+)
+
+// testStores opens the backends that need nothing outside the test.
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	dir := t.TempDir()
+	stores := make(map[string]Store)
+	for _, cfg := range []*Config{
+		{Backend: BackendFile, Dir: filepath.Join(dir, "mappings")},
+		{Backend: BackendSqlite, SqlitePath: filepath.Join(dir, "mappings.db")},
+	} {
+		s, err := New(cfg, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		stores[cfg.Backend] = s
+	}
+	return stores
+}
+
+func TestStoreSaveFind(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			saves := []*rbmq.PicklistMappedResp{
+				{Recs: []rbmq.RecommendationRecord{{ProgName: "P", MeasureName: "M", PicklistVal: "A"}, {ProgName: "P", MeasureName: "M", PicklistVal: "A"}}},
+				{Recs: []rbmq.RecommendationRecord{{ProgName: "P", MeasureName: "M", PicklistVal: "A"}, {ProgName: "P", MeasureName: "M", PicklistVal: "B"}}},
+				{Eqs: []rbmq.EquipmentRecord{{ProgName: "P", MeasureName: "N", PicklistVal: "Furnace"}}},
+				{Recs: []rbmq.RecommendationRecord{{ProgName: "Q", MeasureName: "M", PicklistVal: "C"}}},
+			}
+			for _, m := range saves {
+				program := "P"
+				if len(m.Recs) > 0 {
+					program = m.Recs[0].ProgName
+				}
+				if err := s.Save(ctx, program, m); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := s.Find(ctx, Query{Program: "P"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantRecs := rbmq.RecommendationRecords{{ProgName: "P", MeasureName: "M", PicklistVal: "A"}, {ProgName: "P", MeasureName: "M", PicklistVal: "B"}}
+			if !reflect.DeepEqual(got.Recs, wantRecs) || len(got.Eqs) != 1 {
+				t.Errorf("Find(P) = %+v, want %+v and one equipment row", got, wantRecs)
+			}
+
+			got, err = s.Find(ctx, Query{Measure: "M", RecordType: RecordTypeRecommendation})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Recs) != 3 || len(got.Eqs) != 0 {
+				t.Errorf("Find(M, Recommendation) = %+v, want 3 recommendation rows", got)
+			}
+		})
+	}
+}
+
+func TestFileStoreLeavesNoTemporaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	s := NewFileStore(dir, zap.NewNop())
+	m := &rbmq.PicklistMappedResp{Recs: []rbmq.RecommendationRecord{{ProgName: "P", MeasureName: "M", PicklistVal: "A"}}}
+	if err := s.Save(context.Background(), "P", m); err != nil {
+		t.Fatal(err)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmp) > 0 {
+		t.Errorf("temporary files left behind: %q", tmp)
+	}
+}
+
+func TestStoreRuns(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := s.FindRun(ctx, "run-1"); err != ErrRunNotFound {
+				t.Errorf("FindRun of a missing run: error = %v, want ErrRunNotFound", err)
+			}
+
+			created := time.Now().UTC().Truncate(time.Millisecond)
+			run := &Run{ID: "run-1", CorrelationID: "trace-1", State: "processing", Published: 2, CreatedAt: created, UpdatedAt: created}
+			if err := s.SaveRun(ctx, run); err != nil {
+				t.Fatal(err)
+			}
+			run.State, run.Succeeded, run.Failed, run.Error = "failed", 1, 1, "bulk load failed"
+			run.Failures = []RunFailure{{RecordID: "a1", RecordType: "Recommendation", Error: "no picklist value"}}
+			run.Jobs = []RunJob{{Category: "Direct Install", Object: "Measure_Equipment_Type__c", JobID: "7501", Records: 1, Error: "batch rejected"}}
+			run.UpdatedAt = created.Add(time.Second)
+			if err := s.SaveRun(ctx, run); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := s.FindRun(ctx, "run-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, run) {
+				t.Errorf("FindRun = %+v, want %+v", got, run)
+			}
+		})
+	}
+}
+
+// TestSqliteStoreAddsRunColumns opens a database created before runs kept
+// their correlation ID, failures and jobs.
+func TestSqliteStoreAddsRunColumns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mappings.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE picklist_runs (
+		id TEXT PRIMARY KEY, state TEXT NOT NULL, published INTEGER NOT NULL DEFAULT 0,
+		succeeded INTEGER NOT NULL DEFAULT 0, failed INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '', created_at BIGINT NOT NULL, updated_at BIGINT NOT NULL);
+		INSERT INTO picklist_runs (id, state, created_at, updated_at) VALUES ('old', 'completed', 0, 0)`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSqliteStore(path, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	if run, err := s.FindRun(ctx, "old"); err != nil || run.State != "completed" || run.Jobs != nil {
+		t.Errorf("FindRun(old) = %+v, %v", run, err)
+	}
+	run := &Run{ID: "new", State: "completed", Jobs: []RunJob{{Category: "Recommendation", JobID: "7501", Records: 2}}}
+	if err := s.SaveRun(ctx, run); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.FindRun(ctx, "new"); err != nil || !reflect.DeepEqual(got.Jobs, run.Jobs) {
+		t.Errorf("FindRun(new) = %+v, %v, want jobs %+v", got, err, run.Jobs)
+	}
+}
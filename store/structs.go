@@ -0,0 +1,48 @@
+package store
+
+import "time"
+
+type Config struct {
+	Backend     string
+	Dir         string
+	SqlitePath  string
+	PostgresURL string
+}
+
+// Query selects mapping rows. Empty fields match everything.
+type Query struct {
+	Program    string
+	Measure    string
+	RecordType string
+}
+
+// Run is the progress of one picklist mapping run.
+type Run struct {
+	ID            string       `json:"id"`
+	CorrelationID string       `json:"correlationId,omitempty"`
+	State         string       `json:"state"`
+	Published     int          `json:"published"`
+	Succeeded     int          `json:"succeeded"`
+	Failed        int          `json:"failed"`
+	Error         string       `json:"error,omitempty"`
+	Failures      []RunFailure `json:"failures,omitempty"`
+	Jobs          []RunJob     `json:"jobs,omitempty"`
+	CreatedAt     time.Time    `json:"createdAt"`
+	UpdatedAt     time.Time    `json:"updatedAt"`
+}
+
+// RunFailure is a record of a run that could not be published or mapped.
+type RunFailure struct {
+	RecordID   string `json:"recordId"`
+	RecordType string `json:"recordType"`
+	Error      string `json:"error"`
+}
+
+// RunJob is a Bulk API job that loaded the rows of one category of a run.
+type RunJob struct {
+	Category string `json:"category"`
+	Object   string `json:"object,omitempty"`
+	JobID    string `json:"jobId,omitempty"`
+	Records  int    `json:"records"`
+	Error    string `json:"error,omitempty"`
+}